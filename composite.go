@@ -0,0 +1,121 @@
+package jsonapi
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CompositeIDSeparator is the default separator joining the parts of a
+// composite id, built from several primary fields tagged with a "key=<n>"
+// option, e.g.
+//
+//	type Membership struct {
+//		TenantID string `jsonapi:"primary,memberships,key=1"`
+//		UserID   int    `jsonapi:"primary,memberships,key=2"`
+//	}
+//
+// is written with the id "acme:42". Any "%" and separator characters within a
+// part are percent-encoded ("%25", "%3A"), so parts can hold any value. The
+// separator can be changed with the CompositeIDSeparator field of
+// MarshalOptions and UnmarshalOptions.
+const CompositeIDSeparator = ":"
+
+func (o *MarshalOptions) compositeIDSeparator() string {
+	if o == nil || o.CompositeIDSeparator == "" {
+		return CompositeIDSeparator
+	}
+	return o.CompositeIDSeparator
+}
+
+func (o *UnmarshalOptions) compositeIDSeparator() string {
+	if o == nil || o.CompositeIDSeparator == "" {
+		return CompositeIDSeparator
+	}
+	return o.CompositeIDSeparator
+}
+
+// compositePart is the formatted value of the primary field with key n.
+type compositePart struct {
+	n  int
+	id string
+}
+
+// compositeKey returns the position of a primary field in a composite id,
+// from its "key=<n>" tag option.
+func compositeKey(args []string) (n int, ok bool, err error) {
+	if len(args) < 3 {
+		return 0, false, nil
+	}
+	for _, arg := range args[2:] {
+		if v, found := tagOptionValue(arg, annotationKey); found {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return 0, true, ErrBadJSONAPIStructTag
+			}
+			return n, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// compositeKeyCount returns the number of primary fields of the struct type t
+// that are part of a composite id.
+func compositeKeyCount(t reflect.Type) int {
+	count := 0
+	for i := 0; i < t.NumField(); i++ {
+		args := strings.Split(t.Field(i).Tag.Get(annotationJSONAPI), annotationSeperator)
+		if args[0] != annotationPrimary {
+			continue
+		}
+		if _, ok, _ := compositeKey(args); ok {
+			count++
+		}
+	}
+	return count
+}
+
+// joinCompositeID escapes and joins the parts with sep, which must have the
+// keys 1 to len(parts).
+func joinCompositeID(parts []compositePart, sep string) (string, error) {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].n < parts[j].n })
+
+	escaped := make([]string, len(parts))
+	for i, p := range parts {
+		if p.n != i+1 {
+			return "", ErrBadJSONAPIStructTag
+		}
+		escaped[i] = escapeCompositePart(p.id, sep)
+	}
+	return strings.Join(escaped, sep), nil
+}
+
+// splitCompositeID splits id into its n unescaped parts separated by sep.
+func splitCompositeID(id string, n int, sep string) ([]string, error) {
+	parts := strings.Split(id, sep)
+	if len(parts) != n {
+		return nil, ErrBadJSONAPIID
+	}
+
+	for i, p := range parts {
+		unescaped, err := url.PathUnescape(p)
+		if err != nil {
+			return nil, ErrBadJSONAPIID
+		}
+		parts[i] = unescaped
+	}
+	return parts, nil
+}
+
+func escapeCompositePart(part, sep string) string {
+	part = strings.ReplaceAll(part, "%", "%25")
+
+	var escapedSep strings.Builder
+	for _, b := range []byte(sep) {
+		fmt.Fprintf(&escapedSep, "%%%02X", b)
+	}
+	return strings.ReplaceAll(part, sep, escapedSep.String())
+}
@@ -0,0 +1,82 @@
+package jsonapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestCompositeID(t *testing.T) {
+	for tenant, id := range map[string]string{
+		"acme":     "acme:42",
+		"a:b%c":    "a%3Ab%25c:42",
+		"100%:off": "100%25%3Aoff:42",
+	} {
+		membership := &Membership{TenantID: tenant, UserID: 42, Role: "admin"}
+
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayload(out, membership); err != nil {
+			t.Fatal(err)
+		}
+
+		payload := new(OnePayload)
+		if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+			t.Fatal(err)
+		}
+		if e, a := id, payload.Data.ID; e != a {
+			t.Fatalf("Was expecting id %q, got %q", e, a)
+		}
+
+		decoded := new(Membership)
+		if err := UnmarshalPayload(out, decoded); err != nil {
+			t.Fatal(err)
+		}
+		if *decoded != *membership {
+			t.Fatalf("Was expecting %v, got %v", membership, decoded)
+		}
+	}
+}
+
+func TestCompositeID_separator(t *testing.T) {
+	membership := &Membership{TenantID: "a|b", UserID: 42, Role: "admin"}
+
+	payload, err := MarshalWithOptions(membership, MarshalOptions{CompositeIDSeparator: "|"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "a%7Cb|42", payload.(*OnePayload).Data.ID; e != a {
+		t.Fatalf("Was expecting id %q, got %q", e, a)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(out).Encode(payload); err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(Membership)
+	if err := UnmarshalPayloadWithOptions(out, decoded, UnmarshalOptions{CompositeIDSeparator: "|"}); err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != *membership {
+		t.Fatalf("Was expecting %v, got %v", membership, decoded)
+	}
+}
+
+func TestCompositeID_badID(t *testing.T) {
+	for _, id := range []string{"acme", "acme:42:1", "acme:%zz"} {
+		in := bytes.NewBufferString(`{"data":{"type":"memberships","id":"` + id + `"}}`)
+		if err := UnmarshalPayload(in, new(Membership)); err != ErrBadJSONAPIID {
+			t.Fatalf("For %q, was expecting ErrBadJSONAPIID, got %v", id, err)
+		}
+	}
+}
+
+func TestCompositeID_badKeys(t *testing.T) {
+	type gap struct {
+		A string `jsonapi:"primary,things,key=1"`
+		B string `jsonapi:"primary,things,key=3"`
+	}
+
+	if _, err := Marshal(&gap{A: "a", B: "b"}); err != ErrBadJSONAPIStructTag {
+		t.Fatalf("Was expecting ErrBadJSONAPIStructTag, got %v", err)
+	}
+}
@@ -2,15 +2,40 @@ package jsonapi
 
 const (
 	// StructTag annotation strings
-	annotationJSONAPI   = "jsonapi"
-	annotationPrimary   = "primary"
-	annotationClientID  = "client-id"
-	annotationAttribute = "attr"
-	annotationRelation  = "relation"
-	annotationOmitEmpty = "omitempty"
-	annotationISO8601   = "iso8601"
-	annotationRFC3339   = "rfc3339"
-	annotationSeperator = ","
+	annotationJSONAPI     = "jsonapi"
+	annotationPrimary     = "primary"
+	annotationClientID    = "client-id"
+	annotationLID         = "lid"
+	annotationAttribute   = "attr"
+	annotationAttrExtra   = "attr-extra"
+	annotationRelation    = "relation"
+	annotationRelationMap = "relation-map"
+	annotationMeta        = "meta"
+	annotationLinks       = "links"
+	annotationOmitEmpty   = "omitempty"
+	annotationISO8601     = "iso8601"
+	annotationRFC3339     = "rfc3339"
+	annotationUnixMilli   = "unixmilli"
+	annotationClamp       = "clamp"
+	annotationComplex     = "complex"
+	annotationScalar      = "scalar"
+	annotationPolymorphic = "polymorphic"
+	annotationRequired    = "required"
+	annotationSeperator   = ","
+
+	// StructTag options taking a value, e.g. "emptyhasmany=omit"
+	annotationEmptyHasMany = "emptyhasmany"
+	annotationMax          = "max"
+	annotationPrecision    = "precision"
+	annotationSort         = "sort"
+	annotationKey          = "key"
+	annotationLayout       = "layout"
+	annotationMethod       = "method"
+	annotationCodec        = "codec"
+	annotationValueSep     = "="
+
+	emptyHasManyOmit  = "omit"
+	emptyHasManyEmpty = "empty"
 
 	iso8601TimeFormat = "2006-01-02T15:04:05Z"
 
@@ -19,6 +44,27 @@ const (
 	// see http://jsonapi.org/format/#document-structure
 	MediaType = "application/vnd.api+json"
 
+	// MetaKeyHasMore is the key set to true in the meta object of a has-many
+	// relationship whose linkage was truncated by the "max" relation option.
+	MetaKeyHasMore = "has-more"
+
+	// MetaKeyIncludedVia is the key set in the meta object of included
+	// resources to the relationship path they were reached through, with
+	// MarshalOptions.IncludedVia.
+	MetaKeyIncludedVia = "included-via"
+
+	// KeySelfLink is the key to the links object whose value contains the link
+	// that generated the current document or resource
+	KeySelfLink = "self"
+
+	// KeyRelatedLink is the key to the links object of a relationship whose
+	// value contains the link to the related resources
+	KeyRelatedLink = "related"
+
+	// MetaKeyTotalCount is the key to the top-level meta object whose value is
+	// the total number of resources of a collection, across all pages
+	MetaKeyTotalCount = "total-count"
+
 	// Pagination Constants
 	//
 	// http://jsonapi.org/format/#fetching-pagination
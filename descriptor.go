@@ -0,0 +1,185 @@
+package jsonapi
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ModelDescriptor describes the jsonapi tags of a model type, as used when
+// marshaling and unmarshaling it. It can be used to build tooling like
+// documentation, validators or admin UIs without parsing the tags again.
+//
+// Descriptors are cached per type and shared, so they must not be modified.
+type ModelDescriptor struct {
+	// Type is the resource type of the primary tag.
+	Type string
+	// GoType is the struct type of the model.
+	GoType reflect.Type
+	// Primary holds the primary field, or the fields of a composite id in
+	// key order.
+	Primary []FieldDescriptor
+	// ClientID, LID and AttrExtra are the client-id, lid and attr-extra
+	// fields, if any.
+	ClientID  *FieldDescriptor
+	LID       *FieldDescriptor
+	AttrExtra *FieldDescriptor
+	// Attributes, Relationships, Meta and Links hold the attr, relation,
+	// meta and links fields in declaration order.
+	Attributes    []FieldDescriptor
+	Relationships []FieldDescriptor
+	Meta          []FieldDescriptor
+	Links         []FieldDescriptor
+}
+
+// FieldDescriptor describes a tagged field of a model.
+type FieldDescriptor struct {
+	// Field is the name of the struct field and Index its index.
+	Field string
+	Index int
+	// Annotation is the first argument of the tag, e.g. "attr".
+	Annotation string
+	// Name is the name of the attribute, relationship or meta key, the type
+	// for the primary field, or the relationship of a links field.
+	Name string
+	// Type is the type of the field and Kind the kind of the type it points
+	// to, for pointer fields.
+	Type reflect.Type
+	Kind reflect.Kind
+	// Options holds the extra tag arguments, e.g. "omitempty" or "max=10".
+	Options []string
+	// ToMany is set for relationships holding a slice or a map.
+	ToMany bool
+}
+
+// HasOption reports whether the field has the extra tag argument option.
+func (f FieldDescriptor) HasOption(option string) bool {
+	for _, o := range f.Options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// Option returns the value of a "name=value" extra tag argument.
+func (f FieldDescriptor) Option(name string) (string, bool) {
+	for _, o := range f.Options {
+		if v, ok := tagOptionValue(o, name); ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+var descriptors sync.Map // map[reflect.Type]*ModelDescriptor
+
+// DescribeModel returns the descriptor of the model, a struct or a pointer to
+// a struct. Descriptors are cached, so repeated calls are cheap.
+func DescribeModel(model interface{}) (*ModelDescriptor, error) {
+	t := reflect.TypeOf(model)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, ErrUnexpectedType
+	}
+
+	if d, ok := descriptors.Load(t); ok {
+		return d.(*ModelDescriptor), nil
+	}
+
+	d, err := describe(t)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := descriptors.LoadOrStore(t, d)
+
+	return actual.(*ModelDescriptor), nil
+}
+
+func describe(t reflect.Type) (*ModelDescriptor, error) {
+	d := &ModelDescriptor{GoType: t}
+	var keys []int // composite key of each primary field
+
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		tag := structField.Tag.Get(annotationJSONAPI)
+		if tag == "" {
+			continue
+		}
+
+		args := strings.Split(tag, annotationSeperator)
+		annotation := args[0]
+		if !validTagArgs(args) {
+			return nil, ErrBadJSONAPIStructTag
+		}
+
+		f := FieldDescriptor{
+			Field:      structField.Name,
+			Index:      i,
+			Annotation: annotation,
+			Type:       structField.Type,
+			Kind:       structField.Type.Kind(),
+		}
+		if f.Kind == reflect.Ptr {
+			f.Kind = structField.Type.Elem().Kind()
+		}
+		if len(args) > 1 {
+			f.Name = args[1]
+		}
+		if len(args) > 2 {
+			f.Options = args[2:]
+		}
+
+		switch annotation {
+		case annotationPrimary:
+			d.Type = f.Name
+			n, ok, err := compositeKey(args)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				n = 0
+			}
+			keys = append(keys, n)
+			d.Primary = append(d.Primary, f)
+		case annotationClientID:
+			d.ClientID = &f
+		case annotationLID:
+			d.LID = &f
+		case annotationAttrExtra:
+			d.AttrExtra = &f
+		case annotationAttribute:
+			d.Attributes = append(d.Attributes, f)
+		case annotationRelation:
+			f.ToMany = structField.Type.Kind() == reflect.Slice || structField.Type.Kind() == reflect.Map ||
+				isSliceRef(structField.Type)
+			d.Relationships = append(d.Relationships, f)
+		case annotationRelationMap:
+			d.Relationships = append(d.Relationships, f)
+		case annotationMeta:
+			d.Meta = append(d.Meta, f)
+		case annotationLinks:
+			d.Links = append(d.Links, f)
+		}
+	}
+
+	// keep the fields of a composite id in key order
+	sort.Stable(primaryByKey{keys: keys, fields: d.Primary})
+
+	return d, nil
+}
+
+type primaryByKey struct {
+	keys   []int
+	fields []FieldDescriptor
+}
+
+func (p primaryByKey) Len() int           { return len(p.keys) }
+func (p primaryByKey) Less(i, j int) bool { return p.keys[i] < p.keys[j] }
+func (p primaryByKey) Swap(i, j int) {
+	p.keys[i], p.keys[j] = p.keys[j], p.keys[i]
+	p.fields[i], p.fields[j] = p.fields[j], p.fields[i]
+}
@@ -0,0 +1,91 @@
+package jsonapi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDescribeModel(t *testing.T) {
+	d, err := DescribeModel(&Post{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Type != "posts" || d.GoType != reflect.TypeOf(Post{}) {
+		t.Fatalf("Was expecting the posts type, got %q (%v)", d.Type, d.GoType)
+	}
+	if len(d.Primary) != 1 || d.Primary[0].Field != "ID" || d.Primary[0].Kind != reflect.Uint64 {
+		t.Fatalf("Was expecting the ID primary field, got %+v", d.Primary)
+	}
+	if d.ClientID == nil || d.ClientID.Field != "ClientID" {
+		t.Fatalf("Was expecting the ClientID client-id field, got %+v", d.ClientID)
+	}
+
+	var attrs []string
+	for _, a := range d.Attributes {
+		attrs = append(attrs, a.Name)
+	}
+	if !reflect.DeepEqual(attrs, []string{"blog_id", "title", "body"}) {
+		t.Fatalf("Was expecting the attributes in declaration order, got %v", attrs)
+	}
+
+	if len(d.Relationships) != 2 {
+		t.Fatalf("Was expecting 2 relationships, got %d", len(d.Relationships))
+	}
+	if r := d.Relationships[0]; r.Name != "comments" || !r.ToMany || r.Kind != reflect.Slice {
+		t.Fatalf("Was expecting the to-many comments relationship, got %+v", r)
+	}
+	if r := d.Relationships[1]; r.Name != "latest_comment" || r.ToMany || r.Kind != reflect.Struct {
+		t.Fatalf("Was expecting the to-one latest_comment relationship, got %+v", r)
+	}
+}
+
+func TestDescribeModel_options(t *testing.T) {
+	d, err := DescribeModel(TimestampModel{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, a := range d.Attributes {
+		if a.Name == "iso8601p" && (!a.HasOption(annotationISO8601) || a.Kind != reflect.Struct) {
+			t.Fatalf("Was expecting the iso8601 option, got %+v", a)
+		}
+	}
+
+	d, err = DescribeModel(&Membership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Primary) != 2 || d.Primary[0].Field != "TenantID" || d.Primary[1].Field != "UserID" {
+		t.Fatalf("Was expecting the composite id fields in key order, got %+v", d.Primary)
+	}
+	if key, ok := d.Primary[1].Option(annotationKey); !ok || key != "2" {
+		t.Fatalf("Was expecting key=2, got %q", key)
+	}
+}
+
+func TestDescribeModel_cached(t *testing.T) {
+	first, err := DescribeModel(&Comment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := DescribeModel(Comment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("Was expecting the descriptor to be cached")
+	}
+}
+
+func TestDescribeModel_invalid(t *testing.T) {
+	for _, model := range []interface{}{nil, "posts", &[]*Post{}} {
+		if _, err := DescribeModel(model); err != ErrUnexpectedType {
+			t.Fatalf("Was expecting ErrUnexpectedType for %T, got %v", model, err)
+		}
+	}
+
+	if _, err := DescribeModel(&BadModel{}); err != ErrBadJSONAPIStructTag {
+		t.Fatalf("Was expecting ErrBadJSONAPIStructTag, got %v", err)
+	}
+}
@@ -45,6 +45,21 @@ value arguments are comma separated.  The first argument must be, "primary", and
 the second must be the name that should appear in the "type" field for all data
 objects that represent this type of model.
 
+Several primary fields can make up a composite id with a "key=<n>" extra
+argument giving their position, e.g. "primary,memberships,key=1" and
+"primary,memberships,key=2". The parts are joined with ":", or the
+CompositeIDSeparator of MarshalOptions and UnmarshalOptions, percent-encoding
+"%" and the separator within a part, and are split back into the fields when
+unmarshaling.
+
+Value, lid: "lid"
+
+This marks the string field holding the local id of a resource that hasn't been
+persisted yet, e.g. within a batch of atomic operations. It is written as "lid"
+and, while the resource has no id, relationships reference it by
+{"type": ..., "lid": ...} instead of by id. When unmarshaling, such
+relationships are resolved against the included resources with the same lid.
+
 Value, attr: "attr,<key name in attributes hash>[,<extra arguments>]"
 
 These fields' values should end up in the "attribute" hash for a record.  The first
@@ -53,8 +68,50 @@ the "attributes" hash for that record.
 
 The following extra arguments are also supported:
 
-"omitempty": excludes the fields value from the "attribute" hash.
+"omitempty": excludes the fields value from the "attribute" hash when it is the zero
+value of its type, or an empty slice or map. Pointers are only excluded when nil, so
+a pointer to a zero value is still written.
 "iso8601": uses the ISO8601 timestamp format when serialising or deserialising the time.Time value.
+"unixmilli": writes a time.Time value as an integer number of milliseconds since
+the Unix epoch instead of seconds, the default format of time values, written
+the same with or without a "unix" argument. Both are read back from an integer
+or float epoch, keeping the fraction of a float. Zero time.Time values are
+omitted whatever their format, or handled as set by MarshalOptions.ZeroTimes.
+"layout=<layout>": uses the given time.Format layout for a time.Time value instead, e.g.
+"attr,published_on,layout=2006-01-02". The time is formatted in its own location, and the
+layout can't contain commas.
+"clamp": when unmarshaling a number into a float32 field, limits values out of
+the float32 range to the largest float32 (or zero) instead of returning
+ErrFloat32OutOfRange.
+"complex": writes a complex64 or complex128 value as a {"real": ..., "imag": ...}
+object and reads it back, failing with an *ErrInvalidComplex for other values.
+"scalar": when unmarshaling into a slice field, also accepts a single value and
+reads it as a slice of one element, e.g. "tags": "a" as []string{"a"}. Elements
+of the wrong type still fail with an *ErrInvalidSliceElement.
+"codec=<name>": converts the value with the codec registered under name with
+RegisterAttrCodec, e.g. to encrypt the attribute when marshaling and decrypt it
+when unmarshaling.
+"precision=<n>": writes a float value as a number with exactly n decimals, e.g.
+"attr,rate,precision=2". NaN and infinite values fail with an *ErrNonFiniteFloat.
+The value is unmarshaled as is.
+"method=<name>": writes the result of the model's method with the given name,
+taking no arguments and returning one value, as the attribute instead of the
+field's value, e.g. on a blank field: _ struct{} `jsonapi:"attr,full_name,method=FullName"`.
+The result is formatted like a field of its type, and the attribute is ignored
+when unmarshaling.
+"required": when unmarshaling, returns an *ErrMissingAttributes listing every
+required attribute that is absent or null. Related resources that are only
+referenced by linkage, without being included, aren't checked.
+
+Value, attr-extra: "attr-extra"
+
+A map[string]interface{} field that receives the attributes of the resource
+that no attr field maps when unmarshaling, and writes them back as attributes
+when marshaling, e.g. to pass through fields the model doesn't know about yet.
+Attributes of the model's fields take precedence over the captured ones, and
+attributes not allowed by UnmarshalOptions.AllowedFields aren't captured. The
+captured attributes keep their names, MarshalOptions.AttrNames and KeyNamer
+don't rename them.
 
 Value, relation: "relation,<key name in relationships hash>"
 
@@ -63,6 +120,68 @@ jsonapi will traverse the graph of relationships and marshal or unmarshal record
 argument must be, "relation", and the second should be the name of the relationship, used as
 the key in the "relationships" hash for the record.
 
+A one-to-many may also be held in a map with string keys, e.g. map[string]*Comment.
+It is unmarshaled keyed by the id of each related record, and marshaled in key order.
+
+A pointer to a slice, e.g. *[]*Comment, tells a relationship that wasn't loaded from
+an empty one. A nil pointer leaves the relationship out, while a pointer to an empty
+slice writes "data": []. When unmarshaling, the pointer stays nil when the relationship
+is absent and points to an empty slice when its data is [].
+
+A relation field may also hold an Identifier, *Identifier or []Identifier to
+carry just the linkage of related resources that have no model, e.g. ones owned
+by another service. Such related resources are never included.
+
+The following extra arguments are also supported:
+
+"omitempty": excludes a nil or empty relationship from the "relationships" hash.
+"emptyhasmany=omit|empty": controls how a has-many relationship without elements
+is written. "omit" drops it, "empty" always writes "data": [] (with omitempty,
+only a nil slice is then dropped).
+"max=<n>": writes at most n resource identifiers for a has-many relationship,
+n being at least 1. When the relationship had more elements, "has-more": true
+is set in its meta.
+"sort=[-]<attr>": orders a has-many relationship by the named attribute of the
+related models, descending when prefixed with "-". The model's slice is left
+untouched, and sorting happens before "max" is applied.
+"polymorphic": for a field holding an interface or a slice of interfaces, e.g.
+a feed of posts and videos. When unmarshaling, each related resource is
+decoded into the Go type registered for its type with RegisterPolymorphicType.
+
+Value, meta: "meta,<key name in meta hash>[,omitempty]"
+
+These fields' values end up in the resource's "meta" hash under the given key,
+and are read back from it when unmarshaling, e.g. "meta,version" for a version
+used in optimistic concurrency. When the model also implements Metable, the
+field values take precedence over the returned meta.
+
+Value, links: "links[,<relationship name>]"
+
+A *Links field receives the "links" of the resource, or of the named
+relationship, when unmarshaling, e.g. to follow a "related" link. Link objects
+are converted to Link values, and Links.Href reads the URL of either form. When
+marshaling, the field is written unless Linkable or RelationshipLinkable
+provide links. Top-level links are kept by decoding the document into a
+OnePayload or ManyPayload and using DecodeOnePayload or DecodeManyPayload.
+
+Value, relation-map: "relation-map"
+
+A relation-map field is a map[string]interface{} (or map[string][]*Node) whose
+entries are marshaled as relationships named after the map keys. This is meant
+for resources with a variable set of relationships. Values may be struct
+pointers or slices of struct pointers, which are handled like relation fields,
+or *Node and []*Node values, which are used as the linkage directly. The field
+is ignored when unmarshaling.
+
+Marshaling the same models always gives the same bytes, e.g. for golden files
+or ETags. Attributes, relationships, meta and links are objects written with
+sorted keys. The "data" array and has-many linkage keep the order of the
+slices (map relation fields are written in key order), and the "included"
+array is sorted by type, then id compared as strings. OrderIncludedByTraversal
+replaces the latter with the order of the relationship traversal, which is
+deterministic as well. Likewise, OrderedRelationships writes relationships in
+the order their fields are declared.
+
 Use the methods below to Marshal and Unmarshal jsonapi.org_rest json payloads.
 
 Visit the readme at https://github.com/google/jsonapi
@@ -1,9 +1,9 @@
 package jsonapi
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
 )
 
 // MarshalErrors writes a JSON API response using the given `[]error`.
@@ -12,7 +12,7 @@ import (
 // http://jsonapi.org/format/#document-top-level
 // and here: http://jsonapi.org/format/#error-objects.
 func MarshalErrors(w io.Writer, errorObjects []*ErrorObject) error {
-	return json.NewEncoder(w).Encode(&ErrorsPayload{Errors: errorObjects})
+	return encodePayload(w, &ErrorsPayload{Errors: errorObjects})
 }
 
 // ErrorsPayload is a serializer struct for representing a valid JSON API errors payload.
@@ -42,10 +42,31 @@ type ErrorObject struct {
 	// Code is an application-specific error code, expressed as a string value.
 	Code string `json:"code,omitempty"`
 
+	// Source is an object containing references to the source of the error.
+	Source *ErrorSource `json:"source,omitempty"`
+
 	// Meta is an object containing non-standard meta-information about the error.
 	Meta *map[string]interface{} `json:"meta,omitempty"`
 }
 
+// ErrorSource is the source member of a JSON API error object.
+type ErrorSource struct {
+	// Pointer is a JSON Pointer (RFC6901) to the value in the request document that caused the error, e.g. "/data/attributes/title".
+	Pointer string `json:"pointer,omitempty"`
+
+	// Parameter is the name of the URI query parameter that caused the error.
+	Parameter string `json:"parameter,omitempty"`
+}
+
+// NewErrorObject returns an ErrorObject with the given HTTP status code, title
+// and detail, e.g. to report a validation failure:
+//
+//	e := jsonapi.NewErrorObject(http.StatusUnprocessableEntity, "Invalid Attribute", "Title must not be empty.")
+//	e.Source = &jsonapi.ErrorSource{Pointer: "/data/attributes/title"}
+func NewErrorObject(status int, title, detail string) *ErrorObject {
+	return &ErrorObject{Status: strconv.Itoa(status), Title: title, Detail: detail}
+}
+
 // Error implements the `Error` interface.
 func (e *ErrorObject) Error() string {
 	return fmt.Sprintf("Error: %s %s\n", e.Title, e.Detail)
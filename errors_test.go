@@ -40,6 +40,17 @@ func TestMarshalErrorsWritesTheExpectedPayload(t *testing.T) {
 				map[string]interface{}{"title": "Test title.", "detail": "Test detail", "meta": map[string]interface{}{"key": "val"}},
 			}},
 		},
+		{
+			Title: "TestSourceIsSerializedProperly",
+			In: []*ErrorObject{
+				{Title: "Invalid Attribute", Source: &ErrorSource{Pointer: "/data/attributes/title"}},
+				{Title: "Invalid Query Parameter", Source: &ErrorSource{Parameter: "sort"}},
+			},
+			Out: map[string]interface{}{"errors": []interface{}{
+				map[string]interface{}{"title": "Invalid Attribute", "source": map[string]interface{}{"pointer": "/data/attributes/title"}},
+				map[string]interface{}{"title": "Invalid Query Parameter", "source": map[string]interface{}{"parameter": "sort"}},
+			}},
+		},
 	}
 	for _, testRow := range marshalErrorsTableTasts {
 		t.Run(testRow.Title, func(t *testing.T) {
@@ -55,3 +66,14 @@ func TestMarshalErrorsWritesTheExpectedPayload(t *testing.T) {
 		})
 	}
 }
+
+func TestNewErrorObject(t *testing.T) {
+	e := NewErrorObject(422, "Invalid Attribute", "Title must not be empty.")
+
+	if e.Status != "422" || e.Title != "Invalid Attribute" || e.Detail != "Title must not be empty." {
+		t.Fatalf("Was expecting the status, title and detail to be set, got %+v", e)
+	}
+	if e.Source != nil {
+		t.Fatalf("Was not expecting a source, got %+v", e.Source)
+	}
+}
@@ -0,0 +1,149 @@
+package jsonapi
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Identifier identifies a resource by its type and id, like a resource
+// identifier object. An empty ID matches any resource of the type.
+//
+// A relation field may hold an Identifier, *Identifier or []Identifier to
+// write and read the linkage of a relationship without a model for the
+// related resource, e.g. one owned by another service. Such relationships
+// are never included.
+type Identifier struct {
+	Type string
+	ID   string
+}
+
+var identifierType = reflect.TypeOf(Identifier{})
+
+// isIdentifierField reports whether a relation field of type t holds
+// Identifier linkage.
+func isIdentifierField(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t == identifierType
+}
+
+func (i Identifier) matches(n *Node) bool {
+	return n.Type == i.Type && (i.ID == "" || n.ID == i.ID)
+}
+
+// ErrNoIncludePath is returned by MinimalIncludes when a target can't be
+// reached through the relationships of the primary data.
+type ErrNoIncludePath struct {
+	Target Identifier
+}
+
+func (e *ErrNoIncludePath) Error() string {
+	if e.Target.ID == "" {
+		return fmt.Sprintf("jsonapi: no include path reaches type %q", e.Target.Type)
+	}
+	return fmt.Sprintf("jsonapi: no include path reaches %s %q", e.Target.Type, e.Target.ID)
+}
+
+// MinimalIncludes returns the shortest include paths (as used with
+// MarshalPayloadFilterIncluded) that bring all targets into the "included"
+// array when marshaling model, a struct pointer or a slice of struct
+// pointers. Paths that are a prefix of another returned path are left out,
+// since including "posts.comments" also includes "posts".
+func MinimalIncludes(model interface{}, targets []Identifier) ([]string, error) {
+	var primary []interface{}
+	if reflect.ValueOf(model).Kind() == reflect.Slice {
+		m, err := convertToSliceInterface(&model)
+		if err != nil {
+			return nil, err
+		}
+		primary = m
+	} else {
+		primary = []interface{}{model}
+	}
+
+	type step struct {
+		node *Node
+		path string
+	}
+
+	var queue []step
+	for _, m := range primary {
+		if v := reflect.ValueOf(m); v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			return nil, ErrUnexpectedType
+		}
+		node, err := visitModelNode(m, nil, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			queue = append(queue, step{node: node})
+		}
+	}
+
+	// walk the relationships breadth first, so that the first path found to
+	// a target is the shortest
+	paths := make(map[Identifier]string, len(targets))
+	visited := map[string]bool{}
+	for len(queue) > 0 && len(paths) < len(targets) {
+		s := queue[0]
+		queue = queue[1:]
+
+		for _, name := range relationshipNames(s.node) {
+			path := name
+			if s.path != "" {
+				path = s.path + "." + name
+			}
+
+			for _, related := range linkageNodes(s.node, name) {
+				if visited[related.key()] {
+					continue
+				}
+				visited[related.key()] = true
+
+				for _, t := range targets {
+					if _, found := paths[t]; !found && t.matches(related) {
+						paths[t] = path
+					}
+				}
+				queue = append(queue, step{node: related, path: path})
+			}
+		}
+	}
+
+	for _, t := range targets {
+		if _, found := paths[t]; !found {
+			return nil, &ErrNoIncludePath{Target: t}
+		}
+	}
+
+	var includes []string
+	for _, p := range paths {
+		redundant := false
+		for _, other := range paths {
+			if strings.HasPrefix(other, p+".") {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			includes = append(includes, p)
+		}
+	}
+	sort.Strings(includes)
+
+	return dedupe(includes), nil
+}
+
+// dedupe removes consecutive duplicates from the sorted strings.
+func dedupe(sorted []string) []string {
+	out := sorted[:0]
+	for i, s := range sorted {
+		if i == 0 || s != sorted[i-1] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,50 @@
+package jsonapi
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMinimalIncludes(t *testing.T) {
+	includes, err := MinimalIncludes(testBlog(), []Identifier{
+		{Type: "posts", ID: "2"},
+		{Type: "comments", ID: "3"},
+		{Type: "posts"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := []string{"posts.comments"}, includes; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting includes %v, got %v", e, a)
+	}
+}
+
+func TestMinimalIncludes_separatePaths(t *testing.T) {
+	includes, err := MinimalIncludes([]*Blog{testBlog()}, []Identifier{
+		{Type: "posts", ID: "1"},
+		{Type: "comments", ID: "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// comment 1 is also the latest_comment of the posts, but comments is
+	// declared first
+	if e, a := []string{"posts.comments"}, includes; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting includes %v, got %v", e, a)
+	}
+}
+
+func TestMinimalIncludes_unreachable(t *testing.T) {
+	_, err := MinimalIncludes(testBlog(), []Identifier{{Type: "authors"}})
+
+	var noPath *ErrNoIncludePath
+	if !errors.As(err, &noPath) {
+		t.Fatalf("Was expecting an ErrNoIncludePath, got %v", err)
+	}
+	if e, a := "authors", noPath.Target.Type; e != a {
+		t.Fatalf("Was expecting target type %q, got %q", e, a)
+	}
+}
@@ -0,0 +1,29 @@
+package jsonapi
+
+// SelfLink builds the top-level links object of a single resource document,
+// which only has a "self" link.
+func SelfLink(href string) (*Links, error) {
+	links := &Links{KeySelfLink: href}
+	if err := links.validate(); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// CollectionLinks builds the top-level links object of a collection document:
+// the "self" link merged with the pagination links (KeyFirstPage,
+// KeyPreviousPage, KeyNextPage and KeyLastPage), if any.
+func CollectionLinks(self string, pagination *Links) (*Links, error) {
+	links := Links{}
+	if pagination != nil {
+		for k, v := range *pagination {
+			links[k] = v
+		}
+	}
+	links[KeySelfLink] = self
+
+	if err := links.validate(); err != nil {
+		return nil, err
+	}
+	return &links, nil
+}
@@ -0,0 +1,49 @@
+package jsonapi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelfLink(t *testing.T) {
+	links, err := SelfLink("http://example.com/posts/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := (&Links{"self": "http://example.com/posts/1"}), links; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting %v, got %v", e, a)
+	}
+}
+
+func TestCollectionLinks(t *testing.T) {
+	links, err := CollectionLinks("http://example.com/posts?page[number]=2", &Links{
+		KeyFirstPage:    "http://example.com/posts?page[number]=1",
+		KeyPreviousPage: "http://example.com/posts?page[number]=1",
+		KeyNextPage:     Link{Href: "http://example.com/posts?page[number]=3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Links{
+		"self":          "http://example.com/posts?page[number]=2",
+		KeyFirstPage:    "http://example.com/posts?page[number]=1",
+		KeyPreviousPage: "http://example.com/posts?page[number]=1",
+		KeyNextPage:     Link{Href: "http://example.com/posts?page[number]=3"},
+	}
+	if !reflect.DeepEqual(expected, links) {
+		t.Fatalf("Was expecting %v, got %v", expected, links)
+	}
+
+	links, err = CollectionLinks("http://example.com/posts", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := (&Links{"self": "http://example.com/posts"}), links; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting %v, got %v", e, a)
+	}
+
+	if _, err := CollectionLinks("http://example.com/posts", &Links{KeyNextPage: 3}); err == nil {
+		t.Fatal("Was expecting an invalid pagination link to be rejected")
+	}
+}
@@ -0,0 +1,135 @@
+package jsonapi
+
+import (
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Loader loads the models of the given type and ids, as struct pointers, for
+// MarshalPayloadWithLoader.
+type Loader func(typ string, ids []string) ([]interface{}, error)
+
+// MarshalPayloadWithLoader writes a jsonapi response for one or many records
+// like MarshalPayload, but fills the "included" array using loader instead of
+// the related models embedded in models.
+//
+// The relation fields of models (and of the loaded models) only need to hold
+// the ids of the related records. For every segment of the include paths, e.g.
+// "comments" and "comments.author" for []string{"comments.author"}, the ids
+// referenced by the relationship are collected and loader is called once per
+// related type with all of them. This avoids loading relationships one record
+// at a time (N+1 queries) when building compound documents from an ORM.
+func MarshalPayloadWithLoader(w io.Writer, models interface{}, includes []string, loader Loader) error {
+	payload, err := Marshal(models)
+	if err != nil {
+		return err
+	}
+
+	l := &includeLoader{
+		loader: loader,
+		nodes:  map[string]*Node{},
+		seen:   map[string]bool{},
+	}
+	for _, n := range payload.primaryNodes() {
+		l.nodes[n.key()] = n
+		l.seen[n.key()] = true
+	}
+
+	for _, path := range includes {
+		level := payload.primaryNodes()
+		for _, relation := range strings.Split(path, ".") {
+			if level, err = l.load(level, relation); err != nil {
+				return err
+			}
+		}
+	}
+
+	sortNodes(l.included)
+	payload.setIncluded(l.included)
+
+	return encodePayload(w, payload)
+}
+
+// includeLoader keeps track of the resources loaded for the include paths of
+// MarshalPayloadWithLoader.
+type includeLoader struct {
+	loader Loader
+	// nodes holds the primary and loaded nodes, by key
+	nodes map[string]*Node
+	// seen holds the keys of the primary and loaded nodes
+	seen     map[string]bool
+	included []*Node
+}
+
+// load resolves the named relationship of the given nodes, loading the
+// related resources that weren't loaded yet, and returns the related nodes.
+func (l *includeLoader) load(nodes []*Node, relation string) ([]*Node, error) {
+	var linkage []*Node
+	missing := map[string][]string{}
+	for _, n := range nodes {
+		for _, r := range linkageNodes(n, relation) {
+			linkage = append(linkage, r)
+			if !l.seen[r.key()] {
+				l.seen[r.key()] = true
+				missing[r.Type] = append(missing[r.Type], r.ID)
+			}
+		}
+	}
+
+	types := make([]string, 0, len(missing))
+	for typ := range missing {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	for _, typ := range types {
+		models, err := l.loader(typ, missing[typ])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range models {
+			if v := reflect.ValueOf(m); v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+				return nil, ErrUnexpectedType
+			}
+
+			node, err := visitModelNode(m, &map[string]*Node{}, true, nil)
+			if err != nil {
+				return nil, err
+			}
+			if node == nil {
+				continue
+			}
+
+			l.seen[node.key()] = true
+			if _, ok := l.nodes[node.key()]; !ok {
+				l.nodes[node.key()] = node
+				l.included = append(l.included, node)
+			}
+		}
+	}
+
+	related := make([]*Node, 0, len(linkage))
+	for _, r := range linkage {
+		if n, ok := l.nodes[r.key()]; ok {
+			related = append(related, n)
+		}
+	}
+
+	return related, nil
+}
+
+// linkageNodes returns the resource identifiers of the named relationship of n.
+func linkageNodes(n *Node, relation string) []*Node {
+	switch r := n.Relationships[relation].(type) {
+	case *RelationshipOneNode:
+		if r.Data != nil {
+			return []*Node{r.Data}
+		}
+	case *RelationshipManyNode:
+		return r.Data
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package jsonapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestMarshalPayloadWithLoader(t *testing.T) {
+	blog := &Blog{ID: 1, Title: "Loaded", Posts: []*Post{{ID: 1}, {ID: 2}}}
+
+	calls := map[string][][]string{}
+	loader := func(typ string, ids []string) ([]interface{}, error) {
+		calls[typ] = append(calls[typ], ids)
+
+		var models []interface{}
+		for _, id := range ids {
+			n, _ := strconv.Atoi(id)
+			switch typ {
+			case "posts":
+				models = append(models, &Post{
+					ID:       uint64(n),
+					Title:    "Post " + id,
+					Comments: []*Comment{{ID: n * 10}, {ID: 99}},
+				})
+			case "comments":
+				models = append(models, &Comment{ID: n, Body: "Comment " + id})
+			}
+		}
+		return models, nil
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithLoader(out, blog, []string{"posts.comments"}, loader); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedCalls := map[string][][]string{
+		"posts":    {{"1", "2"}},
+		"comments": {{"10", "99", "20"}},
+	}
+	if !reflect.DeepEqual(expectedCalls, calls) {
+		t.Fatalf("Was expecting loader calls %v, got %v", expectedCalls, calls)
+	}
+
+	payload := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := 5, len(payload.Included); e != a {
+		t.Fatalf("Was expecting %d included resources, got %d", e, a)
+	}
+	var order []string
+	for _, n := range payload.Included {
+		order = append(order, n.Type+","+n.ID)
+	}
+	// sorted by type, then id, like the other marshal paths
+	if e := []string{"comments,10", "comments,20", "comments,99", "posts,1", "posts,2"}; !reflect.DeepEqual(e, order) {
+		t.Fatalf("Was expecting the included order %v, got %v", e, order)
+	}
+	for _, n := range payload.Included {
+		if n.Type == "comments" && n.Attributes["body"] != "Comment "+n.ID {
+			t.Fatalf("Was expecting the loaded comment %s, got %v", n.ID, n.Attributes)
+		}
+	}
+}
+
+func TestMarshalPayloadWithLoader_error(t *testing.T) {
+	blog := &Blog{ID: 1, Posts: []*Post{{ID: 1}}}
+	loadErr := errors.New("database unavailable")
+
+	err := MarshalPayloadWithLoader(bytes.NewBuffer(nil), blog, []string{"posts"},
+		func(string, []string) ([]interface{}, error) {
+			return nil, loadErr
+		})
+	if err != loadErr {
+		t.Fatalf("Was expecting the loader error, got %v", err)
+	}
+}
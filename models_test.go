@@ -1,8 +1,10 @@
 package jsonapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -216,3 +218,327 @@ func TestBla(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+type VersionedPost struct {
+	ID      uint64 `jsonapi:"primary,posts"`
+	Title   string `jsonapi:"attr,title"`
+	Version int    `jsonapi:"meta,version"`
+	ETag    string `jsonapi:"meta,etag,omitempty"`
+}
+
+func (p *VersionedPost) JSONAPIMeta() *Meta {
+	return &Meta{"version": "ignored", "detail": "extra details regarding the post"}
+}
+
+type PrimitiveSlices struct {
+	ID       string             `jsonapi:"primary,primitive-slices"`
+	Ints     []int              `jsonapi:"attr,ints"`
+	Int64s   []int64            `jsonapi:"attr,int64s"`
+	Floats   []float64          `jsonapi:"attr,floats"`
+	Bools    []bool             `jsonapi:"attr,bools"`
+	Strings  []string           `jsonapi:"attr,strings"`
+	Customs  []CustomStringType `jsonapi:"attr,customs"`
+	Unsigned []uint8            `jsonapi:"attr,unsigned"`
+}
+
+type Money struct {
+	Cents    int64
+	Currency string
+}
+
+func (m Money) JSONAPIAttrValue() (interface{}, error) {
+	if m.Currency == "" {
+		return nil, fmt.Errorf("money without currency")
+	}
+	return fmt.Sprintf("%d %s", m.Cents, m.Currency), nil
+}
+
+func (m *Money) ScanJSONAPIAttr(value interface{}) error {
+	s, ok := value.(string)
+	if !ok {
+		return ErrInvalidType
+	}
+	_, err := fmt.Sscanf(s, "%d %s", &m.Cents, &m.Currency)
+	return err
+}
+
+type Invoice struct {
+	ID       string `jsonapi:"primary,invoices"`
+	Total    Money  `jsonapi:"attr,total"`
+	Discount *Money `jsonapi:"attr,discount"`
+}
+
+type Vehicle struct {
+	ID     string `jsonapi:"primary,vehicles"`
+	Kind   string
+	Wheels int      `jsonapi:"attr,wheels"`
+	Owner  *Vehicle `jsonapi:"relation,owner,omitempty"`
+}
+
+func (v *Vehicle) JSONAPIType() string {
+	return v.Kind
+}
+
+type Rate struct {
+	ID     string   `jsonapi:"primary,rates"`
+	Rate   float64  `jsonapi:"attr,rate,precision=2"`
+	Ratio  *float32 `jsonapi:"attr,ratio,precision=1"`
+	Factor *float64 `jsonapi:"attr,factor,precision=3"`
+	Raw    float64  `jsonapi:"attr,raw"`
+}
+
+type Signup struct {
+	ID       string  `jsonapi:"primary,signups"`
+	Email    string  `jsonapi:"attr,email,required"`
+	Name     string  `jsonapi:"attr,name,required"`
+	Note     string  `jsonapi:"attr,note"`
+	Referrer *Signup `jsonapi:"relation,referrer,omitempty"`
+}
+
+type Article struct {
+	ID           string     `jsonapi:"primary,articles"`
+	Title        string     `jsonapi:"attr,title"`
+	Comments     []*Comment `jsonapi:"relation,comments,omitempty"`
+	Links        *Links     `jsonapi:"links"`
+	CommentLinks *Links     `jsonapi:"links,comments"`
+}
+
+type Contact struct {
+	ID       string  `jsonapi:"primary,contacts"`
+	Name     string  `jsonapi:"attr,name"`
+	Nickname *string `jsonapi:"attr,nickname"`
+	Note     string  `jsonapi:"attr,note,omitempty"`
+	Phone    string  `jsonapi:"attr,phone"`
+}
+
+type Reading struct {
+	ID        string     `jsonapi:"primary,readings"`
+	TakenAt   time.Time  `jsonapi:"attr,taken_at,unix"`
+	SyncedAt  *time.Time `jsonapi:"attr,synced_at,unixmilli"`
+	ArchiveAt time.Time  `jsonapi:"attr,archive_at,unixmilli"`
+}
+
+type Signal struct {
+	ID        string     `jsonapi:"primary,signals"`
+	Impedance complex128 `jsonapi:"attr,impedance,complex"`
+	Gain      *complex64 `jsonapi:"attr,gain,complex,omitempty"`
+}
+
+type Listing struct {
+	ID     string   `jsonapi:"primary,listings"`
+	Tags   []string `jsonapi:"attr,tags,scalar"`
+	Labels []string `jsonapi:"attr,labels"`
+}
+
+type Clipping struct {
+	ID    string                 `jsonapi:"primary,clippings"`
+	Title string                 `jsonapi:"attr,title"`
+	Extra map[string]interface{} `jsonapi:"attr-extra"`
+}
+
+type Ledger struct {
+	ID      int     `jsonapi:"primary,ledgers"`
+	UUID    string  `jsonapi:"attr,uuid"`
+	NewID   *string `jsonapi:"attr,new_id"`
+	Balance float64 `jsonapi:"attr,balance"`
+	Parent  *Ledger `jsonapi:"relation,parent"`
+}
+
+type Thread struct {
+	ID       string      `jsonapi:"primary,threads"`
+	Comments *[]*Comment `jsonapi:"relation,comments"`
+}
+
+type Shipment struct {
+	ID       string       `jsonapi:"primary,shipments"`
+	Customer Identifier   `jsonapi:"relation,customer"`
+	Carrier  *Identifier  `jsonapi:"relation,carrier,omitempty"`
+	Parcels  []Identifier `jsonapi:"relation,parcels"`
+}
+
+type viewerKey struct{}
+
+type Profile struct {
+	ID      string     `jsonapi:"primary,profiles"`
+	Email   string     `jsonapi:"attr,email,omitempty"`
+	Friends []*Profile `jsonapi:"relation,friends,omitempty"`
+}
+
+// JSONAPIBeforeMarshal redacts the email of profiles other than the viewer's.
+func (p *Profile) JSONAPIBeforeMarshal(ctx context.Context) error {
+	if p.ID == "" {
+		return fmt.Errorf("profile without id")
+	}
+	if viewer, _ := ctx.Value(viewerKey{}).(string); viewer != p.ID {
+		p.Email = ""
+	}
+	return nil
+}
+
+type Task struct {
+	ID       string  `jsonapi:"primary,tasks"`
+	LID      string  `jsonapi:"lid"`
+	Title    string  `jsonapi:"attr,title"`
+	Parent   *Task   `jsonapi:"relation,parent,omitempty"`
+	Subtasks []*Task `jsonapi:"relation,subtasks,omitempty"`
+}
+
+type PostStats struct {
+	Views         int      `jsonapi:"attr,views"`
+	Title         string   `jsonapi:"attr,title"`
+	LatestComment *Comment `jsonapi:"relation,latest_comment"`
+}
+
+type Tag struct {
+	ID   string `jsonapi:"primary,tags"`
+	Name string `jsonapi:"attr,name"`
+}
+
+func (t *Tag) JSONAPIMeta() *Meta {
+	return &Meta{}
+}
+
+type SortedPost struct {
+	ID       string            `jsonapi:"primary,posts"`
+	Comments []*Comment        `jsonapi:"relation,comments,sort=body"`
+	Latest   []*OrderedComment `jsonapi:"relation,latest,sort=-id_order,max=2"`
+}
+
+type OrderedComment struct {
+	ID    string `jsonapi:"primary,ordered-comments"`
+	Order int    `jsonapi:"attr,id_order"`
+}
+
+type Person struct {
+	ID    string `jsonapi:"primary,people"`
+	First string `jsonapi:"attr,first"`
+	Last  string `jsonapi:"attr,last"`
+	Role  string `jsonapi:"attr,role"`
+}
+
+func (p *Person) JSONAPIComputedAttrs() map[string]interface{} {
+	return map[string]interface{}{
+		"full-name": p.First + " " + p.Last,
+		"first":     "Augusta",
+		"role":      OverrideAttr{Value: strings.ToUpper(p.Role)},
+	}
+}
+
+type Handle struct {
+	ID   string `jsonapi:"primary,handles"`
+	Nick string `jsonapi:"attr,nick,omitempty"`
+}
+
+func (h *Handle) JSONAPIComputedAttrs() map[string]interface{} {
+	return map[string]interface{}{"nick": "computed"}
+}
+
+type Member struct {
+	ID    string    `jsonapi:"primary,members"`
+	First string    `jsonapi:"attr,first"`
+	Last  string    `jsonapi:"attr,last"`
+	Born  time.Time `jsonapi:"attr,born,iso8601"`
+	_     struct{}  `jsonapi:"attr,full_name,method=FullName"`
+	_     struct{}  `jsonapi:"attr,joined,iso8601,method=Joined"`
+}
+
+func (m *Member) FullName() string {
+	return m.First + " " + m.Last
+}
+
+func (m Member) Joined() time.Time {
+	return m.Born.AddDate(18, 0, 0)
+}
+
+type Sensor struct {
+	ID      string   `jsonapi:"primary,sensors"`
+	Reading float32  `jsonapi:"attr,reading"`
+	Peak    *float32 `jsonapi:"attr,peak,clamp"`
+}
+
+type Review struct {
+	ID       string `jsonapi:"primary,reviews"`
+	AuthorID int    `jsonapi:"attr,author_id"`
+
+	author *Comment
+}
+
+func (r *Review) JSONAPIIncluded() []interface{} {
+	if r.author == nil {
+		return nil
+	}
+	return []interface{}{r.author, &Comment{ID: r.author.ID}}
+}
+
+type Membership struct {
+	TenantID string `jsonapi:"primary,memberships,key=1"`
+	UserID   int    `jsonapi:"primary,memberships,key=2"`
+	Role     string `jsonapi:"attr,role"`
+}
+
+type SSN string
+
+type Patient struct {
+	ID      string   `jsonapi:"primary,patients"`
+	Name    string   `jsonapi:"attr,name"`
+	SSN     SSN      `jsonapi:"attr,ssn"`
+	Spouse  SSN      `jsonapi:"attr,spouse-ssn,omitempty"`
+	Contact *Patient `jsonapi:"relation,contact"`
+}
+
+type Insured struct {
+	ID      string                 `jsonapi:"primary,insureds"`
+	SSN     *SSN                   `jsonapi:"attr,ssn"`
+	Partner *SSN                   `jsonapi:"attr,partner-ssn"`
+	_       struct{}               `jsonapi:"attr,holder-ssn,method=HolderSSN"`
+	Extra   map[string]interface{} `jsonapi:"attr-extra"`
+}
+
+func (i *Insured) HolderSSN() SSN {
+	return "111-22-3333"
+}
+
+func (i *Insured) JSONAPIComputedAttrs() map[string]interface{} {
+	return map[string]interface{}{"beneficiary-ssn": SSN("444-55-6666")}
+}
+
+type IndexedPost struct {
+	ID       string              `jsonapi:"primary,posts"`
+	Title    string              `jsonapi:"attr,title"`
+	Comments map[string]*Comment `jsonapi:"relation,comments"`
+}
+
+type Draft struct {
+	ID      string            `jsonapi:"primary,drafts"`
+	Count   int               `jsonapi:"attr,count,omitempty"`
+	Note    string            `jsonapi:"attr,note,omitempty"`
+	Tags    []string          `jsonapi:"attr,tags,omitempty"`
+	Labels  map[string]string `jsonapi:"attr,labels,omitempty"`
+	Rating  *int              `jsonapi:"attr,rating,omitempty"`
+	DueAt   *time.Time        `jsonapi:"attr,due-at,iso8601,omitempty"`
+	SavedAt time.Time         `jsonapi:"attr,saved-at,iso8601,omitempty"`
+}
+
+type Edition struct {
+	ID          string     `jsonapi:"primary,editions"`
+	PublishedOn time.Time  `jsonapi:"attr,published_on,layout=2006-01-02"`
+	UpdatedAt   *time.Time `jsonapi:"attr,updated_at,layout=2006-01-02T15:04:05.999999999Z07:00"`
+}
+
+type Dataset struct {
+	ID       string                 `jsonapi:"primary,datasets"`
+	Metadata map[string]interface{} `jsonapi:"attr,metadata"`
+	Owners   map[string]Employee    `jsonapi:"attr,owners"`
+	Counts   *map[string]int        `jsonapi:"attr,counts"`
+}
+
+type Dashboard struct {
+	ID      string                 `jsonapi:"primary,dashboards"`
+	Widgets map[string]interface{} `jsonapi:"relation-map"`
+}
+
+func (d *Dashboard) JSONAPIRelationshipLinks(relation string) *Links {
+	return &Links{
+		"related": fmt.Sprintf("https://example.com/api/dashboards/%s/%s", d.ID, relation),
+	}
+}
@@ -0,0 +1,66 @@
+package jsonapi
+
+import (
+	"strings"
+	"unicode"
+)
+
+// KeyNamer transforms the member name written in a jsonapi struct tag into
+// the name used in documents, e.g. to change the casing of every attribute
+// and relationship without renaming the tags. See MarshalOptions.KeyNamer
+// and UnmarshalOptions.KeyNamer.
+type KeyNamer func(name string) string
+
+// DasherizeKeys is a KeyNamer writing names as "created-at".
+func DasherizeKeys(name string) string {
+	return strings.Join(splitWords(name), "-")
+}
+
+// SnakeizeKeys is a KeyNamer writing names as "created_at".
+func SnakeizeKeys(name string) string {
+	return strings.Join(splitWords(name), "_")
+}
+
+// CamelizeKeys is a KeyNamer writing names as "createdAt".
+func CamelizeKeys(name string) string {
+	words := splitWords(name)
+	for i := 1; i < len(words); i++ {
+		r := []rune(words[i])
+		r[0] = unicode.ToUpper(r[0])
+		words[i] = string(r)
+	}
+	return strings.Join(words, "")
+}
+
+// splitWords splits a dasherized, snake_case or camelCase name into its
+// lowercased words. A run of capitals is an acronym, so "HTMLBody" is
+// "html" and "body".
+func splitWords(name string) []string {
+	var words []string
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+
+	runes := []rune(name)
+	for i, r := range runes {
+		switch {
+		case r == '-' || r == '_' || unicode.IsSpace(r):
+			flush()
+			continue
+		case unicode.IsUpper(r) && len(word) > 0:
+			prev := word[len(word)-1]
+			next := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(prev) || next {
+				flush()
+			}
+		}
+		word = append(word, r)
+	}
+	flush()
+
+	return words
+}
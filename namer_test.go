@@ -0,0 +1,24 @@
+package jsonapi
+
+import "testing"
+
+func TestKeyNamers(t *testing.T) {
+	for _, name := range []string{"created-at", "created_at", "createdAt", "CreatedAt"} {
+		if e, a := "created-at", DasherizeKeys(name); e != a {
+			t.Fatalf("Was expecting %q for %q, got %q", e, name, a)
+		}
+		if e, a := "created_at", SnakeizeKeys(name); e != a {
+			t.Fatalf("Was expecting %q for %q, got %q", e, name, a)
+		}
+		if e, a := "createdAt", CamelizeKeys(name); e != a {
+			t.Fatalf("Was expecting %q for %q, got %q", e, name, a)
+		}
+	}
+
+	if e, a := "html-body-v2", DasherizeKeys("HTMLBody_v2"); e != a {
+		t.Fatalf("Was expecting %q, got %q", e, a)
+	}
+	if e, a := "title", CamelizeKeys("title"); e != a {
+		t.Fatalf("Was expecting %q, got %q", e, a)
+	}
+}
@@ -0,0 +1,114 @@
+package jsonapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// ErrNDJSONLine is returned by UnmarshalNDJSON for a line that could not be
+// decoded.
+type ErrNDJSONLine struct {
+	// Line is the 1-based line number.
+	Line int
+	Err  error
+}
+
+func (e *ErrNDJSONLine) Error() string {
+	return fmt.Sprintf("jsonapi: ndjson line %d: %v", e.Line, e.Err)
+}
+
+func (e *ErrNDJSONLine) Unwrap() error {
+	return e.Err
+}
+
+// MarshalNDJSON writes models, a struct pointer or a slice of struct pointers,
+// as newline-delimited JSON: one single resource document {"data": {...}} per
+// line, for bulk exports to tools that load one record per line. Related
+// resources are written as linkage only; nothing is included.
+//
+// Each document is written as soon as it is built, so an error may leave the
+// lines of the models before it written.
+func MarshalNDJSON(w io.Writer, models interface{}) error {
+	var records []interface{}
+	switch v := reflect.ValueOf(models); v.Kind() {
+	case reflect.Slice:
+		m, err := convertToSliceInterface(&models)
+		if err != nil {
+			return err
+		}
+		records = m
+	case reflect.Ptr:
+		if v.Elem().Kind() != reflect.Struct {
+			return ErrUnexpectedType
+		}
+		records = []interface{}{models}
+	default:
+		return ErrUnexpectedType
+	}
+
+	enc := json.NewEncoder(w)
+	for _, model := range records {
+		if v := reflect.ValueOf(model); v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			return ErrUnexpectedType
+		}
+
+		// sideload into a discarded map, leaving linkage in the relationships
+		node, err := visitModelNode(model, &map[string]*Node{}, true, nil)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(&OnePayload{Data: node}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalNDJSON reads newline-delimited JSON as written by MarshalNDJSON,
+// decoding the single resource document of every line into a new *T and
+// calling fn with it. Only one line is held in memory at a time. Blank lines
+// are skipped.
+//
+// Lines that can't be decoded fail with an *ErrNDJSONLine. An error returned
+// by fn stops reading and is returned as is.
+func UnmarshalNDJSON[T any](in io.Reader, fn func(*T) error) error {
+	r := bufio.NewReader(in)
+
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		if b = bytes.TrimSpace(b); len(b) > 0 {
+			model := new(T)
+			if decodeErr := decodeNDJSONLine(b, model); decodeErr != nil {
+				return &ErrNDJSONLine{Line: line, Err: decodeErr}
+			}
+			if fnErr := fn(model); fnErr != nil {
+				return fnErr
+			}
+		}
+
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func decodeNDJSONLine(line []byte, model interface{}) error {
+	payload := new(OnePayload)
+	if err := json.Unmarshal(line, payload); err != nil {
+		return err
+	}
+	if payload.Data == nil {
+		return ErrMissingData
+	}
+	return DecodeOnePayload(payload, model)
+}
@@ -0,0 +1,125 @@
+package jsonapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMarshalNDJSON(t *testing.T) {
+	blogs := []*Blog{testBlog(), {ID: 6, Title: "Other"}}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalNDJSON(out, blogs); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	scanner := bufio.NewScanner(out)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			t.Fatalf("Was expecting a JSON document per line, got %s: %v", scanner.Text(), err)
+		}
+		if _, ok := doc["included"]; ok {
+			t.Fatalf("Was expecting no included resources, got %s", scanner.Text())
+		}
+
+		payload := new(OnePayload)
+		if err := json.Unmarshal(scanner.Bytes(), payload); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, payload.Data.ID)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 2 || ids[0] != "5" || ids[1] != "6" {
+		t.Fatalf("Was expecting a line per blog, got ids %v", ids)
+	}
+}
+
+func TestMarshalNDJSON_linkage(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalNDJSON(out, testBlog()); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+
+	posts := payload.Data.Relationships["posts"].(map[string]interface{})["data"].([]interface{})
+	if post := posts[0].(map[string]interface{}); post["attributes"] != nil || post["id"] != "1" {
+		t.Fatalf("Was expecting a resource identifier, got %v", post)
+	}
+}
+
+func TestMarshalNDJSON_invalid(t *testing.T) {
+	if err := MarshalNDJSON(bytes.NewBuffer(nil), Blog{}); err != ErrUnexpectedType {
+		t.Fatalf("Was expecting ErrUnexpectedType, got %v", err)
+	}
+}
+
+func TestUnmarshalNDJSON(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalNDJSON(out, []*Post{{ID: 1, Title: "First"}, {ID: 2, Title: "Second"}}); err != nil {
+		t.Fatal(err)
+	}
+	out.WriteString("\n")
+
+	var titles []string
+	err := UnmarshalNDJSON(out, func(p *Post) error {
+		titles = append(titles, p.Title)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(titles) != 2 || titles[0] != "First" || titles[1] != "Second" {
+		t.Fatalf("Was expecting both posts, got %v", titles)
+	}
+}
+
+func TestUnmarshalNDJSON_malformedLine(t *testing.T) {
+	in := strings.NewReader(`{"data":{"type":"posts","id":"1"}}` + "\n" +
+		"\n" +
+		`{"data":{"type":"posts","id":` + "\n")
+
+	calls := 0
+	err := UnmarshalNDJSON(in, func(*Post) error {
+		calls++
+		return nil
+	})
+
+	var lineErr *ErrNDJSONLine
+	if !errors.As(err, &lineErr) {
+		t.Fatalf("Was expecting an ErrNDJSONLine, got %v", err)
+	}
+	if e, a := 3, lineErr.Line; e != a {
+		t.Fatalf("Was expecting line %d, got %d", e, a)
+	}
+	if calls != 1 {
+		t.Fatalf("Was expecting the first post to be decoded, got %d calls", calls)
+	}
+}
+
+func TestUnmarshalNDJSON_callbackError(t *testing.T) {
+	in := strings.NewReader(`{"data":{"type":"posts","id":"1"}}` + "\n" + `{"data":{"type":"posts","id":"2"}}`)
+	stop := errors.New("stop")
+
+	calls := 0
+	err := UnmarshalNDJSON(in, func(*Post) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Fatalf("Was expecting the callback error after one call, got %v after %d", err, calls)
+	}
+}
@@ -1,6 +1,9 @@
 package jsonapi
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
@@ -12,15 +15,55 @@ type Payloader interface {
 	filterIncluded(relationshipPaths []string)
 	setMeta(meta *Meta)
 	setLinks(links *Links)
+	nodes() []*Node
+	primaryNodes() []*Node
+	includedNodes() []*Node
+	setIncluded(nodes []*Node)
+	setAlwaysEmitIncluded()
+	setJSONAPI(jsonapi *JSONAPIObject)
+}
+
+// JSONAPIObject is the top-level "jsonapi" member of a document, declaring the
+// version of the specification it implements.
+type JSONAPIObject struct {
+	Version string `json:"version,omitempty"`
+	// Ext lists the URIs of the extensions applied to the document, e.g.
+	// "https://jsonapi.org/ext/atomic".
+	Ext  []string `json:"ext,omitempty"`
+	Meta *Meta    `json:"meta,omitempty"`
 }
 
 // OnePayload is used to represent a generic JSON API payload where a single
 // resource (Node) was included as an {} in the "data" key
 type OnePayload struct {
-	Data     *Node   `json:"data"`
-	Included []*Node `json:"included,omitempty"`
-	Links    *Links  `json:"links,omitempty"`
-	Meta     *Meta   `json:"meta,omitempty"`
+	JSONAPI  *JSONAPIObject `json:"jsonapi,omitempty"`
+	Data     *Node          `json:"data"`
+	Included []*Node        `json:"included,omitempty"`
+	Links    *Links         `json:"links,omitempty"`
+	Meta     *Meta          `json:"meta,omitempty"`
+	Errors   []*ErrorObject `json:"errors,omitempty"`
+
+	alwaysEmitIncluded bool
+}
+
+// MarshalJSON implements json.Marshaler, writing "included": [] for an empty
+// included array when the payload was built with AlwaysEmitIncluded, empty
+// relationships objects with EmitEmptyRelationships, and relationships in
+// declaration order with OrderedRelationships.
+func (p *OnePayload) MarshalJSON() ([]byte, error) {
+	type payload OnePayload
+	if !p.alwaysEmitIncluded && !hasEncodingFlags(p.nodes()) {
+		return json.Marshal((*payload)(p))
+	}
+	return json.Marshal(struct {
+		*payload
+		Data     interface{} `json:"data"`
+		Included interface{} `json:"included,omitempty"`
+	}{(*payload)(p), encodableNode(p.Data), includedMember(p.Included, p.alwaysEmitIncluded)})
+}
+
+func (p *OnePayload) setAlwaysEmitIncluded() {
+	p.alwaysEmitIncluded = true
 }
 
 func (p *OnePayload) clearIncluded() {
@@ -37,11 +80,34 @@ func (p *OnePayload) filterIncluded(relationshipPaths []string) {
 	filteredIncludes := make(map[string]*Node, 0)
 	for _, path := range relationshipPaths {
 		includePath := strings.Split(path, ".")
-		oneAppendRelationsToIncludes(&filteredIncludes, p.Data, includePath, allIncludes)
+		oneAppendRelationsToIncludes(&filteredIncludes, p.Data, includePath, allIncludes, map[string]bool{})
 	}
 	p.Included = nodeMapValuesSorted(&filteredIncludes)
 }
 
+// nodes returns the primary and included nodes of the payload
+func (p *OnePayload) nodes() []*Node {
+	if p.Data == nil {
+		return p.Included
+	}
+	return append([]*Node{p.Data}, p.Included...)
+}
+
+func (p *OnePayload) primaryNodes() []*Node {
+	if p.Data == nil {
+		return nil
+	}
+	return []*Node{p.Data}
+}
+
+func (p *OnePayload) includedNodes() []*Node {
+	return p.Included
+}
+
+func (p *OnePayload) setIncluded(nodes []*Node) {
+	p.Included = nodes
+}
+
 // SetLinks sets the links field of the payload
 func (p *OnePayload) setLinks(links *Links) {
 	p.Links = links
@@ -52,13 +118,57 @@ func (p *OnePayload) setMeta(meta *Meta) {
 	p.Meta = meta
 }
 
+func (p *OnePayload) setJSONAPI(jsonapi *JSONAPIObject) {
+	p.JSONAPI = jsonapi
+}
+
+// RewriteLinks replaces the href of every top-level, resource and relationship
+// link of the payload with the result of fn, which is called with the link's
+// name (e.g. "self" or "related") and its current href.
+func (p *OnePayload) RewriteLinks(fn func(rel, href string) string) {
+	rewriteLinks(p.Links, fn)
+	p.Data.rewriteLinks(fn)
+	for _, n := range p.Included {
+		n.rewriteLinks(fn)
+	}
+}
+
 // ManyPayload is used to represent a generic JSON API payload where many
 // resources (Nodes) were included in an [] in the "data" key
 type ManyPayload struct {
-	Data     []*Node `json:"data"`
-	Included []*Node `json:"included,omitempty"`
-	Links    *Links  `json:"links,omitempty"`
-	Meta     *Meta   `json:"meta,omitempty"`
+	JSONAPI  *JSONAPIObject `json:"jsonapi,omitempty"`
+	Data     []*Node        `json:"data"`
+	Included []*Node        `json:"included,omitempty"`
+	Links    *Links         `json:"links,omitempty"`
+	Meta     *Meta          `json:"meta,omitempty"`
+	Errors   []*ErrorObject `json:"errors,omitempty"`
+
+	alwaysEmitIncluded bool
+}
+
+// MarshalJSON implements json.Marshaler, writing "included": [] for an empty
+// included array when the payload was built with AlwaysEmitIncluded, empty
+// relationships objects with EmitEmptyRelationships, and relationships in
+// declaration order with OrderedRelationships.
+func (p *ManyPayload) MarshalJSON() ([]byte, error) {
+	type payload ManyPayload
+	if !p.alwaysEmitIncluded && !hasEncodingFlags(p.nodes()) {
+		return json.Marshal((*payload)(p))
+	}
+
+	var data interface{} = p.Data
+	if p.Data != nil {
+		data = encodableNodes(p.Data)
+	}
+	return json.Marshal(struct {
+		*payload
+		Data     interface{} `json:"data"`
+		Included interface{} `json:"included,omitempty"`
+	}{(*payload)(p), data, includedMember(p.Included, p.alwaysEmitIncluded)})
+}
+
+func (p *ManyPayload) setAlwaysEmitIncluded() {
+	p.alwaysEmitIncluded = true
 }
 
 func (p *ManyPayload) clearIncluded() {
@@ -75,11 +185,34 @@ func (p *ManyPayload) filterIncluded(relationshipPaths []string) {
 	filteredIncludes := make(map[string]*Node, 0)
 	for _, path := range relationshipPaths {
 		relationPath := strings.Split(path, ".")
-		manyAppendRelationsToIncludes(&filteredIncludes, p.Data, relationPath, allIncludes)
+		manyAppendRelationsToIncludes(&filteredIncludes, p.Data, relationPath, allIncludes, map[string]bool{})
 	}
 	p.Included = nodeMapValuesSorted(&filteredIncludes)
 }
 
+// nodes returns the primary and included nodes of the payload
+func (p *ManyPayload) nodes() []*Node {
+	nodes := make([]*Node, 0, len(p.Data)+len(p.Included))
+	for _, n := range p.Data {
+		if n != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	return append(nodes, p.Included...)
+}
+
+func (p *ManyPayload) primaryNodes() []*Node {
+	return p.Data
+}
+
+func (p *ManyPayload) includedNodes() []*Node {
+	return p.Included
+}
+
+func (p *ManyPayload) setIncluded(nodes []*Node) {
+	p.Included = nodes
+}
+
 // SetLinks sets the links field of the payload
 func (p *ManyPayload) setLinks(links *Links) {
 	p.Links = links
@@ -90,15 +223,169 @@ func (p *ManyPayload) setMeta(meta *Meta) {
 	p.Meta = meta
 }
 
+func (p *ManyPayload) setJSONAPI(jsonapi *JSONAPIObject) {
+	p.JSONAPI = jsonapi
+}
+
+// RewriteLinks replaces the href of every top-level, resource and relationship
+// link of the payload with the result of fn, which is called with the link's
+// name (e.g. "self", "next" or "related") and its current href.
+func (p *ManyPayload) RewriteLinks(fn func(rel, href string) string) {
+	rewriteLinks(p.Links, fn)
+	for _, n := range p.Data {
+		n.rewriteLinks(fn)
+	}
+	for _, n := range p.Included {
+		n.rewriteLinks(fn)
+	}
+}
+
 // Node is used to represent a generic JSON API Resource
 type Node struct {
 	Type          string                 `json:"type"`
 	ID            string                 `json:"id,omitempty"`
 	ClientID      string                 `json:"client-id,omitempty"`
+	LID           string                 `json:"lid,omitempty"`
 	Attributes    map[string]interface{} `json:"attributes,omitempty"`
 	Relationships map[string]interface{} `json:"relationships,omitempty"`
 	Links         *Links                 `json:"links,omitempty"`
 	Meta          *Meta                  `json:"meta,omitempty"`
+
+	// relationshipOrder holds the relationship names in the order they were
+	// declared on the marshaled model.
+	relationshipOrder []string
+	// emitEmptyRelationships writes "relationships": {} when there are none.
+	emitEmptyRelationships bool
+	// orderRelationships writes the relationships in relationshipOrder.
+	orderRelationships bool
+	// extraAttributes holds the names of the attributes written from an
+	// attr-extra field, which are kept as is when attributes are renamed.
+	extraAttributes map[string]bool
+}
+
+// emptyRelationshipsNode encodes a node with "relationships": {}.
+type emptyRelationshipsNode struct {
+	*Node
+	Relationships map[string]interface{} `json:"relationships"`
+}
+
+// orderedRelationshipsNode encodes a node with its relationships in
+// declaration order.
+type orderedRelationshipsNode struct {
+	*Node
+	Relationships orderedRelationships `json:"relationships"`
+}
+
+// orderedRelationships encodes a relationships object with its members in
+// the order of names.
+type orderedRelationships struct {
+	names         []string
+	relationships map[string]interface{}
+}
+
+func (o orderedRelationships) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range o.names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(o.relationships[name])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// encodableNode returns n, or a wrapper writing its empty relationships
+// object when it was marshaled with EmitEmptyRelationships, or its
+// relationships in declaration order with OrderedRelationships.
+func encodableNode(n *Node) interface{} {
+	if n != nil && n.emitEmptyRelationships && len(n.Relationships) == 0 {
+		return &emptyRelationshipsNode{Node: n, Relationships: map[string]interface{}{}}
+	}
+	if n != nil && n.orderRelationships && len(n.Relationships) > 0 {
+		return &orderedRelationshipsNode{Node: n, Relationships: orderedRelationships{
+			names:         declaredRelationshipNames(n),
+			relationships: n.Relationships,
+		}}
+	}
+	return n
+}
+
+func encodableNodes(nodes []*Node) []interface{} {
+	encodable := make([]interface{}, len(nodes))
+	for i, n := range nodes {
+		encodable[i] = encodableNode(n)
+	}
+	return encodable
+}
+
+// hasEncodingFlags reports whether any of nodes needs encodableNode.
+func hasEncodingFlags(nodes []*Node) bool {
+	for _, n := range nodes {
+		if n != nil && (n.emitEmptyRelationships || n.orderRelationships) {
+			return true
+		}
+	}
+	return false
+}
+
+// includedMember returns the value to write as "included", where nil omits
+// the member.
+func includedMember(included []*Node, alwaysEmit bool) interface{} {
+	if len(included) > 0 {
+		return encodableNodes(included)
+	}
+	if alwaysEmit {
+		return []*Node{}
+	}
+	return nil
+}
+
+// key identifies the node within a document by its type and id, or by its
+// type and local id when it has no id yet.
+func (n *Node) key() string {
+	if n.ID == "" && n.LID != "" {
+		return fmt.Sprintf("%s,lid:%s", n.Type, n.LID)
+	}
+	return fmt.Sprintf("%s,%s", n.Type, n.ID)
+}
+
+func (n *Node) rewriteLinks(fn func(rel, href string) string) {
+	if n == nil {
+		return
+	}
+
+	rewriteLinks(n.Links, fn)
+
+	for _, relationship := range n.Relationships {
+		switch r := relationship.(type) {
+		case *RelationshipOneNode:
+			rewriteLinks(r.Links, fn)
+			r.Data.rewriteLinks(fn)
+		case *RelationshipManyNode:
+			rewriteLinks(r.Links, fn)
+			for _, d := range r.Data {
+				d.rewriteLinks(fn)
+			}
+		case map[string]interface{}:
+			// relationship decoded from JSON
+			if links, ok := r["links"].(map[string]interface{}); ok {
+				l := Links(links)
+				rewriteLinks(&l, fn)
+			}
+		}
+	}
 }
 
 // RelationshipOneNode is used to represent a generic has one JSON API relation
@@ -131,6 +418,13 @@ func (l *Links) validate() (err error) {
 	for k, v := range *l {
 		_, isString := v.(string)
 		_, isLink := v.(Link)
+		if p, ok := v.(*Link); ok && p != nil {
+			isLink = true
+		}
+		if m, ok := v.(map[string]interface{}); ok {
+			// link object decoded from JSON
+			_, isLink = m["href"].(string)
+		}
 
 		if !(isString || isLink) {
 			return fmt.Errorf(
@@ -142,6 +436,86 @@ func (l *Links) validate() (err error) {
 	return
 }
 
+// Href returns the URL of the link named name, whether it is written as a
+// string or as a link object.
+func (l *Links) Href(name string) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+
+	switch link := (*l)[name].(type) {
+	case string:
+		return link, true
+	case Link:
+		return link.Href, true
+	case *Link:
+		return link.Href, link != nil
+	case map[string]interface{}:
+		// link object decoded from JSON
+		href, ok := link["href"].(string)
+		return href, ok
+	}
+	return "", false
+}
+
+// decodedLinks returns a copy of l with the link objects decoded from JSON
+// as maps converted to Link values.
+func decodedLinks(l *Links) *Links {
+	links := make(Links, len(*l))
+	for k, v := range *l {
+		if m, ok := v.(map[string]interface{}); ok {
+			link := Link{}
+			link.Href, _ = m["href"].(string)
+			if meta, ok := m["meta"].(map[string]interface{}); ok {
+				link.Meta = Meta(meta)
+			}
+			v = link
+		}
+		links[k] = v
+	}
+	return &links
+}
+
+// relationshipLinks returns the links of the relationship named relation of
+// n, which may be decoded from JSON or built by marshaling.
+func relationshipLinks(n *Node, relation string) *Links {
+	switch rel := n.Relationships[relation].(type) {
+	case *RelationshipOneNode:
+		return rel.Links
+	case *RelationshipManyNode:
+		return rel.Links
+	case map[string]interface{}:
+		if l, ok := rel["links"].(map[string]interface{}); ok {
+			links := Links(l)
+			return &links
+		}
+	}
+	return nil
+}
+
+func rewriteLinks(l *Links, fn func(rel, href string) string) {
+	if l == nil {
+		return
+	}
+
+	for k, v := range *l {
+		switch link := v.(type) {
+		case string:
+			(*l)[k] = fn(k, link)
+		case Link:
+			link.Href = fn(k, link.Href)
+			(*l)[k] = link
+		case *Link:
+			link.Href = fn(k, link.Href)
+		case map[string]interface{}:
+			// link object decoded from JSON
+			if href, ok := link["href"].(string); ok {
+				link["href"] = fn(k, href)
+			}
+		}
+	}
+}
+
 // Link is used to represent a member of the `links` object.
 type Link struct {
 	Href string `json:"href"`
@@ -161,37 +535,185 @@ type RelationshipLinkable interface {
 	JSONAPIRelationshipLinks(relation string) *Links
 }
 
+// Typeable is used to report the resource type of a model dynamically, e.g.
+// for single-table inheritance where one struct represents several types.
+// A non-empty JSONAPIType overrides the type of the primary tag, for the
+// resource object as well as for the linkage referencing it.
+type Typeable interface {
+	JSONAPIType() string
+}
+
 // Meta is used to represent a `meta` object.
 // http://jsonapi.org/format/#document-meta
+//
+// A value may be a func() interface{}, in which case it is only invoked when
+// the meta object is encoded and its result is written instead. This defers
+// expensive values (like counts) until the payload is actually serialized.
+// The function is called every time the meta object is encoded, possibly
+// concurrently if the same Meta is encoded from several goroutines, so it must
+// be safe for concurrent use.
 type Meta map[string]interface{}
 
+// MarshalJSON implements json.Marshaler, resolving lazily computed values.
+func (m Meta) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+
+	resolved := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if f, ok := v.(func() interface{}); ok {
+			v = f()
+		}
+		resolved[k] = v
+	}
+
+	return json.Marshal(resolved)
+}
+
+// ErrUnexpectedMetaKeys is returned by Meta.Validate when a meta object has
+// keys that aren't allowed. Keys is sorted.
+type ErrUnexpectedMetaKeys struct {
+	Keys []string
+}
+
+func (e *ErrUnexpectedMetaKeys) Error() string {
+	return fmt.Sprintf("jsonapi: unexpected meta keys: %s", strings.Join(e.Keys, ", "))
+}
+
+// Validate returns an *ErrUnexpectedMetaKeys listing the keys of m that are
+// not in allowed, e.g. to reject arbitrary client-provided meta on write
+// endpoints. It returns nil when all keys are allowed.
+func (m Meta) Validate(allowed []string) error {
+	permitted := make(map[string]bool, len(allowed))
+	for _, k := range allowed {
+		permitted[k] = true
+	}
+
+	var unexpected []string
+	for k := range m {
+		if !permitted[k] {
+			unexpected = append(unexpected, k)
+		}
+	}
+	if len(unexpected) == 0 {
+		return nil
+	}
+
+	sort.Strings(unexpected)
+	return &ErrUnexpectedMetaKeys{Keys: unexpected}
+}
+
+// Normalize validates m like Validate and returns a copy of it holding the
+// values as encoding/json decodes them: lazy values are resolved, numbers
+// become float64, structs and maps map[string]interface{}, and slices
+// []interface{}. This lets handlers read client-provided meta the same way
+// whether it was decoded from a request or built in code. A nil m stays nil.
+func (m Meta) Normalize(allowed []string) (Meta, error) {
+	if err := m.Validate(allowed); err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, nil
+	}
+
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	normalized := make(Meta, len(m))
+	if err := json.Unmarshal(raw, &normalized); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
 // Metable is used to include document meta in response data
 // e.g. {"foo": "bar"}
 type Metable interface {
 	JSONAPIMeta() *Meta
 }
 
+// BeforeMarshaler is implemented by models that are prepared with
+// request-scoped data, e.g. to redact attributes the current user may not see
+// or to localize strings, when marshaled with MarshalPayloadContext.
+// JSONAPIBeforeMarshal is called before the resource is built from the model,
+// for primary and related models alike, and an error aborts marshaling.
+type BeforeMarshaler interface {
+	JSONAPIBeforeMarshal(ctx context.Context) error
+}
+
+// AttrValuer is implemented by attribute field types that provide the exact
+// value to write to the "attributes" hash, bypassing reflection. time.Time
+// fields keep their dedicated handling.
+type AttrValuer interface {
+	JSONAPIAttrValue() (interface{}, error)
+}
+
+// IncludeProvider is implemented by models that want additional resources
+// sideloaded into "included", which aren't reachable through their relation
+// fields (e.g. referenced by id in an attribute). The returned struct pointers
+// are marshaled with their own relationships and deduplicated with the other
+// included resources. Only the primary models are asked for their includes.
+type IncludeProvider interface {
+	JSONAPIIncluded() []interface{}
+}
+
+// ComputedAttributer is implemented by models exposing derived attributes, like
+// a full name built from first and last name, without storing them in fields.
+// The returned attributes are merged into the resource's attributes, replacing
+// the attr fields with the same key unless MarshalOptions.ComputedConflicts
+// says otherwise.
+type ComputedAttributer interface {
+	JSONAPIComputedAttrs() map[string]interface{}
+}
+
+// OverrideAttr wraps a value returned by JSONAPIComputedAttrs to replace the
+// attr field with the same key whatever the MarshalOptions.ComputedConflicts
+// policy.
+type OverrideAttr struct {
+	Value interface{}
+}
+
+// AttrScanner is implemented by pointers to attribute field types that read
+// themselves from the decoded JSON value of their attribute (a string,
+// float64, bool, []interface{} or map[string]interface{}).
+type AttrScanner interface {
+	ScanJSONAPIAttr(value interface{}) error
+}
+
 // RelationshipMetable is used to include relationship meta in response data
 type RelationshipMetable interface {
 	// JSONRelationshipMeta will be invoked for each relationship with the corresponding relation name (e.g. `comments`)
 	JSONAPIRelationshipMeta(relation string) *Meta
 }
 
-func manyAppendRelationsToIncludes(includes *map[string]*Node, nodes []*Node, includePath []string, allIncludes map[string]*Node) {
+func manyAppendRelationsToIncludes(includes *map[string]*Node, nodes []*Node, includePath []string, allIncludes map[string]*Node, visited map[string]bool) {
 	for _, n := range nodes {
-		oneAppendRelationsToIncludes(includes, n, includePath, allIncludes)
+		oneAppendRelationsToIncludes(includes, n, includePath, allIncludes, visited)
 	}
 }
 
-func oneAppendRelationsToIncludes(includes *map[string]*Node, node *Node, includePath []string, allIncludes map[string]*Node) {
-	if len(includePath) < 1 {
+// oneAppendRelationsToIncludes adds the resources reached from node along
+// includePath to includes. visited holds the nodes already expanded for the
+// path, by "type,id" and the length of the remaining path, so cyclic
+// relationships aren't walked again; a node reached again at another depth
+// is still expanded, as the rest of the path differs.
+func oneAppendRelationsToIncludes(includes *map[string]*Node, node *Node, includePath []string, allIncludes map[string]*Node, visited map[string]bool) {
+	if len(includePath) < 1 || node == nil {
+		return
+	}
+	k := fmt.Sprintf("%s@%d", node.key(), len(includePath))
+	if visited[k] {
 		return
 	}
+	visited[k] = true
+
 	relations := getRelationKeys(node, includePath[0])
 	level1Nodes := nodesMapValuesWithKeys(&allIncludes, &relations)
 	appendNodes(includes, level1Nodes...)
 	if len(includePath) > 1 {
-		manyAppendRelationsToIncludes(includes, level1Nodes, includePath[1:], allIncludes)
+		manyAppendRelationsToIncludes(includes, level1Nodes, includePath[1:], allIncludes, visited)
 	}
 }
 
@@ -203,11 +725,14 @@ func getRelationKeys(n *Node, relationName string) map[string]bool {
 	relationShips := n.Relationships[relationName]
 	if relationShips != nil {
 		if r, ok := relationShips.(*RelationshipOneNode); ok && r.Data != nil {
-			k := fmt.Sprintf("%s,%s", r.Data.Type, r.Data.ID)
+			k := r.Data.key()
 			return map[string]bool{k: true}
 		} else if r, ok := relationShips.(*RelationshipManyNode); ok {
 			for _, n := range r.Data {
-				k := fmt.Sprintf("%s,%s", n.Type, n.ID)
+				if n == nil {
+					continue
+				}
+				k := n.key()
 				result[k] = true
 			}
 		}
@@ -224,7 +749,7 @@ func appendNodes(m *map[string]*Node, nodes ...*Node) {
 		if n == nil {
 			continue
 		}
-		k := fmt.Sprintf("%s,%s", n.Type, n.ID)
+		k := n.key()
 		if _, hasNode := included[k]; hasNode {
 			continue
 		}
@@ -232,27 +757,280 @@ func appendNodes(m *map[string]*Node, nodes ...*Node) {
 	}
 }
 
+// nodesMapValuesWithKeys returns the nodes of m with the given keys. Keys
+// absent from m, e.g. of dangling linkage to a resource that wasn't included,
+// are skipped.
 func nodesMapValuesWithKeys(m *map[string]*Node, keys *map[string]bool) []*Node {
 	result := make([]*Node, 0)
 	for k := range *keys {
-		result = append(result, (*m)[k])
+		if n, ok := (*m)[k]; ok && n != nil {
+			result = append(result, n)
+		}
 	}
 	return result
 }
 
+// orderByTraversal returns the included nodes in the order they are reached
+// when walking the relationships of the primary nodes depth first, in the
+// order the relationships were declared. Nodes that can't be reached are
+// appended sorted by type and id.
+func orderByTraversal(primary []*Node, included []*Node) []*Node {
+	ordered, remaining := traverseIncluded(primary, included)
+
+	return append(ordered, nodeMapValuesSorted(&remaining)...)
+}
+
+// traverseIncluded walks the relationships of the primary nodes depth first,
+// returning the included nodes that were reached in order, and those that
+// weren't by key.
+func traverseIncluded(primary []*Node, included []*Node) ([]*Node, map[string]*Node) {
+	remaining := make(map[string]*Node, len(included))
+	appendNodes(&remaining, included...)
+
+	ordered := make([]*Node, 0, len(included))
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		for _, name := range relationshipNames(n) {
+			for _, k := range relationKeysOrdered(n, name) {
+				related, ok := remaining[k]
+				if !ok {
+					continue
+				}
+				delete(remaining, k)
+				ordered = append(ordered, related)
+				walk(related)
+			}
+		}
+	}
+	for _, n := range primary {
+		if n != nil {
+			walk(n)
+		}
+	}
+
+	return ordered, remaining
+}
+
+// includedVia returns the shortest relationship path (e.g. "posts.comments")
+// through which each included node is reached from the primary nodes, by key.
+func includedVia(primary, included []*Node) map[string]string {
+	all := make(map[string]*Node, len(included))
+	appendNodes(&all, included...)
+
+	type step struct {
+		node *Node
+		path string
+	}
+
+	paths := make(map[string]string, len(included))
+	queue := make([]step, 0, len(primary))
+	for _, n := range primary {
+		if n != nil {
+			queue = append(queue, step{node: n})
+		}
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+
+		for _, name := range relationshipNames(s.node) {
+			path := name
+			if s.path != "" {
+				path = s.path + "." + name
+			}
+
+			for _, k := range relationKeysOrdered(s.node, name) {
+				related, ok := all[k]
+				if !ok {
+					continue
+				}
+				if _, found := paths[k]; found {
+					continue
+				}
+				paths[k] = path
+				queue = append(queue, step{node: related, path: path})
+			}
+		}
+	}
+
+	return paths
+}
+
+// limitIncludeDepth drops the included nodes that are only reachable from the
+// primary nodes through relationship paths cut off by depths, which maps a
+// relationship path to the number of levels that may be included from it.
+func limitIncludeDepth(primary, included []*Node, depths map[string]int) []*Node {
+	all := make(map[string]*Node, len(included))
+	appendNodes(&all, included...)
+
+	// the paths that are, or lead to, a key of depths
+	prefixes := map[string]bool{}
+	for path := range depths {
+		parts := strings.Split(path, ".")
+		for i := range parts {
+			prefixes[strings.Join(parts[:i+1], ".")] = true
+		}
+	}
+
+	// a step only tracks its path while it may still reach a key of depths,
+	// and remaining is the number of levels left below it, -1 if unlimited;
+	// a node is visited once per path and remaining pair, which keeps cycles
+	// and diamonds from being walked again
+	type step struct {
+		node      *Node
+		path      string
+		tracked   bool
+		remaining int
+	}
+
+	type visit struct {
+		key, path string
+		remaining int
+	}
+
+	kept := map[string]bool{}
+	visited := map[visit]bool{}
+	queue := make([]step, 0, len(primary))
+	for _, n := range primary {
+		if n != nil {
+			queue = append(queue, step{node: n, tracked: true, remaining: -1})
+		}
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+
+		if s.remaining == 0 {
+			continue
+		}
+
+		for _, name := range relationshipNames(s.node) {
+			remaining := s.remaining
+			if remaining > 0 {
+				remaining--
+			}
+
+			var path string
+			tracked := false
+			if s.tracked {
+				path = name
+				if s.path != "" {
+					path = s.path + "." + name
+				}
+				if tracked = prefixes[path]; !tracked {
+					path = ""
+				}
+			}
+			if d, ok := depths[path]; ok && tracked {
+				if d < 1 {
+					continue
+				}
+				if remaining < 0 || d-1 < remaining {
+					remaining = d - 1
+				}
+			}
+
+			for _, k := range relationKeysOrdered(s.node, name) {
+				related, ok := all[k]
+				if !ok {
+					continue
+				}
+				kept[k] = true
+
+				if v := (visit{k, path, remaining}); !visited[v] {
+					visited[v] = true
+					queue = append(queue, step{node: related, path: path, tracked: tracked, remaining: remaining})
+				}
+			}
+		}
+	}
+
+	limited := []*Node{}
+	for _, n := range included {
+		if kept[n.key()] {
+			limited = append(limited, n)
+		}
+	}
+	return limited
+}
+
+// relationshipNames returns the relationship names of n in declaration order
+// when known, alphabetically otherwise.
+func relationshipNames(n *Node) []string {
+	if len(n.relationshipOrder) == len(n.Relationships) {
+		return n.relationshipOrder
+	}
+
+	names := make([]string, 0, len(n.Relationships))
+	for name := range n.Relationships {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// declaredRelationshipNames returns the relationship names of n in
+// declaration order, followed alphabetically by those that weren't declared
+// on the model (e.g. added by a node hook). Names of relationships that were
+// removed since, e.g. by Fields, are skipped.
+func declaredRelationshipNames(n *Node) []string {
+	names := make([]string, 0, len(n.Relationships))
+	seen := make(map[string]bool, len(n.Relationships))
+	for _, name := range n.relationshipOrder {
+		if _, ok := n.Relationships[name]; ok && !seen[name] {
+			names = append(names, name)
+			seen[name] = true
+		}
+	}
+
+	var rest []string
+	for name := range n.Relationships {
+		if !seen[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	return append(names, rest...)
+}
+
+// relationKeysOrdered returns the "type,id" keys of the linkage of the named
+// relationship, in linkage order.
+func relationKeysOrdered(n *Node, relationName string) []string {
+	switch r := n.Relationships[relationName].(type) {
+	case *RelationshipOneNode:
+		if r.Data != nil {
+			return []string{r.Data.key()}
+		}
+	case *RelationshipManyNode:
+		keys := make([]string, 0, len(r.Data))
+		for _, d := range r.Data {
+			keys = append(keys, d.key())
+		}
+		return keys
+	}
+	return nil
+}
+
 func nodeMapValuesSorted(m *map[string]*Node) []*Node {
 	nodes := nodeMapValues(m)
 	if len(nodes) == 0 {
 		return []*Node{}
 	}
+	sortNodes(nodes)
+
+	return nodes
+}
 
-	// sort by type and id
+// sortNodes sorts nodes by type and id, then lid for resources without an id,
+// the order of the "included" array.
+func sortNodes(nodes []*Node) {
 	sort.Slice(nodes, func(i, j int) bool {
-		if nodes[i].Type == nodes[j].Type {
+		if nodes[i].Type != nodes[j].Type {
+			return nodes[i].Type < nodes[j].Type
+		}
+		if nodes[i].ID != nodes[j].ID {
 			return nodes[i].ID < nodes[j].ID
 		}
-		return nodes[i].Type < nodes[j].Type
+		return nodes[i].LID < nodes[j].LID
 	})
-
-	return nodes
 }
@@ -0,0 +1,298 @@
+package jsonapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRewriteLinks(t *testing.T) {
+	payload, err := Marshal(testBlog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := payload.(*OnePayload)
+	one.Links = &Links{KeyNextPage: "https://example.com/api/blogs?page[number]=2"}
+
+	rewrite := func(rel, href string) string {
+		return strings.Replace(href, "https://example.com", "https://tenant.example.com", 1)
+	}
+	one.RewriteLinks(rewrite)
+
+	if e, a := "https://tenant.example.com/api/blogs?page[number]=2", (*one.Links)[KeyNextPage]; e != a {
+		t.Fatalf("Was expecting top-level link %q, got %q", e, a)
+	}
+
+	links := *one.Data.Links
+	if e, a := "https://tenant.example.com/api/blogs/5", links["self"]; e != a {
+		t.Fatalf("Was expecting self link %q, got %q", e, a)
+	}
+	if e, a := "https://tenant.example.com/api/blogs/5/comments", links["comments"].(Link).Href; e != a {
+		t.Fatalf("Was expecting comments link %q, got %q", e, a)
+	}
+
+	posts := one.Data.Relationships["posts"].(*RelationshipManyNode)
+	if e, a := "https://tenant.example.com/api/blogs/5/posts", (*posts.Links)["related"].(Link).Href; e != a {
+		t.Fatalf("Was expecting related link %q, got %q", e, a)
+	}
+
+	for _, n := range one.Included {
+		if n.Links == nil {
+			continue
+		}
+		if self := (*n.Links)["self"].(string); !strings.HasPrefix(self, "https://tenant.example.com") {
+			t.Fatalf("Was expecting included self link to be rewritten, got %q", self)
+		}
+	}
+}
+
+func TestRewriteLinks_decodedPayload(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, []*Blog{testBlog()}); err != nil {
+		t.Fatal(err)
+	}
+
+	many := new(ManyPayload)
+	if err := json.NewDecoder(out).Decode(many); err != nil {
+		t.Fatal(err)
+	}
+
+	var rels []string
+	many.RewriteLinks(func(rel, href string) string {
+		rels = append(rels, rel)
+		return "/" + rel
+	})
+
+	links := *many.Data[0].Links
+	if e, a := "/self", links["self"]; e != a {
+		t.Fatalf("Was expecting self link %q, got %q", e, a)
+	}
+	if e, a := "/comments", links["comments"].(map[string]interface{})["href"]; e != a {
+		t.Fatalf("Was expecting comments link %q, got %q", e, a)
+	}
+
+	posts := many.Data[0].Relationships["posts"].(map[string]interface{})
+	related := posts["links"].(map[string]interface{})["related"].(map[string]interface{})
+	if e, a := "/related", related["href"]; e != a {
+		t.Fatalf("Was expecting related link %q, got %q", e, a)
+	}
+
+	if len(rels) == 0 {
+		t.Fatal("Was expecting the rewrite function to be called")
+	}
+}
+
+func TestMetaLazyValues(t *testing.T) {
+	calls := 0
+	count := func() interface{} {
+		calls++
+		return 42
+	}
+
+	payload, err := MarshalWithOptions([]*Book{{ID: 1}}, MarshalOptions{
+		Meta: &Meta{"total-count": count, "static": "value"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 {
+		t.Fatalf("Was not expecting the meta function to be called before encoding, got %d calls", calls)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(out).Encode(payload); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("Was expecting the meta function to be called once, got %d calls", calls)
+	}
+
+	var jsonData map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &jsonData); err != nil {
+		t.Fatal(err)
+	}
+	meta := jsonData["meta"].(map[string]interface{})
+	if e, a := float64(42), meta["total-count"]; e != a {
+		t.Fatalf("Was expecting meta.total-count %v, got %v", e, a)
+	}
+	if e, a := "value", meta["static"]; e != a {
+		t.Fatalf("Was expecting meta.static %q, got %v", e, a)
+	}
+}
+
+func TestMetaValidate(t *testing.T) {
+	allowed := []string{"idempotency-key", "client"}
+
+	if err := (Meta{"client": "ios"}).Validate(allowed); err != nil {
+		t.Fatalf("Was not expecting an error, got %v", err)
+	}
+	if err := (Meta(nil)).Validate(allowed); err != nil {
+		t.Fatalf("Was not expecting an error for a nil meta, got %v", err)
+	}
+
+	err := (Meta{"client": "ios", "role": "admin", "debug": true}).Validate(allowed)
+	var unexpected *ErrUnexpectedMetaKeys
+	if !errors.As(err, &unexpected) {
+		t.Fatalf("Was expecting an ErrUnexpectedMetaKeys, got %v", err)
+	}
+	if e, a := []string{"debug", "role"}, unexpected.Keys; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting keys %v, got %v", e, a)
+	}
+}
+
+func TestMetaNormalize(t *testing.T) {
+	allowed := []string{"retries", "client", "tags"}
+
+	meta := Meta{
+		"retries": 3,
+		"client":  func() interface{} { return struct{ Name string }{"ios"} },
+		"tags":    []string{"a"},
+	}
+	normalized, err := meta.Normalize(allowed)
+	if err != nil {
+		t.Fatalf("Was not expecting an error, got %v", err)
+	}
+	expected := Meta{
+		"retries": float64(3),
+		"client":  map[string]interface{}{"Name": "ios"},
+		"tags":    []interface{}{"a"},
+	}
+	if !reflect.DeepEqual(expected, normalized) {
+		t.Fatalf("Was expecting meta %v, got %v", expected, normalized)
+	}
+	if _, ok := meta["retries"].(int); !ok {
+		t.Fatalf("Was not expecting the original meta to change, got %v", meta)
+	}
+
+	if normalized, err := (Meta(nil)).Normalize(allowed); err != nil || normalized != nil {
+		t.Fatalf("Was expecting a nil meta, got %v, %v", normalized, err)
+	}
+
+	_, err = (Meta{"retries": 1, "debug": true}).Normalize(allowed)
+	var unexpected *ErrUnexpectedMetaKeys
+	if !errors.As(err, &unexpected) {
+		t.Fatalf("Was expecting an ErrUnexpectedMetaKeys, got %v", err)
+	}
+}
+
+func TestLinksHref(t *testing.T) {
+	links := &Links{
+		"self":    "https://example.com/posts/1",
+		"related": Link{Href: "https://example.com/posts/1/author"},
+		"next":    map[string]interface{}{"href": "https://example.com/posts?page=2"},
+	}
+
+	for name, e := range map[string]string{
+		"self":    "https://example.com/posts/1",
+		"related": "https://example.com/posts/1/author",
+		"next":    "https://example.com/posts?page=2",
+	} {
+		if a, ok := links.Href(name); !ok || e != a {
+			t.Fatalf("Was expecting the %s href %q, got %q", name, e, a)
+		}
+	}
+	if _, ok := links.Href("prev"); ok {
+		t.Fatal("Was not expecting a prev link")
+	}
+}
+
+func TestFilterIncluded_danglingLinkage(t *testing.T) {
+	person := &Node{Type: "people", ID: "9"}
+	comment := &Node{Type: "comments", ID: "1", Relationships: map[string]interface{}{
+		"author": &RelationshipOneNode{Data: &Node{Type: "people", ID: "9"}},
+	}}
+	payload := &OnePayload{
+		Data: &Node{Type: "posts", ID: "1", Relationships: map[string]interface{}{
+			"author": &RelationshipOneNode{Data: &Node{Type: "people", ID: "9"}},
+			"comments": &RelationshipManyNode{Data: []*Node{
+				{Type: "comments", ID: "1"},
+				{Type: "comments", ID: "2"}, // not included
+			}},
+		}},
+		Included: []*Node{person, comment},
+	}
+
+	payload.filterIncluded([]string{"author", "comments.author"})
+
+	if e, a := 2, len(payload.Included); e != a {
+		t.Fatalf("Was expecting %d included resources, got %d", e, a)
+	}
+	for _, n := range payload.Included {
+		if n == nil {
+			t.Fatal("Was not expecting a nil included resource")
+		}
+	}
+	if payload.Included[0] != comment || payload.Included[1] != person {
+		t.Fatalf("Was expecting the comment and the person once, got %v", payload.Included)
+	}
+}
+
+func TestFilterIncluded_cyclicRelationships(t *testing.T) {
+	parent := func(id string) map[string]interface{} {
+		return map[string]interface{}{
+			"parent": &RelationshipOneNode{Data: &Node{Type: "categories", ID: id}},
+		}
+	}
+	first := &Node{Type: "categories", ID: "1", Relationships: parent("2")}
+	second := &Node{Type: "categories", ID: "2", Relationships: parent("1")}
+	payload := &ManyPayload{
+		Data:     []*Node{first},
+		Included: []*Node{first, second, {Type: "categories", ID: "3"}},
+	}
+
+	payload.filterIncluded([]string{strings.Repeat("parent.", 63) + "parent"})
+
+	if e, a := 2, len(payload.Included); e != a {
+		t.Fatalf("Was expecting %d included resources, got %d", e, a)
+	}
+	if payload.Included[0] != first || payload.Included[1] != second {
+		t.Fatalf("Was expecting each category of the cycle once, got %v", payload.Included)
+	}
+}
+
+func TestLimitIncludeDepth_cyclicRelationships(t *testing.T) {
+	next := func(ids ...string) map[string]interface{} {
+		nodes := []*Node{}
+		for _, id := range ids {
+			nodes = append(nodes, &Node{Type: "categories", ID: id})
+		}
+		return map[string]interface{}{"next": &RelationshipManyNode{Data: nodes}}
+	}
+
+	first := &Node{Type: "categories", ID: "1", Relationships: next("2")}
+	included := []*Node{
+		{Type: "categories", ID: "2", Relationships: next("3")},
+		{Type: "categories", ID: "3", Relationships: next("4")},
+		{Type: "categories", ID: "4", Relationships: next("1")},
+	}
+
+	limited := limitIncludeDepth([]*Node{first}, included, map[string]int{"next": 2})
+	if e, a := 2, len(limited); e != a {
+		t.Fatalf("Was expecting %d included resources, got %d", e, a)
+	}
+	if limited[0] != included[0] || limited[1] != included[1] {
+		t.Fatalf("Was expecting the two first levels of the cycle, got %v", limited)
+	}
+
+	// every node links to every other one, which has too many paths to be
+	// walked one by one
+	var ids []string
+	for i := 0; i < 24; i++ {
+		ids = append(ids, strconv.Itoa(i))
+	}
+	included = nil
+	for _, id := range ids {
+		relationships := next(ids...)
+		relationships["prev"] = relationships["next"]
+		included = append(included, &Node{Type: "categories", ID: id, Relationships: relationships})
+	}
+
+	limited = limitIncludeDepth(included[:1], included, map[string]int{"parent": 1})
+	if e, a := len(included), len(limited); e != a {
+		t.Fatalf("Was expecting %d included resources, got %d", e, a)
+	}
+}
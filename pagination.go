@@ -0,0 +1,184 @@
+package jsonapi
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// DefaultPageSize is the page size returned by ParsePageNumber when the
+	// request has no page[size] query parameter.
+	DefaultPageSize = 20
+	// MaxPageSize is the largest page[size] accepted by ParsePageNumber.
+	MaxPageSize = 100
+)
+
+// PageNumberOptions sets the page sizes of ParsePageNumberWithOptions. Zero
+// fields take the DefaultPageSize and MaxPageSize defaults.
+type PageNumberOptions struct {
+	// DefaultSize is the page size when the request has no page[size].
+	DefaultSize int
+	// MaxSize is the largest page[size] accepted.
+	MaxSize int
+}
+
+// ErrInvalidQueryParam is returned when a JSON API query parameter has a value
+// that can't be used, e.g. a non-numeric page[number]. Handlers will usually
+// respond with 400 Bad Request.
+type ErrInvalidQueryParam struct {
+	Param  string
+	Value  string
+	Reason string
+}
+
+func (e *ErrInvalidQueryParam) Error() string {
+	return fmt.Sprintf("jsonapi: invalid %s %q: %s", e.Param, e.Value, e.Reason)
+}
+
+// ParsePageNumber reads the page[number] and page[size] query parameters of
+// the page based pagination strategy. The page number defaults to 1 and the
+// size to DefaultPageSize. Sizes larger than MaxPageSize are rejected.
+func ParsePageNumber(query url.Values) (number, size int, err error) {
+	return ParsePageNumberWithOptions(query, PageNumberOptions{})
+}
+
+// ParsePageNumberWithOptions does the same as ParsePageNumber, with the
+// default and maximum page sizes given by options.
+func ParsePageNumberWithOptions(query url.Values, options PageNumberOptions) (number, size int, err error) {
+	defaultSize, maxSize := DefaultPageSize, MaxPageSize
+	if options.DefaultSize > 0 {
+		defaultSize = options.DefaultSize
+	}
+	if options.MaxSize > 0 {
+		maxSize = options.MaxSize
+	}
+
+	number, err = parsePageParam(query, QueryParamPageNumber, 1, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size, err = parsePageParam(query, QueryParamPageSize, defaultSize, maxSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return number, size, nil
+}
+
+// parsePageParam parses a positive integer query parameter, returning def
+// when it is absent. A max of 0 means unbounded.
+func parsePageParam(query url.Values, param string, def, max int) (int, error) {
+	raw := query.Get(param)
+	if raw == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, &ErrInvalidQueryParam{Param: param, Value: raw, Reason: "not a number"}
+	}
+	if n < 1 {
+		return 0, &ErrInvalidQueryParam{Param: param, Value: raw, Reason: "must be at least 1"}
+	}
+	if max > 0 && n > max {
+		return 0, &ErrInvalidQueryParam{Param: param, Value: raw, Reason: fmt.Sprintf("must be at most %d", max)}
+	}
+
+	return n, nil
+}
+
+// CollectionOptions describes the collection response built by
+// MarshalCollection.
+type CollectionOptions struct {
+	// BaseURL is the URL of the collection, used to build the "self" and
+	// pagination links. Its query parameters (e.g. include or sort) are kept.
+	BaseURL string
+	// TotalCount is the number of resources across all pages. It is written to
+	// meta.total-count and used to compute the last page.
+	TotalCount int
+	// PageNumber and PageSize are the current page parameters, as returned by
+	// ParsePageNumber.
+	PageNumber int
+	PageSize   int
+	// IncludeRelationPaths filters the "included" array, see
+	// MarshalOptions.IncludeRelationPaths.
+	IncludeRelationPaths []string
+}
+
+// MarshalCollection writes a paginated collection response for models, a
+// slice of struct pointers: the "data" array, the "included" resources
+// filtered by the include paths, the "self" and page based pagination links
+// and meta.total-count.
+func MarshalCollection(w io.Writer, models interface{}, opts CollectionOptions) error {
+	pagination, err := pageNumberLinks(opts.BaseURL, opts.PageNumber, opts.PageSize, opts.TotalCount)
+	if err != nil {
+		return err
+	}
+
+	self := (*pagination)[KeySelfLink].(string)
+	links, err := CollectionLinks(self, pagination)
+	if err != nil {
+		return err
+	}
+
+	payload, err := MarshalWithOptions(models, MarshalOptions{
+		IncludeRelationPaths: opts.IncludeRelationPaths,
+		Links:                links,
+		Meta:                 &Meta{MetaKeyTotalCount: opts.TotalCount},
+	})
+	if err != nil {
+		return err
+	}
+	if _, ok := payload.(*ManyPayload); !ok {
+		return ErrExpectedSlice
+	}
+
+	return encodePayload(w, payload)
+}
+
+// pageNumberLinks builds the self, first, prev, next and last links of the
+// page based pagination strategy.
+func pageNumberLinks(baseURL string, number, size, total int) (*Links, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if number < 1 {
+		number = 1
+	}
+	if size < 1 {
+		size = DefaultPageSize
+	}
+
+	last := (total + size - 1) / size
+	if last < 1 {
+		last = 1
+	}
+
+	pageURL := func(n int) string {
+		query := u.Query()
+		query.Set(QueryParamPageNumber, strconv.Itoa(n))
+		query.Set(QueryParamPageSize, strconv.Itoa(size))
+
+		page := *u
+		page.RawQuery = query.Encode()
+		return page.String()
+	}
+
+	links := Links{
+		KeySelfLink:  pageURL(number),
+		KeyFirstPage: pageURL(1),
+		KeyLastPage:  pageURL(last),
+	}
+	if number > 1 {
+		links[KeyPreviousPage] = pageURL(number - 1)
+	}
+	if number < last {
+		links[KeyNextPage] = pageURL(number + 1)
+	}
+
+	return &links, nil
+}
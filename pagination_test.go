@@ -0,0 +1,149 @@
+package jsonapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestParsePageNumber(t *testing.T) {
+	for raw, expected := range map[string][2]int{
+		"":                            {1, DefaultPageSize},
+		"page[number]=3":              {3, DefaultPageSize},
+		"page[size]=50":               {1, 50},
+		"page[number]=2&page[size]=5": {2, 5},
+	} {
+		query, err := url.ParseQuery(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		number, size, err := ParsePageNumber(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if number != expected[0] || size != expected[1] {
+			t.Fatalf("Was expecting %q to parse to %v, got [%d %d]", raw, expected, number, size)
+		}
+	}
+}
+
+func TestParsePageNumber_invalid(t *testing.T) {
+	for raw, param := range map[string]string{
+		"page[number]=abc":  QueryParamPageNumber,
+		"page[number]=0":    QueryParamPageNumber,
+		"page[size]=-1":     QueryParamPageSize,
+		"page[size]=100000": QueryParamPageSize,
+	} {
+		query, err := url.ParseQuery(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = ParsePageNumber(query)
+
+		var paramErr *ErrInvalidQueryParam
+		if !errors.As(err, &paramErr) {
+			t.Fatalf("Was expecting an ErrInvalidQueryParam for %q, got %v", raw, err)
+		}
+		if e, a := param, paramErr.Param; e != a {
+			t.Fatalf("Was expecting the error for %q to be about %s, got %s", raw, e, a)
+		}
+	}
+}
+
+func TestParsePageNumberWithOptions(t *testing.T) {
+	options := PageNumberOptions{DefaultSize: 10, MaxSize: 500}
+
+	_, size, err := ParsePageNumberWithOptions(url.Values{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 10, size; e != a {
+		t.Fatalf("Was expecting the default size %d, got %d", e, a)
+	}
+
+	_, size, err = ParsePageNumberWithOptions(url.Values{QueryParamPageSize: {"300"}}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 300, size; e != a {
+		t.Fatalf("Was expecting size %d, got %d", e, a)
+	}
+
+	var paramErr *ErrInvalidQueryParam
+	_, _, err = ParsePageNumberWithOptions(url.Values{QueryParamPageSize: {"501"}}, options)
+	if !errors.As(err, &paramErr) {
+		t.Fatalf("Was expecting an ErrInvalidQueryParam above the max size, got %v", err)
+	}
+}
+
+func TestMarshalCollection(t *testing.T) {
+	posts := testBlog().Posts
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalCollection(out, posts, CollectionOptions{
+		BaseURL:              "http://example.com/posts?include=comments",
+		TotalCount:           5,
+		PageNumber:           2,
+		PageSize:             2,
+		IncludeRelationPaths: []string{"comments"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(ManyPayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := 2, len(resp.Data); e != a {
+		t.Fatalf("Was expecting %d posts, got %d", e, a)
+	}
+	if e, a := 3, len(resp.Included); e != a {
+		t.Fatalf("Was expecting %d included comments, got %d", e, a)
+	}
+	if e, a := float64(5), (*resp.Meta)[MetaKeyTotalCount]; e != a {
+		t.Fatalf("Was expecting meta.%s %v, got %v", MetaKeyTotalCount, e, a)
+	}
+
+	expected := map[string]string{
+		KeySelfLink:     "http://example.com/posts?include=comments&page%5Bnumber%5D=2&page%5Bsize%5D=2",
+		KeyFirstPage:    "http://example.com/posts?include=comments&page%5Bnumber%5D=1&page%5Bsize%5D=2",
+		KeyPreviousPage: "http://example.com/posts?include=comments&page%5Bnumber%5D=1&page%5Bsize%5D=2",
+		KeyNextPage:     "http://example.com/posts?include=comments&page%5Bnumber%5D=3&page%5Bsize%5D=2",
+		KeyLastPage:     "http://example.com/posts?include=comments&page%5Bnumber%5D=3&page%5Bsize%5D=2",
+	}
+	links := *resp.Links
+	if e, a := len(expected), len(links); e != a {
+		t.Fatalf("Was expecting %d links, got %v", e, links)
+	}
+	for k, href := range expected {
+		if links[k] != href {
+			t.Fatalf("Was expecting links.%s %q, got %q", k, href, links[k])
+		}
+	}
+}
+
+func TestMarshalCollection_lastPage(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalCollection(out, []*Book{}, CollectionOptions{
+		BaseURL:    "http://example.com/books",
+		PageNumber: 1,
+		PageSize:   10,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(ManyPayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{KeyPreviousPage, KeyNextPage} {
+		if _, ok := (*resp.Links)[k]; ok {
+			t.Fatalf("Was not expecting a %s link on the only page", k)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package jsonapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+func TestMarshalPayload_nothingWrittenOnError(t *testing.T) {
+	type unencodable struct {
+		ID    string      `jsonapi:"primary,things"`
+		Value interface{} `jsonapi:"attr,value"`
+	}
+
+	model := &unencodable{ID: "1", Value: make(chan int)}
+	for name, marshal := range map[string]func(io.Writer) error{
+		"MarshalPayload": func(w io.Writer) error { return MarshalPayload(w, model) },
+		"MarshalPayloadWithOptions": func(w io.Writer) error {
+			return MarshalPayloadWithOptions(w, model, MarshalOptions{})
+		},
+	} {
+		out := bytes.NewBuffer(nil)
+		if err := marshal(out); err == nil {
+			t.Fatalf("Was expecting an encoding error from %s", name)
+		}
+		if out.Len() != 0 {
+			t.Fatalf("Was not expecting any output from %s, got %s", name, out.String())
+		}
+	}
+}
+
+func BenchmarkMarshalPayload(b *testing.B) {
+	blog := testBlog()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := MarshalPayload(io.Discard, blog); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalPayload(b *testing.B) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, testBlog()); err != nil {
+		b.Fatal(err)
+	}
+	in := out.Bytes()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := UnmarshalPayload(bytes.NewReader(in), new(Blog)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMarshalPayload_buffer compares MarshalPayload, which encodes into
+// a pooled buffer so that nothing is written on error, with encoding straight
+// to the writer. Both allocate the same, the pool only keeps the buffering
+// from costing more.
+func BenchmarkMarshalPayload_buffer(b *testing.B) {
+	blog := testBlog()
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := MarshalPayload(io.Discard, blog); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("direct", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			payload, err := Marshal(blog)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := json.NewEncoder(io.Discard).Encode(payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
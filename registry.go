@@ -0,0 +1,260 @@
+package jsonapi
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// IDCoercion converts the string "id" of a resource into a value of the type
+// it was registered for with RegisterIDCoercion.
+type IDCoercion func(id string) (interface{}, error)
+
+var (
+	idCoercionsMu sync.RWMutex
+	idCoercions   = map[reflect.Type]IDCoercion{}
+)
+
+// RegisterIDCoercion registers fromString to populate primary fields of type t
+// from the string id of a resource when unmarshaling. This allows any type,
+// including types from third-party packages, to be used as a primary field.
+//
+// Registration is safe for concurrent use but is typically done at init time.
+func RegisterIDCoercion(t reflect.Type, fromString func(string) (interface{}, error)) {
+	idCoercionsMu.Lock()
+	defer idCoercionsMu.Unlock()
+
+	idCoercions[t] = fromString
+}
+
+func idCoercionFor(t reflect.Type) (IDCoercion, bool) {
+	idCoercionsMu.RLock()
+	defer idCoercionsMu.RUnlock()
+
+	c, ok := idCoercions[t]
+	return c, ok
+}
+
+// coerceID looks up a registered IDCoercion for the type of field (or the type
+// it points to) and uses it to assign id to field.
+func coerceID(field reflect.Value, id string) (bool, error) {
+	t := field.Type()
+
+	c, ok := idCoercionFor(t)
+	if !ok && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		c, ok = idCoercionFor(t)
+	}
+	if !ok {
+		return false, nil
+	}
+
+	coerced, err := c(id)
+	if err != nil {
+		return true, err
+	}
+
+	v := reflect.ValueOf(coerced)
+	if !v.IsValid() || !v.Type().ConvertibleTo(t) {
+		return true, fmt.Errorf("jsonapi: id coercion for %s returned a %T", t, coerced)
+	}
+	v = v.Convert(t)
+
+	if t == field.Type() {
+		field.Set(v)
+	} else {
+		field.Set(reflect.New(t))
+		field.Elem().Set(v)
+	}
+
+	return true, nil
+}
+
+var (
+	typesMu sync.RWMutex
+	types   = map[string]reflect.Type{}
+)
+
+// RegisterType associates the JSON API type name with the struct type t (or
+// the struct type t points to). UnmarshalManyPayload and DecodeManyPayload use
+// it to allocate the concrete model of every element when they decode into a
+// slice of an interface type, e.g. a feed of mixed resource types:
+//
+//	jsonapi.RegisterType("posts", reflect.TypeOf(Post{}))
+//	jsonapi.RegisterType("comments", reflect.TypeOf(Comment{}))
+//
+//	items, err := jsonapi.UnmarshalManyPayload[FeedItem](r.Body)
+//
+// Registration is safe for concurrent use but is typically done at init time.
+func RegisterType(name string, t reflect.Type) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	typesMu.Lock()
+	defer typesMu.Unlock()
+
+	types[name] = t
+}
+
+// RegisterPolymorphicType registers the type of proto, a struct or struct
+// pointer, for the JSON API type name, like RegisterType. Relation fields
+// tagged with the "polymorphic" option, holding an interface or a slice of
+// interfaces, are unmarshaled into the registered type of each related
+// resource:
+//
+//	type Feed struct {
+//		ID    string        `jsonapi:"primary,feeds"`
+//		Items []interface{} `jsonapi:"relation,items,polymorphic"`
+//	}
+//
+//	jsonapi.RegisterPolymorphicType("posts", &Post{})
+//	jsonapi.RegisterPolymorphicType("videos", &Video{})
+func RegisterPolymorphicType(name string, proto interface{}) {
+	RegisterType(name, reflect.TypeOf(proto))
+}
+
+// RegisteredTypes returns the JSON API type names registered with
+// RegisterType or RegisterPolymorphicType, in order.
+func RegisteredTypes() []string {
+	typesMu.RLock()
+	defer typesMu.RUnlock()
+
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResetRegistry removes all the types registered with RegisterType or
+// RegisterPolymorphicType, e.g. to isolate tests from each other. ID
+// coercions and attribute codecs are kept.
+func ResetRegistry() {
+	typesMu.Lock()
+	defer typesMu.Unlock()
+
+	types = map[string]reflect.Type{}
+}
+
+func registeredType(name string) (reflect.Type, bool) {
+	typesMu.RLock()
+	defer typesMu.RUnlock()
+
+	t, ok := types[name]
+	return t, ok
+}
+
+// newRegisteredModel allocates a pointer to the struct type registered for
+// the JSON API type name, which must implement the interface type iface.
+func newRegisteredModel(name string, iface reflect.Type) (reflect.Value, error) {
+	t, ok := registeredType(name)
+	if !ok {
+		return reflect.Value{}, &ErrUnregisteredType{Type: name}
+	}
+
+	model := reflect.New(t)
+	if !model.Type().Implements(iface) {
+		return reflect.Value{}, fmt.Errorf("jsonapi: %s registered for type %q does not implement %s", model.Type(), name, iface)
+	}
+	return model, nil
+}
+
+// AttrCodec converts attribute values of fields tagged with a "codec=<name>"
+// option, see RegisterAttrCodec.
+type AttrCodec struct {
+	Encode func(interface{}) (interface{}, error)
+	Decode func(interface{}) (interface{}, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]AttrCodec{}
+)
+
+// ErrUnregisteredCodec is returned when marshaling or unmarshaling an
+// attribute whose codec option names a codec that wasn't registered.
+type ErrUnregisteredCodec struct {
+	Name string
+}
+
+func (e *ErrUnregisteredCodec) Error() string {
+	return fmt.Sprintf("jsonapi: no attribute codec registered for %q", e.Name)
+}
+
+// RegisterAttrCodec registers a codec for the attributes tagged with the
+// "codec=<name>" option, e.g. to encrypt sensitive fields:
+//
+//	type User struct {
+//		ID  string `jsonapi:"primary,users"`
+//		SSN string `jsonapi:"attr,ssn,codec=pii"`
+//	}
+//
+//	jsonapi.RegisterAttrCodec("pii", encrypt, decrypt)
+//
+// When marshaling, encode is called with the value of the field and its
+// result is written as the attribute. When unmarshaling, decode is called with
+// the decoded JSON value of the attribute, and its result is assigned to the
+// field like the attribute value would be.
+func RegisterAttrCodec(name string, encode, decode func(interface{}) (interface{}, error)) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[name] = AttrCodec{Encode: encode, Decode: decode}
+}
+
+// attrCodec returns the codec named by the codec option of the tag args, if
+// any.
+func attrCodec(args []string) (*AttrCodec, error) {
+	if len(args) < 3 {
+		return nil, nil
+	}
+	for _, arg := range args[2:] {
+		name, ok := tagOptionValue(arg, annotationCodec)
+		if !ok {
+			continue
+		}
+
+		codecsMu.RLock()
+		codec, registered := codecs[name]
+		codecsMu.RUnlock()
+
+		if !registered {
+			return nil, &ErrUnregisteredCodec{Name: name}
+		}
+		return &codec, nil
+	}
+	return nil, nil
+}
+
+var (
+	nodeHookMu sync.RWMutex
+	nodeHook   func(model interface{}, node *Node)
+)
+
+// SetNodeHook registers fn to be called with every model and the Node built
+// from it while marshaling, both for primary and included resources. It can be
+// used to uniformly stamp meta, add links or redact attributes across a
+// service without implementing Linkable or Metable on every model.
+//
+// The hook runs before the node is added to the payload, may be called
+// concurrently from multiple goroutines, and must not retain the node. Passing
+// nil removes the hook.
+func SetNodeHook(fn func(model interface{}, node *Node)) {
+	nodeHookMu.Lock()
+	defer nodeHookMu.Unlock()
+
+	nodeHook = fn
+}
+
+func runNodeHook(model interface{}, node *Node) {
+	nodeHookMu.RLock()
+	fn := nodeHook
+	nodeHookMu.RUnlock()
+
+	if fn != nil {
+		fn(model, node)
+	}
+}
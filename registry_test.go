@@ -0,0 +1,350 @@
+package jsonapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type orderKey struct {
+	Region string
+	Number int
+}
+
+func (k orderKey) String() string {
+	return fmt.Sprintf("%s-%d", k.Region, k.Number)
+}
+
+type Order struct {
+	ID    orderKey `jsonapi:"primary,orders"`
+	Total int      `jsonapi:"attr,total"`
+}
+
+type OrderPtr struct {
+	ID *orderKey `jsonapi:"primary,orders"`
+}
+
+type Unregistered struct {
+	ID struct{ Value string } `jsonapi:"primary,unregistered"`
+}
+
+func init() {
+	RegisterIDCoercion(reflect.TypeOf(orderKey{}), func(id string) (interface{}, error) {
+		region, number, found := strings.Cut(id, "-")
+		if !found {
+			return nil, errors.New("malformed order id")
+		}
+		var k orderKey
+		k.Region = region
+		_, err := fmt.Sscan(number, &k.Number)
+		return k, err
+	})
+}
+
+func TestRegisterIDCoercion(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, &Order{ID: orderKey{"eu", 42}, Total: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	order := new(Order)
+	if err := UnmarshalPayload(bytes.NewReader(out.Bytes()), order); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := (orderKey{"eu", 42}), order.ID; e != a {
+		t.Fatalf("Was expecting id %v, got %v", e, a)
+	}
+
+	orderPtr := new(OrderPtr)
+	if err := UnmarshalPayload(bytes.NewReader(out.Bytes()), orderPtr); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := (orderKey{"eu", 42}), *orderPtr.ID; e != a {
+		t.Fatalf("Was expecting id %v, got %v", e, a)
+	}
+}
+
+func TestRegisterIDCoercion_coercionError(t *testing.T) {
+	in := strings.NewReader(`{"data":{"type":"orders","id":"malformed"}}`)
+	if err := UnmarshalPayload(in, new(Order)); err == nil || err.Error() != "malformed order id" {
+		t.Fatalf("Was expecting the coercion error, got %v", err)
+	}
+}
+
+func TestRegisterIDCoercion_notRegistered(t *testing.T) {
+	in := strings.NewReader(`{"data":{"type":"unregistered","id":"1"}}`)
+
+	var noCoercion *ErrNoIDCoercion
+	if err := UnmarshalPayload(in, new(Unregistered)); !errors.As(err, &noCoercion) {
+		t.Fatalf("Was expecting an ErrNoIDCoercion, got %v", err)
+	}
+}
+
+func TestSetNodeHook(t *testing.T) {
+	SetNodeHook(func(model interface{}, node *Node) {
+		if _, ok := model.(*Post); !ok {
+			return
+		}
+		if node.Meta == nil {
+			node.Meta = &Meta{}
+		}
+		(*node.Meta)["stamped"] = true
+	})
+	defer SetNodeHook(nil)
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, testBlog()); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Data.Meta != nil && (*payload.Data.Meta)["stamped"] != nil {
+		t.Fatal("Was not expecting the blog to be stamped")
+	}
+
+	posts := 0
+	for _, n := range payload.Included {
+		if n.Type != "posts" {
+			continue
+		}
+		posts++
+		if n.Meta == nil || (*n.Meta)["stamped"] != true {
+			t.Fatalf("Was expecting included post %s to be stamped", n.ID)
+		}
+	}
+	if posts == 0 {
+		t.Fatal("Was expecting included posts")
+	}
+}
+
+type feedItem interface {
+	feedItem()
+}
+
+func (p *Post) feedItem()    {}
+func (c *Comment) feedItem() {}
+
+func TestRegisterType_interfaceSlice(t *testing.T) {
+	RegisterType("posts", reflect.TypeOf(Post{}))
+	RegisterType("comments", reflect.TypeOf(&Comment{}))
+
+	in := strings.NewReader(`{"data":[
+		{"type":"posts","id":"1","attributes":{"title":"Hello"}},
+		{"type":"comments","id":"2","attributes":{"body":"World"}}
+	]}`)
+
+	items, err := UnmarshalManyPayload[feedItem](in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, len(items); e != a {
+		t.Fatalf("Was expecting %d items, got %d", e, a)
+	}
+	if post, ok := items[0].(*Post); !ok || post.Title != "Hello" {
+		t.Fatalf("Was expecting the post, got %#v", items[0])
+	}
+	if comment, ok := items[1].(*Comment); !ok || comment.ID != 2 || comment.Body != "World" {
+		t.Fatalf("Was expecting the comment, got %#v", items[1])
+	}
+}
+
+func TestRegisterType_unregistered(t *testing.T) {
+	in := strings.NewReader(`{"data":[{"type":"unknown-feed-items","id":"1"}]}`)
+
+	var unregistered *ErrUnregisteredType
+	if _, err := UnmarshalManyPayload[feedItem](in); !errors.As(err, &unregistered) {
+		t.Fatalf("Was expecting an ErrUnregisteredType, got %v", err)
+	}
+	if e, a := "unknown-feed-items", unregistered.Type; e != a {
+		t.Fatalf("Was expecting type %q, got %q", e, a)
+	}
+}
+
+func TestResetRegistry(t *testing.T) {
+	ResetRegistry()
+	t.Cleanup(ResetRegistry)
+
+	RegisterType("posts", reflect.TypeOf(Post{}))
+	RegisterPolymorphicType("comments", &Comment{})
+	if e, a := []string{"comments", "posts"}, RegisteredTypes(); !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting registered types %v, got %v", e, a)
+	}
+
+	ResetRegistry()
+	if a := RegisteredTypes(); len(a) != 0 {
+		t.Fatalf("Was expecting no registered types, got %v", a)
+	}
+	var unregistered *ErrUnregisteredType
+	in := strings.NewReader(`{"data":[{"type":"posts","id":"1"}]}`)
+	if _, err := UnmarshalManyPayload[feedItem](in); !errors.As(err, &unregistered) {
+		t.Fatalf("Was expecting an ErrUnregisteredType after the reset, got %v", err)
+	}
+}
+
+type Feed struct {
+	ID     string      `jsonapi:"primary,feeds"`
+	Items  []feedItem  `jsonapi:"relation,items,polymorphic"`
+	Pinned interface{} `jsonapi:"relation,pinned,polymorphic"`
+}
+
+func TestRegisterPolymorphicType(t *testing.T) {
+	RegisterPolymorphicType("posts", &Post{})
+	RegisterPolymorphicType("comments", Comment{})
+
+	feed := &Feed{
+		ID:     "1",
+		Items:  []feedItem{&Post{ID: 1, Title: "Hello"}, &Comment{ID: 2, Body: "World"}},
+		Pinned: &Comment{ID: 3, Body: "Pinned"},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, feed); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := new(Feed)
+	if err := UnmarshalPayload(out, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, len(decoded.Items); e != a {
+		t.Fatalf("Was expecting %d items, got %d", e, a)
+	}
+	if post, ok := decoded.Items[0].(*Post); !ok || post.Title != "Hello" {
+		t.Fatalf("Was expecting the post, got %#v", decoded.Items[0])
+	}
+	if comment, ok := decoded.Items[1].(*Comment); !ok || comment.Body != "World" {
+		t.Fatalf("Was expecting the comment, got %#v", decoded.Items[1])
+	}
+	if comment, ok := decoded.Pinned.(*Comment); !ok || comment.Body != "Pinned" {
+		t.Fatalf("Was expecting the pinned comment, got %#v", decoded.Pinned)
+	}
+}
+
+func TestApplyRelationship_polymorphic(t *testing.T) {
+	RegisterPolymorphicType("posts", &Post{})
+	RegisterPolymorphicType("comments", &Comment{})
+
+	feed := &Feed{ID: "1"}
+	in := strings.NewReader(`{"data":[{"type":"posts","id":"1"},{"type":"comments","id":"2"}]}`)
+	if err := ApplyRelationship(in, feed, "items"); err != nil {
+		t.Fatal(err)
+	}
+	if post, ok := feed.Items[0].(*Post); !ok || post.ID != 1 {
+		t.Fatalf("Was expecting post 1, got %#v", feed.Items[0])
+	}
+	if comment, ok := feed.Items[1].(*Comment); !ok || comment.ID != 2 {
+		t.Fatalf("Was expecting comment 2, got %#v", feed.Items[1])
+	}
+
+	if err := ApplyRelationship(strings.NewReader(`{"data":{"type":"comments","id":"3"}}`), feed, "pinned"); err != nil {
+		t.Fatal(err)
+	}
+	if comment, ok := feed.Pinned.(*Comment); !ok || comment.ID != 3 {
+		t.Fatalf("Was expecting the pinned comment 3, got %#v", feed.Pinned)
+	}
+
+	var unregistered *ErrUnregisteredType
+	in = strings.NewReader(`{"data":[{"type":"unknown-feed-items","id":"1"}]}`)
+	if err := ApplyRelationship(in, feed, "items"); !errors.As(err, &unregistered) {
+		t.Fatalf("Was expecting an ErrUnregisteredType, got %v", err)
+	}
+}
+
+func TestRegisterPolymorphicType_unregistered(t *testing.T) {
+	in := strings.NewReader(`{"data":{"type":"feeds","id":"1","relationships":{
+		"items":{"data":[{"type":"unknown-feed-items","id":"1"}]}
+	}}}`)
+
+	var unregistered *ErrUnregisteredType
+	if err := UnmarshalPayload(in, new(Feed)); !errors.As(err, &unregistered) {
+		t.Fatalf("Was expecting an ErrUnregisteredType, got %v", err)
+	}
+	if e, a := "unknown-feed-items", unregistered.Type; e != a {
+		t.Fatalf("Was expecting type %q, got %q", e, a)
+	}
+}
+
+func TestRegisterPolymorphicType_missingOption(t *testing.T) {
+	type untagged struct {
+		ID     string      `jsonapi:"primary,feeds"`
+		Pinned interface{} `jsonapi:"relation,pinned"`
+	}
+
+	in := strings.NewReader(`{"data":{"type":"feeds","id":"1","relationships":{
+		"pinned":{"data":{"type":"posts","id":"1"}}
+	}}}`)
+	if err := UnmarshalPayload(in, new(untagged)); err != ErrBadJSONAPIStructTag {
+		t.Fatalf("Was expecting ErrBadJSONAPIStructTag, got %v", err)
+	}
+}
+
+type Account struct {
+	ID  string `jsonapi:"primary,accounts"`
+	SSN string `jsonapi:"attr,ssn,codec=base64"`
+}
+
+type unregisteredCodecAccount struct {
+	ID  string `jsonapi:"primary,accounts"`
+	SSN string `jsonapi:"attr,ssn,codec=unknown"`
+}
+
+func init() {
+	RegisterAttrCodec("base64",
+		func(v interface{}) (interface{}, error) {
+			return base64.StdEncoding.EncodeToString([]byte(v.(string))), nil
+		},
+		func(v interface{}) (interface{}, error) {
+			s, ok := v.(string)
+			if !ok {
+				return nil, errors.New("encoded value should be a string")
+			}
+			b, err := base64.StdEncoding.DecodeString(s)
+			return string(b), err
+		},
+	)
+}
+
+func TestRegisterAttrCodec(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, &Account{ID: "1", SSN: "123-45-6789"}); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "MTIzLTQ1LTY3ODk=", payload.Data.Attributes["ssn"]; e != a {
+		t.Fatalf("Was expecting the encoded ssn %q, got %v", e, a)
+	}
+
+	account := new(Account)
+	if err := UnmarshalPayload(bytes.NewReader(out.Bytes()), account); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "123-45-6789", account.SSN; e != a {
+		t.Fatalf("Was expecting the decoded ssn %q, got %q", e, a)
+	}
+}
+
+func TestRegisterAttrCodec_errors(t *testing.T) {
+	in := strings.NewReader(`{"data":{"type":"accounts","id":"1","attributes":{"ssn":42}}}`)
+	if err := UnmarshalPayload(in, new(Account)); err == nil || err.Error() != "encoded value should be a string" {
+		t.Fatalf("Was expecting the decode error, got %v", err)
+	}
+
+	var unregistered *ErrUnregisteredCodec
+	err := MarshalPayload(bytes.NewBuffer(nil), &unregisteredCodecAccount{ID: "1"})
+	if !errors.As(err, &unregistered) || unregistered.Name != "unknown" {
+		t.Fatalf("Was expecting an ErrUnregisteredCodec, got %v", err)
+	}
+}
@@ -1,14 +1,16 @@
 package jsonapi
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -28,7 +30,27 @@ var (
 	ErrUnknownFieldNumberType = errors.New("the struct field was not of a known number type")
 	// ErrInvalidType is returned when the given type is incompatible with the expected type.
 	ErrInvalidType = errors.New("invalid type provided") // I wish we used punctuation.
-
+	// ErrPayloadTooLarge is returned by UnmarshalPayloadLimited when the
+	// payload is larger than the allowed number of bytes.
+	ErrPayloadTooLarge = errors.New("payload too large")
+	// ErrMissingData is returned when a document was expected to have a
+	// top-level "data" member holding a resource object.
+	ErrMissingData = errors.New("document has no primary data")
+	// ErrMissingMeta is returned by UnmarshalMetaDocument when the document
+	// has no top-level "meta" member.
+	ErrMissingMeta = errors.New("document has no top-level meta")
+	// ErrIncludedNotFound is returned by IncludedIndex.GetAs when no resource
+	// with the requested type and id was present in the "included" array.
+	ErrIncludedNotFound = errors.New("resource not found in included")
+	// ErrDataWithErrors is returned when a document has both top-level "data"
+	// and "errors" members, which the spec forbids.
+	ErrDataWithErrors = errors.New("document has both data and errors")
+	// ErrUnknownRelation is returned by ApplyRelationship when the model has
+	// no relation field with the requested name.
+	ErrUnknownRelation = errors.New("model has no relation with that name")
+	// ErrFloat32OutOfRange is returned when a JSON number is too large or too
+	// small (but not zero) for a float32 field without the "clamp" option.
+	ErrFloat32OutOfRange = errors.New("number is out of range for a float32")
 )
 
 // ErrUnsupportedPtrType is returned when the Struct field was a pointer but
@@ -55,6 +77,151 @@ func newErrUnsupportedPtrType(rf reflect.Value, t reflect.Type, structField refl
 	return ErrUnsupportedPtrType{rf, t, structField}
 }
 
+// ErrInvalidSliceElement is returned when an element of a slice attribute
+// couldn't be converted to the element type of the struct field.
+type ErrInvalidSliceElement struct {
+	Index int
+	Err   error
+}
+
+func (e *ErrInvalidSliceElement) Error() string {
+	return fmt.Sprintf("jsonapi: invalid slice element at index %d: %v", e.Index, e.Err)
+}
+
+func (e *ErrInvalidSliceElement) Unwrap() error {
+	return e.Err
+}
+
+// ErrNoIDCoercion is returned when unmarshaling into a primary field whose
+// type is neither a string nor a number, and has no coercion registered with
+// RegisterIDCoercion.
+type ErrNoIDCoercion struct {
+	Type reflect.Type
+}
+
+func (e *ErrNoIDCoercion) Error() string {
+	return fmt.Sprintf("jsonapi: no id coercion registered for primary field of type %s", e.Type)
+}
+
+// ErrUnregisteredType is returned when unmarshaling a resource into an
+// interface type and its JSON API type wasn't registered with RegisterType.
+type ErrUnregisteredType struct {
+	Type string
+}
+
+func (e *ErrUnregisteredType) Error() string {
+	return fmt.Sprintf("jsonapi: no model type registered for %q", e.Type)
+}
+
+// ErrFieldNotAllowed is returned when unmarshaling a resource with an
+// attribute or relationship that UnmarshalOptions.AllowedFields doesn't allow,
+// and RejectDisallowedFields is set.
+type ErrFieldNotAllowed struct {
+	Type  string
+	Field string
+}
+
+func (e *ErrFieldNotAllowed) Error() string {
+	return fmt.Sprintf("jsonapi: field %q is not allowed for type %q", e.Field, e.Type)
+}
+
+// ErrInvalidLinkage is returned when unmarshaling a relationship with a
+// resource identifier missing its type or id, unless
+// UnmarshalOptions.LenientLinkage is set.
+type ErrInvalidLinkage struct {
+	// Relationship is the name of the relationship, and Type and ID identify
+	// the resource holding it.
+	Relationship string
+	Type         string
+	ID           string
+	// Member is the missing member, "type" or "id".
+	Member string
+}
+
+func (e *ErrInvalidLinkage) Error() string {
+	return fmt.Sprintf("jsonapi: relationship %q of %s %q has a resource identifier without %s", e.Relationship, e.Type, e.ID, e.Member)
+}
+
+// ErrMissingAttributes is returned when unmarshaling a resource that lacks
+// attributes tagged with the "required" option.
+type ErrMissingAttributes struct {
+	// Type and ID identify the resource, and Attributes lists the names of
+	// the missing attributes.
+	Type       string
+	ID         string
+	Attributes []string
+	// Pointer is the JSON pointer of the resource in the document, like
+	// "/data", "/data/1" or "/included/0", empty when it isn't known.
+	Pointer string
+}
+
+func (e *ErrMissingAttributes) Error() string {
+	return fmt.Sprintf("jsonapi: %s %q is missing required attributes %s", e.Type, e.ID, strings.Join(e.Attributes, ", "))
+}
+
+// ErrorObjects returns an error object per missing attribute, to be written
+// with MarshalErrors. The source pointer to the attribute is only set when
+// the location of the resource is known.
+func (e *ErrMissingAttributes) ErrorObjects() []*ErrorObject {
+	errs := make([]*ErrorObject, 0, len(e.Attributes))
+	for _, name := range e.Attributes {
+		obj := &ErrorObject{
+			Status: "422",
+			Title:  "Missing Attribute",
+			Detail: fmt.Sprintf("The attribute %q is required.", name),
+		}
+		if e.Pointer != "" {
+			obj.Source = &ErrorSource{Pointer: e.Pointer + "/attributes/" + name}
+		}
+		errs = append(errs, obj)
+	}
+	return errs
+}
+
+// locateMissingAttributes sets the pointer of an ErrMissingAttributes for
+// data, found at pointer, or for one of the included resources.
+func locateMissingAttributes(err error, data *Node, pointer string, included []*Node) error {
+	missing, ok := err.(*ErrMissingAttributes)
+	if !ok || missing.Pointer != "" {
+		return err
+	}
+
+	if data != nil && missing.Type == data.Type && missing.ID == data.ID {
+		missing.Pointer = pointer
+		return missing
+	}
+	for i, n := range included {
+		if n != nil && missing.Type == n.Type && missing.ID == n.ID {
+			missing.Pointer = "/included/" + strconv.Itoa(i)
+			break
+		}
+	}
+	return missing
+}
+
+// ErrInvalidTimeLayout is returned when unmarshaling a time attribute with a
+// "layout=" tag option whose value doesn't match the layout.
+type ErrInvalidTimeLayout struct {
+	Attribute string
+	Value     interface{}
+	Layout    string
+}
+
+func (e *ErrInvalidTimeLayout) Error() string {
+	return fmt.Sprintf("jsonapi: attribute %q value %#v does not match the time layout %q", e.Attribute, e.Value, e.Layout)
+}
+
+// ErrInvalidComplex is returned when unmarshaling an attribute with the
+// complex option that isn't a {"real": ..., "imag": ...} object of numbers.
+type ErrInvalidComplex struct {
+	Attribute string
+	Value     interface{}
+}
+
+func (e *ErrInvalidComplex) Error() string {
+	return fmt.Sprintf(`jsonapi: attribute %q should be a {"real": ..., "imag": ...} object, got %v`, e.Attribute, e.Value)
+}
+
 // ErrInvalidJSONAPIType is returned when the JSONAPI type does not match the jsonapi primary type tag.
 type ErrInvalidJSONAPIType struct {
 	ActualType   string
@@ -69,6 +236,136 @@ func newErrInvalidJSONAPIType(actualType, expectedType string) error {
 	return &ErrInvalidJSONAPIType{actualType, expectedType}
 }
 
+// PendingKey identifies the relationship of a resource that identifiers
+// were skipped from, see UnmarshalOptions.PendingRelationships. LID is set
+// for resources that have no id yet.
+type PendingKey struct {
+	Type         string
+	ID           string
+	LID          string
+	Relationship string
+}
+
+// UnmarshalOptions controls the behaviour of UnmarshalPayloadWithOptions and
+// UnmarshalManyPayloadWithOptions. The zero value gives the same behaviour as
+// UnmarshalPayload and UnmarshalManyPayload.
+type UnmarshalOptions struct {
+	// LenientRelationships skips relationship resource identifiers that have a
+	// "type" but no "id" (e.g. related resources that are yet to be created)
+	// instead of unmarshaling them into empty models.
+	LenientRelationships bool
+	// PendingRelationships, when non-nil and LenientRelationships is set, is
+	// populated with the skipped identifiers keyed by the resource and the
+	// name of the relationship they were skipped from.
+	PendingRelationships map[PendingKey][]*Node
+	// NumericRelationshipIDs accepts relationship resource identifiers whose
+	// "id" is a JSON number, as sent by some non-conforming producers, and
+	// coerces it to its string form for linkage resolution. By default only
+	// string ids are accepted.
+	NumericRelationshipIDs bool
+	// AllowDataWithErrors accepts documents that have both top-level "data"
+	// and "errors" members, unmarshaling the data and ignoring the errors. By
+	// default such documents are rejected with ErrDataWithErrors.
+	AllowDataWithErrors bool
+	// AttrNames maps resource types to renamed attributes, from the name in
+	// the attr tag to the name in the document, like MarshalOptions.AttrNames.
+	AttrNames map[string]map[string]string
+	// KeyNamer, when set, transforms the names of the attr and relation tags
+	// into the names looked up in the document, like MarshalOptions.KeyNamer.
+	// Attributes renamed by AttrNames are looked up by the name given there.
+	KeyNamer KeyNamer
+	// AllowedFields maps resource types to the attributes and relationships
+	// accepted for them, e.g. to protect privileged fields from mass
+	// assignment on write endpoints. Other fields of those types are ignored,
+	// or rejected with an *ErrFieldNotAllowed when RejectDisallowedFields is
+	// set. Types that aren't in the map are not restricted.
+	AllowedFields map[string][]string
+	// RejectDisallowedFields makes fields not allowed by AllowedFields an
+	// error instead of ignoring them.
+	RejectDisallowedFields bool
+	// TimeParser, when set, parses the string values of all time.Time and
+	// *time.Time attributes instead of their tag options (iso8601, rfc3339,
+	// layout=), e.g. to accept several formats from a messy upstream. Its
+	// errors are returned with the name of the attribute. Numeric values are
+	// still read as unix timestamps.
+	TimeParser func(string) (time.Time, error)
+	// LenientLinkage accepts relationship resource identifiers without a
+	// "type" or an "id" (or "lid"), unmarshaling them into partially set
+	// models. By default they are rejected with an *ErrInvalidLinkage, which
+	// is recommended as it catches broken producers early.
+	LenientLinkage bool
+	// CompositeIDSeparator splits composite ids, see the constant of the
+	// same name for the default.
+	CompositeIDSeparator string
+}
+
+// fieldAllowed reports whether the attribute or relationship name of a
+// resource of type typ may be unmarshaled, honouring AllowedFields.
+func (o *UnmarshalOptions) fieldAllowed(typ, name string) bool {
+	if o == nil || o.AllowedFields == nil {
+		return true
+	}
+
+	allowed, restricted := o.AllowedFields[typ]
+	if !restricted {
+		return true
+	}
+	for _, a := range allowed {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFields returns an *ErrFieldNotAllowed for the first field of n that
+// isn't allowed, when RejectDisallowedFields is set.
+func (o *UnmarshalOptions) checkFields(n *Node) error {
+	if o == nil || !o.RejectDisallowedFields {
+		return nil
+	}
+
+	names := make([]string, 0, len(n.Attributes)+len(n.Relationships))
+	for name := range n.Attributes {
+		names = append(names, name)
+	}
+	for name := range n.Relationships {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !o.fieldAllowed(n.Type, name) {
+			return &ErrFieldNotAllowed{Type: n.Type, Field: name}
+		}
+	}
+	return nil
+}
+
+// attrName returns the name of the attribute with the given tag name in
+// documents, honouring AttrNames and KeyNamer.
+func (o *UnmarshalOptions) attrName(typ, name string) string {
+	if o == nil {
+		return name
+	}
+	if renamed, ok := o.AttrNames[typ][name]; ok {
+		return renamed
+	}
+	if o.KeyNamer != nil {
+		return o.KeyNamer(name)
+	}
+	return name
+}
+
+// relationName returns the name of the relationship with the given tag name
+// in documents, honouring KeyNamer.
+func (o *UnmarshalOptions) relationName(name string) string {
+	if o == nil || o.KeyNamer == nil {
+		return name
+	}
+	return o.KeyNamer(name)
+}
+
 // UnmarshalPayload converts an io into a struct instance using jsonapi tags on
 // struct fields. This method supports single request payloads only, at the
 // moment. Bulk creates and updates are not supported yet.
@@ -80,24 +377,23 @@ func newErrInvalidJSONAPIType(actualType, expectedType string) error {
 // For example you could pass it, in, req.Body and, model, a BlogPost
 // struct instance to populate in an http handler,
 //
-//   func CreateBlog(w http.ResponseWriter, r *http.Request) {
-//   	blog := new(Blog)
+//	func CreateBlog(w http.ResponseWriter, r *http.Request) {
+//		blog := new(Blog)
 //
-//   	if err := jsonapi.UnmarshalPayload(r.Body, blog); err != nil {
-//   		http.Error(w, err.Error(), 500)
-//   		return
-//   	}
+//		if err := jsonapi.UnmarshalPayload(r.Body, blog); err != nil {
+//			http.Error(w, err.Error(), 500)
+//			return
+//		}
 //
-//   	// ...do stuff with your blog...
+//		// ...do stuff with your blog...
 //
-//   	w.Header().Set("Content-Type", jsonapi.MediaType)
-//   	w.WriteHeader(201)
-//
-//   	if err := jsonapi.MarshalPayload(w, blog); err != nil {
-//   		http.Error(w, err.Error(), 500)
-//   	}
-//   }
+//		w.Header().Set("Content-Type", jsonapi.MediaType)
+//		w.WriteHeader(201)
 //
+//		if err := jsonapi.MarshalPayload(w, blog); err != nil {
+//			http.Error(w, err.Error(), 500)
+//		}
+//	}
 //
 // Visit https://github.com/google/jsonapi#create for more info.
 //
@@ -112,21 +408,337 @@ func UnmarshalPayload(in io.Reader, model interface{}) error {
 	return DecodeOnePayload(payload, model)
 }
 
+// UnmarshalPayloadDiff applies the payload read from in to model, an already
+// populated struct pointer, like UnmarshalPayload, and returns the names of
+// the attributes whose value changed, in declaration order. Attributes that
+// were sent with their current value aren't reported, e.g. for audit logging
+// of updates:
+//
+//	changed, err := jsonapi.UnmarshalPayloadDiff(r.Body, post)
+//	if err != nil {
+//		return err
+//	}
+//	audit.Log(post.ID, changed)
+func UnmarshalPayloadDiff(in io.Reader, model interface{}) (changed []string, err error) {
+	if reflect.ValueOf(model).Kind() != reflect.Ptr {
+		return nil, ErrUnexpectedType
+	}
+	d, err := DescribeModel(model)
+	if err != nil {
+		return nil, err
+	}
+	modelValue := reflect.ValueOf(model).Elem()
+
+	// unmarshaling sets new values rather than mutating the current ones,
+	// so a shallow copy is enough to compare against
+	before := make([]interface{}, len(d.Attributes))
+	for i, attr := range d.Attributes {
+		if _, ok := attr.Option(annotationMethod); ok {
+			// method-backed attributes aren't unmarshaled
+			continue
+		}
+		before[i] = modelValue.Field(attr.Index).Interface()
+	}
+
+	if err := UnmarshalPayload(in, model); err != nil {
+		return nil, err
+	}
+
+	for i, attr := range d.Attributes {
+		if _, ok := attr.Option(annotationMethod); ok {
+			continue
+		}
+		if !sameAttrValue(before[i], modelValue.Field(attr.Index).Interface()) {
+			changed = append(changed, attr.Name)
+		}
+	}
+	return changed, nil
+}
+
+// sameAttrValue reports whether the attribute values a and b are deeply
+// equal, comparing times by instant regardless of their location.
+func sameAttrValue(a, b interface{}) bool {
+	switch ta := a.(type) {
+	case time.Time:
+		if tb, ok := b.(time.Time); ok {
+			return ta.Equal(tb)
+		}
+	case *time.Time:
+		if tb, ok := b.(*time.Time); ok && ta != nil && tb != nil {
+			return ta.Equal(*tb)
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// UnmarshalPayloadWithOptions does the same as UnmarshalPayload, with the
+// behaviour adjusted by options. See UnmarshalOptions for details.
+func UnmarshalPayloadWithOptions(in io.Reader, model interface{}, options UnmarshalOptions) error {
+	payload := new(OnePayload)
+
+	if err := json.NewDecoder(in).Decode(payload); err != nil {
+		return err
+	}
+
+	return DecodeOnePayloadWithOptions(payload, model, options)
+}
+
+// IsCreate reports whether the resource object in the "data" member of the
+// document lacks an "id", as is the case for create requests where the server
+// generates the id. It consumes in, so callers that also want to unmarshal the
+// document should buffer it first.
+func IsCreate(in io.Reader) (bool, error) {
+	var doc struct {
+		Data *struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+
+	if err := json.NewDecoder(in).Decode(&doc); err != nil {
+		return false, err
+	}
+	if doc.Data == nil {
+		return false, ErrMissingData
+	}
+
+	return doc.Data.ID == "", nil
+}
+
+// UnmarshalMetaDocument reads the top-level "meta" object of a document that
+// may have no "data", as written by MarshalMetaDocument.
+func UnmarshalMetaDocument(in io.Reader) (*Meta, error) {
+	payload := new(MetaPayload)
+
+	if err := json.NewDecoder(in).Decode(payload); err != nil {
+		return nil, err
+	}
+	if payload.Meta == nil {
+		return nil, ErrMissingMeta
+	}
+
+	return payload.Meta, nil
+}
+
+// ApplyRelationship reads a relationship document, holding only the linkage of
+// a relationship in "data" as sent to a relationship endpoint like
+// PATCH /articles/1/relationships/tags, and sets the relation field named
+// relationName of model to it. A null or empty linkage clears the field.
+//
+// The field may be a slice, a pointer to a slice or a map keyed by id for a
+// to-many relationship. The related models only have their primary field
+// populated.
+func ApplyRelationship(in io.Reader, model interface{}, relationName string) error {
+	var doc struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(in).Decode(&doc); err != nil {
+		return err
+	}
+	if doc.Data == nil {
+		return ErrMissingData
+	}
+
+	v := reflect.ValueOf(model)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return ErrInvalidType
+	}
+
+	fieldValue, ok := relationField(v.Elem(), relationName)
+	if !ok {
+		return ErrUnknownRelation
+	}
+
+	if string(doc.Data) == "null" {
+		fieldValue.Set(reflect.Zero(fieldValue.Type()))
+		return nil
+	}
+
+	// a pointer to a has-many is set to the slice read below
+	var sliceRef reflect.Value
+	if isSliceRef(fieldValue.Type()) {
+		sliceRef = fieldValue
+		fieldValue = reflect.New(fieldValue.Type().Elem()).Elem()
+	}
+
+	if isIdentifierField(fieldValue.Type()) {
+		if err := setIdentifiers(doc.Data, fieldValue, func(*Node) error { return nil }); err != nil {
+			return err
+		}
+		if sliceRef.IsValid() {
+			sliceRef.Set(fieldValue.Addr())
+		}
+		return nil
+	}
+
+	if kind := fieldValue.Kind(); kind == reflect.Slice || kind == reflect.Map {
+		if kind == reflect.Map && fieldValue.Type().Key().Kind() != reflect.String {
+			return ErrBadJSONAPIStructTag
+		}
+
+		var linkage []*Node
+		if err := json.Unmarshal(doc.Data, &linkage); err != nil {
+			return err
+		}
+
+		models := reflect.MakeSlice(reflect.SliceOf(fieldValue.Type().Elem()), 0, len(linkage))
+		if kind == reflect.Map {
+			// keyed by the id of the related resources
+			models = reflect.MakeMapWithSize(fieldValue.Type(), len(linkage))
+		}
+		for _, n := range linkage {
+			if n == nil {
+				return &ErrInvalidLinkage{Relationship: relationName, Member: "type"}
+			}
+			m, err := newRelatedModel(n, fieldValue.Type().Elem())
+			if err != nil {
+				return err
+			}
+			if err := unmarshalRelated(n, m, nil, nil); err != nil {
+				return err
+			}
+			if kind == reflect.Map {
+				models.SetMapIndex(reflect.ValueOf(n.ID).Convert(fieldValue.Type().Key()), m)
+			} else {
+				models = reflect.Append(models, m)
+			}
+		}
+		fieldValue.Set(models.Convert(fieldValue.Type()))
+		if sliceRef.IsValid() {
+			sliceRef.Set(fieldValue.Addr())
+		}
+
+		return nil
+	}
+
+	linkage := new(Node)
+	if err := json.Unmarshal(doc.Data, linkage); err != nil {
+		return err
+	}
+
+	m, err := newRelatedModel(linkage, fieldValue.Type())
+	if err != nil {
+		return err
+	}
+	if err := unmarshalRelated(linkage, m, nil, nil); err != nil {
+		return err
+	}
+	fieldValue.Set(m)
+
+	return nil
+}
+
+// relationField returns the field of the struct value v tagged as the
+// relation with the given name.
+func relationField(v reflect.Value, name string) (reflect.Value, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		args := strings.Split(v.Type().Field(i).Tag.Get(annotationJSONAPI), annotationSeperator)
+		if len(args) >= 2 && args[0] == annotationRelation && args[1] == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// UnmarshalPayloadLimited does the same as UnmarshalPayload, but reads at most
+// maxBytes from in. ErrPayloadTooLarge is returned when the payload is larger,
+// rather than decoding a truncated document.
+func UnmarshalPayloadLimited(in io.Reader, model interface{}, maxBytes int64) error {
+	lr := &limitedReader{r: io.LimitReader(in, maxBytes+1), max: maxBytes}
+
+	if err := UnmarshalPayload(lr, model); err != nil {
+		if lr.n > maxBytes {
+			return ErrPayloadTooLarge
+		}
+		return err
+	}
+
+	// the decoder may have completed the document from a read that went over
+	// the limit
+	if lr.n > maxBytes {
+		return ErrPayloadTooLarge
+	}
+
+	return nil
+}
+
+// limitedReader counts the bytes read from r and fails once more than max
+// bytes were read.
+type limitedReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n, ErrPayloadTooLarge
+	}
+	return n, err
+}
+
+// UnmarshalPayloadPreservingNode does the same as UnmarshalPayload and also
+// returns the decoded resource Node, giving access to the members that aren't
+// mapped to struct fields (meta, links, unmapped attributes).
+func UnmarshalPayloadPreservingNode(in io.Reader, model interface{}) (*Node, error) {
+	payload := new(OnePayload)
+
+	if err := json.NewDecoder(in).Decode(payload); err != nil {
+		return nil, err
+	}
+
+	if err := DecodeOnePayload(payload, model); err != nil {
+		return nil, err
+	}
+
+	return payload.Data, nil
+}
+
 func DecodeOnePayload(payload *OnePayload, model interface{}) error {
+	return DecodeOnePayloadWithOptions(payload, model, UnmarshalOptions{})
+}
+
+// DecodeOnePayloadWithOptions does the same as DecodeOnePayload, with the
+// behaviour adjusted by options. See UnmarshalOptions for details.
+func DecodeOnePayloadWithOptions(payload *OnePayload, model interface{}, options UnmarshalOptions) error {
+	if payload.Data != nil && len(payload.Errors) > 0 && !options.AllowDataWithErrors {
+		return ErrDataWithErrors
+	}
+
 	if payload.Included != nil {
 		includedMap := make(map[string]*Node)
 		for _, included := range payload.Included {
-			key := fmt.Sprintf("%s,%s", included.Type, included.ID)
-			includedMap[key] = included
+			includedMap[included.key()] = included
 		}
 
-		return unmarshalNode(payload.Data, reflect.ValueOf(model), &includedMap)
+		err := unmarshalNode(payload.Data, reflect.ValueOf(model), &includedMap, &options)
+		return locateMissingAttributes(err, payload.Data, "/data", payload.Included)
 	}
-	return unmarshalNode(payload.Data, reflect.ValueOf(model), nil)
+	err := unmarshalNode(payload.Data, reflect.ValueOf(model), nil, &options)
+	return locateMissingAttributes(err, payload.Data, "/data", nil)
+}
+
+// UnmarshalPayloadWithAttrNames does the same as UnmarshalPayload, reading
+// attributes under the names given by rename, the map used with
+// MarshalPayloadWithAttrNames.
+func UnmarshalPayloadWithAttrNames(in io.Reader, model interface{}, rename map[string]map[string]string) error {
+	return UnmarshalPayloadWithOptions(in, model, UnmarshalOptions{AttrNames: rename})
+}
+
+// UnmarshalPayloadWithAllowedFields does the same as UnmarshalPayload, but
+// ignores the attributes and relationships not listed in allowed for the type
+// of a resource. See UnmarshalOptions.AllowedFields.
+func UnmarshalPayloadWithAllowedFields(in io.Reader, model interface{}, allowed map[string][]string) error {
+	return UnmarshalPayloadWithOptions(in, model, UnmarshalOptions{AllowedFields: allowed})
 }
 
 // UnmarshalManyPayload converts an io into a set of struct instances using
 // jsonapi tags on the type's struct fields.
+//
+// T is usually a struct pointer. When T is an interface type, the concrete
+// model of every element is chosen by its "type" using the types registered
+// with RegisterType.
 func UnmarshalManyPayload[T any](in io.Reader) ([]T, error) {
 	payload := new(ManyPayload)
 
@@ -137,14 +749,46 @@ func UnmarshalManyPayload[T any](in io.Reader) ([]T, error) {
 	return DecodeManyPayload[T](payload)
 }
 
+// UnmarshalMany converts an io into a slice of *T, T being a struct with
+// jsonapi tags:
+//
+//	posts, err := jsonapi.UnmarshalMany[Post](r.Body)
+//
+// An element whose "type" doesn't match the primary tag of T fails with an
+// *ErrInvalidJSONAPIType.
+func UnmarshalMany[T any](in io.Reader) ([]*T, error) {
+	return UnmarshalManyPayload[*T](in)
+}
+
+// UnmarshalManyPayloadWithOptions does the same as UnmarshalManyPayload, with
+// the behaviour adjusted by options. See UnmarshalOptions for details.
+func UnmarshalManyPayloadWithOptions[T any](in io.Reader, options UnmarshalOptions) ([]T, error) {
+	payload := new(ManyPayload)
+
+	if err := json.NewDecoder(in).Decode(payload); err != nil {
+		return nil, err
+	}
+
+	return DecodeManyPayloadWithOptions[T](payload, options)
+}
+
 func DecodeManyPayload[T any](payload *ManyPayload) ([]T, error) {
+	return DecodeManyPayloadWithOptions[T](payload, UnmarshalOptions{})
+}
+
+// DecodeManyPayloadWithOptions does the same as DecodeManyPayload, with the
+// behaviour adjusted by options. See UnmarshalOptions for details.
+func DecodeManyPayloadWithOptions[T any](payload *ManyPayload, options UnmarshalOptions) ([]T, error) {
+	if payload.Data != nil && len(payload.Errors) > 0 && !options.AllowDataWithErrors {
+		return nil, ErrDataWithErrors
+	}
+
 	models := make([]T, 0, len(payload.Data)) // will be populated from the "data"
 	includedMap := map[string]*Node{}         // will be populated from the "included"
 
 	if payload.Included != nil {
 		for _, included := range payload.Included {
-			key := fmt.Sprintf("%s,%s", included.Type, included.ID)
-			includedMap[key] = included
+			includedMap[included.key()] = included
 		}
 	}
 
@@ -152,27 +796,117 @@ func DecodeManyPayload[T any](payload *ManyPayload) ([]T, error) {
 		return nil, nil
 	}
 
-	for _, data := range payload.Data {
+	for i, data := range payload.Data {
 		var model T
-		err := unmarshalNodeGeneric(data, &model, includedMap)
+		err := unmarshalNodeGeneric(data, &model, includedMap, &options)
 		if err != nil {
-			return nil, err
+			return nil, locateMissingAttributes(err, data, "/data/"+strconv.Itoa(i), payload.Included)
 		}
 		models = append(models, model)
 	}
 
-	return models, nil
-}
-
-func unmarshalNodeGeneric[T any](data *Node, model *T, includedMap map[string]*Node) error {
+	return models, nil
+}
+
+// ManyPayloadInto converts the nodes of an already decoded (and possibly
+// modified) ManyPayload into typed models without re-encoding it to JSON.
+// Relationships are resolved against the payload's "included" array.
+//
+// Go methods can't have type parameters, hence this isn't a method of
+// ManyPayload.
+func ManyPayloadInto[T any](p *ManyPayload) ([]*T, error) {
+	if p == nil {
+		return nil, nil
+	}
+
+	return DecodeManyPayload[*T](p)
+}
+
+// UnmarshalManyPayloadWithIndex converts an io into a set of struct instances
+// like UnmarshalManyPayload, and additionally returns an IncludedIndex over the
+// "included" array so that related resources can be resolved on demand.
+func UnmarshalManyPayloadWithIndex[T any](in io.Reader) (data []*T, index *IncludedIndex, err error) {
+	payload := new(ManyPayload)
+
+	if err = json.NewDecoder(in).Decode(payload); err != nil {
+		return nil, nil, err
+	}
+
+	data, err = DecodeManyPayload[*T](payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, newIncludedIndex(payload.Included), nil
+}
+
+// IncludedIndex gives access to the resources of a compound document's
+// "included" array by type and id. The lookup map is only built on the first
+// call to Get or GetAs.
+type IncludedIndex struct {
+	nodes []*Node
+	once  sync.Once
+	index map[string]*Node
+}
+
+func newIncludedIndex(nodes []*Node) *IncludedIndex {
+	return &IncludedIndex{nodes: nodes}
+}
+
+func (i *IncludedIndex) build() {
+	i.index = make(map[string]*Node, len(i.nodes))
+	for _, n := range i.nodes {
+		if n == nil {
+			continue
+		}
+		i.index[fmt.Sprintf("%s,%s", n.Type, n.ID)] = n
+	}
+}
+
+// Get returns the included resource with the given type and id.
+func (i *IncludedIndex) Get(typ, id string) (*Node, bool) {
+	if i == nil {
+		return nil, false
+	}
+	i.once.Do(i.build)
+
+	n, ok := i.index[fmt.Sprintf("%s,%s", typ, id)]
+	return n, ok
+}
+
+// GetAs unmarshals the included resource with the given type and id into
+// target, which should be a pointer to a struct. Relationships of the resource
+// are resolved against the same index.
+func (i *IncludedIndex) GetAs(typ, id string, target interface{}) error {
+	n, ok := i.Get(typ, id)
+	if !ok {
+		return ErrIncludedNotFound
+	}
+
+	return unmarshalNode(n, reflect.ValueOf(target), &i.index, nil)
+}
+
+func unmarshalNodeGeneric[T any](data *Node, model *T, includedMap map[string]*Node, options *UnmarshalOptions) error {
+	typeOf := reflect.TypeOf(model).Elem()
+	if typeOf.Kind() == reflect.Interface {
+		// dispatch on the resource type to a registered concrete type
+		modelValue, err := newRegisteredModel(data.Type, typeOf)
+		if err != nil {
+			return err
+		}
+		if err := unmarshalNode(data, modelValue, &includedMap, options); err != nil {
+			return err
+		}
+		reflect.ValueOf(model).Elem().Set(modelValue)
+		return nil
+	}
+
 	//check if T is Pointer
-	var t T
-	typeOf := reflect.TypeOf(t)
 	if typeOf.Kind() != reflect.Ptr {
 		return errors.New("T must be a pointer")
 	}
 	modelValue := reflect.New(typeOf.Elem())
-	err := unmarshalNode(data, modelValue, &includedMap)
+	err := unmarshalNode(data, modelValue, &includedMap, options)
 	if err != nil {
 		return err
 	}
@@ -180,7 +914,7 @@ func unmarshalNodeGeneric[T any](data *Node, model *T, includedMap map[string]*N
 	return nil
 }
 
-func unmarshalNode(data *Node, model reflect.Value, included *map[string]*Node) (err error) {
+func unmarshalNode(data *Node, model reflect.Value, included *map[string]*Node, options *UnmarshalOptions) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("data is not a jsonapi representation of '%v'", model.Type())
@@ -190,7 +924,14 @@ func unmarshalNode(data *Node, model reflect.Value, included *map[string]*Node)
 	modelValue := model.Elem()
 	modelType := modelValue.Type()
 
+	if err := options.checkFields(data); err != nil {
+		return err
+	}
+
 	var er error
+	var missing []string // required attributes absent from data
+	mapped := map[string]bool{}
+	var extraField reflect.Value
 
 	for i := 0; i < modelValue.NumField(); i++ {
 		fieldType := modelType.Field(i)
@@ -209,8 +950,7 @@ func unmarshalNode(data *Node, model reflect.Value, included *map[string]*Node)
 
 		annotation := args[0]
 
-		if (annotation == annotationClientID && len(args) != 1) ||
-			(annotation != annotationClientID && len(args) < 2) {
+		if !validTagArgs(args) {
 			er = ErrBadJSONAPIStructTag
 			break
 		}
@@ -226,8 +966,31 @@ func unmarshalNode(data *Node, model reflect.Value, included *map[string]*Node)
 				continue
 			}
 
+			id := data.ID
+			if n, ok, err := compositeKey(args); ok {
+				if err != nil {
+					er = err
+					break
+				}
+				parts, err := splitCompositeID(data.ID, compositeKeyCount(modelType), options.compositeIDSeparator())
+				if err != nil || n > len(parts) {
+					er = ErrBadJSONAPIID
+					break
+				}
+				id = parts[n-1]
+			}
+
+			// Types registered with RegisterIDCoercion take precedence
+			if ok, err := coerceID(fieldValue, id); ok {
+				er = err
+				if er != nil {
+					break
+				}
+				continue
+			}
+
 			// ID will have to be transmitted as astring per the JSON API spec
-			v := reflect.ValueOf(data.ID)
+			v := reflect.ValueOf(id)
 
 			// Deal with PTRS
 			var kind reflect.Kind
@@ -243,9 +1006,14 @@ func unmarshalNode(data *Node, model reflect.Value, included *map[string]*Node)
 				continue
 			}
 
+			if !isNumericKind(kind) {
+				er = &ErrNoIDCoercion{Type: fieldType.Type}
+				break
+			}
+
 			// Value was not a string... only other supported type was a numeric,
 			// which would have been sent as a float value.
-			floatValue, err := strconv.ParseFloat(data.ID, 64)
+			floatValue, err := strconv.ParseFloat(id, 64)
 			if err != nil {
 				// Could not convert the value in the "id" attr to a float
 				er = ErrBadJSONAPIID
@@ -268,18 +1036,81 @@ func unmarshalNode(data *Node, model reflect.Value, included *map[string]*Node)
 				continue
 			}
 
-			fieldValue.Set(reflect.ValueOf(data.ClientID))
+			// SetString also accepts named string types
+			fieldValue.SetString(data.ClientID)
+		} else if annotation == annotationLID {
+			if data.LID == "" {
+				continue
+			}
+
+			// SetString also accepts named string types
+			fieldValue.SetString(data.LID)
+		} else if annotation == annotationMeta {
+			if data.Meta == nil {
+				continue
+			}
+
+			value := (*data.Meta)[args[1]]
+			if value == nil {
+				continue
+			}
+
+			v, err := unmarshalAttribute(value, args, fieldType, fieldValue)
+			if err != nil {
+				er = err
+				break
+			}
+
+			assign(fieldValue, v)
 		} else if annotation == annotationAttribute {
 			attributes := data.Attributes
 
-			if attributes == nil || len(data.Attributes) == 0 {
+			name := options.attrName(data.Type, args[1])
+			mapped[name] = true
+			if _, ok := tagOptionArg(args, annotationMethod); ok {
+				// method-backed attributes are read-only
+				continue
+			}
+			if !options.fieldAllowed(data.Type, name) {
 				continue
 			}
 
-			attribute := attributes[args[1]]
+			attribute := attributes[name]
 
 			// continue if the attribute was not included in the request
 			if attribute == nil {
+				if hasTagOption(args, annotationRequired) {
+					missing = append(missing, name)
+				}
+				continue
+			}
+
+			codec, err := attrCodec(args)
+			if err != nil {
+				er = err
+				break
+			}
+			if codec != nil {
+				if attribute, err = codec.Decode(attribute); err != nil {
+					er = err
+					break
+				}
+				// a decoded value of the field type is assigned as is
+				if v := reflect.ValueOf(attribute); v.IsValid() && v.Type().AssignableTo(fieldValue.Type()) {
+					fieldValue.Set(v)
+					continue
+				}
+				if attribute == nil {
+					continue
+				}
+			}
+
+			if t, ok, err := options.parseTime(attribute, fieldValue); ok {
+				if err != nil {
+					er = fmt.Errorf("jsonapi: attribute %q: %w", name, err)
+					break
+				}
+				assign(fieldValue, reflect.ValueOf(t))
 				continue
 			}
 
@@ -292,50 +1123,121 @@ func unmarshalNode(data *Node, model reflect.Value, included *map[string]*Node)
 
 			assign(fieldValue, value)
 		} else if annotation == annotationRelation {
+			relation := options.relationName(args[1])
 			isSlice := fieldValue.Type().Kind() == reflect.Slice
+			isMap := fieldValue.Type().Kind() == reflect.Map
+
+			// a pointer to a has-many is only set when the relationship is
+			// present, to an empty slice when its data is empty
+			var sliceRef reflect.Value
+			if isSliceRef(fieldValue.Type()) {
+				sliceRef = fieldValue
+				fieldValue = reflect.New(fieldValue.Type().Elem()).Elem()
+				isSlice = true
+			}
+
+			// polymorphic relations hold an interface, or a slice of them,
+			// set to the type registered for each related resource
+			polymorphic := hasTagOption(args, annotationPolymorphic)
+			relatedType := fieldValue.Type()
+			if isSlice || isMap {
+				relatedType = relatedType.Elem()
+			}
+			if polymorphic != (relatedType.Kind() == reflect.Interface) {
+				er = ErrBadJSONAPIStructTag
+				break
+			}
+
+			if data.Relationships == nil || data.Relationships[relation] == nil {
+				continue
+			}
+
+			if !options.fieldAllowed(data.Type, relation) {
+				continue
+			}
 
-			if data.Relationships == nil || data.Relationships[args[1]] == nil {
+			if options != nil && options.NumericRelationshipIDs {
+				stringifyLinkageIDs(data.Relationships[relation])
+			}
+
+			if isIdentifierField(fieldValue.Type()) {
+				if er = unmarshalIdentifiers(data, relation, fieldValue, options); er != nil {
+					break
+				}
+				if sliceRef.IsValid() {
+					sliceRef.Set(fieldValue.Addr())
+				}
 				continue
 			}
 
-			if isSlice {
+			if isMap && fieldValue.Type().Key().Kind() != reflect.String {
+				er = ErrBadJSONAPIStructTag
+				break
+			}
+
+			if isSlice || isMap {
 				// to-many relationship
 				relationship := new(RelationshipManyNode)
 
-				buf := bytes.NewBuffer(nil)
+				buf := getBuffer()
 
-				json.NewEncoder(buf).Encode(data.Relationships[args[1]])
+				json.NewEncoder(buf).Encode(data.Relationships[relation])
 				json.NewDecoder(buf).Decode(relationship)
+				putBuffer(buf)
 
-				data := relationship.Data
+				linkage := relationship.Data
 				models := reflect.New(fieldValue.Type()).Elem()
+				if isMap {
+					// keyed by the id of the related resources
+					models = reflect.MakeMapWithSize(fieldValue.Type(), len(linkage))
+				}
+
+				for _, n := range linkage {
+					if options.skipPending(data, relation, n) {
+						continue
+					}
+					if err := options.checkLinkage(data, relation, n); err != nil {
+						er = err
+						break
+					}
 
-				for _, n := range data {
-					m := reflect.New(fieldValue.Type().Elem().Elem())
+					m, err := newRelatedModel(n, relatedType)
+					if err != nil {
+						er = err
+						break
+					}
 
-					if err := unmarshalNode(
-						fullNode(n, included),
-						m,
-						included,
-					); err != nil {
+					if err := unmarshalRelated(n, m, included, options); err != nil {
 						er = err
 						break
 					}
 
-					models = reflect.Append(models, m)
+					if isMap {
+						key := reflect.ValueOf(n.ID).Convert(fieldValue.Type().Key())
+						models.SetMapIndex(key, m)
+					} else {
+						models = reflect.Append(models, m)
+					}
 				}
 
 				fieldValue.Set(models)
+				if sliceRef.IsValid() {
+					if models.Len() == 0 {
+						fieldValue.Set(reflect.MakeSlice(fieldValue.Type(), 0, 0))
+					}
+					sliceRef.Set(fieldValue.Addr())
+				}
 			} else {
 				// to-one relationships
 				relationship := new(RelationshipOneNode)
 
-				buf := bytes.NewBuffer(nil)
+				buf := getBuffer()
 
 				json.NewEncoder(buf).Encode(
-					data.Relationships[args[1]],
+					data.Relationships[relation],
 				)
 				json.NewDecoder(buf).Decode(relationship)
+				putBuffer(buf)
 
 				/*
 					http://jsonapi.org/format/#document-resource-object-relationships
@@ -343,16 +1245,20 @@ func unmarshalNode(data *Node, model reflect.Value, included *map[string]*Node)
 					relationship can have a data node set to null (e.g. to disassociate the relationship)
 					so unmarshal and set fieldValue only if data obj is not null
 				*/
-				if relationship.Data == nil {
+				if relationship.Data == nil || options.skipPending(data, relation, relationship.Data) {
 					continue
 				}
+				if err := options.checkLinkage(data, relation, relationship.Data); err != nil {
+					er = err
+					break
+				}
 
-				m := reflect.New(fieldValue.Type().Elem())
-				if err := unmarshalNode(
-					fullNode(relationship.Data, included),
-					m,
-					included,
-				); err != nil {
+				m, err := newRelatedModel(relationship.Data, relatedType)
+				if err != nil {
+					er = err
+					break
+				}
+				if err := unmarshalRelated(relationship.Data, m, included, options); err != nil {
 					er = err
 					break
 				}
@@ -361,19 +1267,226 @@ func unmarshalNode(data *Node, model reflect.Value, included *map[string]*Node)
 
 			}
 
+		} else if annotation == annotationAttrExtra {
+			if fieldValue.Type() != reflect.TypeOf(map[string]interface{}{}) {
+				er = ErrBadJSONAPIStructTag
+				break
+			}
+			extraField = fieldValue
+		} else if annotation == annotationRelationMap {
+			// relation-map fields are only used when marshaling
+			continue
+		} else if annotation == annotationLinks {
+			if fieldValue.Type() != reflect.TypeOf(new(Links)) {
+				er = ErrBadJSONAPIStructTag
+				break
+			}
+
+			links := data.Links
+			if len(args) > 1 {
+				links = relationshipLinks(data, options.relationName(args[1]))
+			}
+			if links == nil {
+				continue
+			}
+			fieldValue.Set(reflect.ValueOf(decodedLinks(links)))
 		} else {
 			er = fmt.Errorf("unsupported jsonapi tag annotation, %s", annotation)
 		}
 	}
 
+	if er == nil && extraField.IsValid() {
+		extra := map[string]interface{}{}
+		for name, value := range data.Attributes {
+			if !mapped[name] && options.fieldAllowed(data.Type, name) {
+				extra[name] = value
+			}
+		}
+		if len(extra) > 0 {
+			extraField.Set(reflect.ValueOf(extra))
+		}
+	}
+
+	if er == nil && len(missing) > 0 {
+		er = &ErrMissingAttributes{Type: data.Type, ID: data.ID, Attributes: missing}
+	}
+
 	return er
 }
 
-func fullNode(n *Node, included *map[string]*Node) *Node {
-	includedKey := fmt.Sprintf("%s,%s", n.Type, n.ID)
+// newRelatedModel allocates the model for the related resource n, of the
+// registered type for an interface field type t, or else of the struct type t
+// points to.
+func newRelatedModel(n *Node, t reflect.Type) (reflect.Value, error) {
+	if t.Kind() == reflect.Interface {
+		return newRegisteredModel(n.Type, t)
+	}
+	return reflect.New(t.Elem()), nil
+}
+
+// parseTime parses a string attribute for a time field with the TimeParser,
+// reporting whether it applied.
+func (o *UnmarshalOptions) parseTime(attribute interface{}, fieldValue reflect.Value) (time.Time, bool, error) {
+	if o == nil || o.TimeParser == nil {
+		return time.Time{}, false, nil
+	}
+	if t := fieldValue.Type(); t != reflect.TypeOf(time.Time{}) && t != reflect.TypeOf(new(time.Time)) {
+		return time.Time{}, false, nil
+	}
+	s, ok := attribute.(string)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	t, err := o.TimeParser(s)
+	return t, true, err
+}
+
+// checkLinkage returns an *ErrInvalidLinkage when the resource identifier n
+// of the relation of parent lacks a type or id, unless LenientLinkage is set.
+func (o *UnmarshalOptions) checkLinkage(parent *Node, relation string, n *Node) error {
+	if o != nil && o.LenientLinkage {
+		return nil
+	}
+
+	var member string
+	if n.Type == "" {
+		member = "type"
+	} else if n.ID == "" && n.LID == "" && n.ClientID == "" {
+		member = "id"
+	} else {
+		return nil
+	}
+
+	return &ErrInvalidLinkage{Relationship: relation, Type: parent.Type, ID: parent.ID, Member: member}
+}
+
+// skipPending reports whether the relationship node n should be skipped
+// because it is an identifier without an id, recording it as pending for the
+// relation of parent.
+func (o *UnmarshalOptions) skipPending(parent *Node, relation string, n *Node) bool {
+	if o == nil || !o.LenientRelationships {
+		return false
+	}
 
-	if included != nil && (*included)[includedKey] != nil {
-		return (*included)[includedKey]
+	if n.ID != "" || n.ClientID != "" || len(n.Attributes) > 0 || len(n.Relationships) > 0 {
+		return false
+	}
+
+	if o.PendingRelationships != nil {
+		key := PendingKey{Type: parent.Type, ID: parent.ID, LID: parent.LID, Relationship: relation}
+		o.PendingRelationships[key] = append(o.PendingRelationships[key], n)
+	}
+
+	return true
+}
+
+// stringifyLinkageIDs replaces numeric "id" members in the linkage of the
+// decoded relationship object rel with their string form.
+func stringifyLinkageIDs(rel interface{}) {
+	relationship, ok := rel.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	identifiers := []interface{}{relationship["data"]}
+	if many, ok := relationship["data"].([]interface{}); ok {
+		identifiers = many
+	}
+
+	for _, i := range identifiers {
+		identifier, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch id := identifier["id"].(type) {
+		case float64:
+			identifier["id"] = strconv.FormatFloat(id, 'f', -1, 64)
+		case json.Number:
+			identifier["id"] = id.String()
+		}
+	}
+}
+
+// unmarshalIdentifiers sets a relation field holding Identifier linkage from
+// the linkage of the relationship of data, without resolving it against the
+// included resources.
+func unmarshalIdentifiers(data *Node, relation string, fieldValue reflect.Value, options *UnmarshalOptions) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	var relationship struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewEncoder(buf).Encode(data.Relationships[relation]); err != nil {
+		return err
+	}
+	if err := json.NewDecoder(buf).Decode(&relationship); err != nil {
+		return err
+	}
+
+	return setIdentifiers(relationship.Data, fieldValue, func(n *Node) error {
+		return options.checkLinkage(data, relation, n)
+	})
+}
+
+// setIdentifiers sets a relation field holding Identifier linkage from the
+// JSON linkage, calling check with every resource identifier.
+func setIdentifiers(linkage json.RawMessage, fieldValue reflect.Value, check func(n *Node) error) error {
+	if fieldValue.Kind() == reflect.Slice {
+		var nodes []*Node
+		if err := json.Unmarshal(linkage, &nodes); err != nil {
+			return err
+		}
+		ids := make([]Identifier, 0, len(nodes))
+		for _, n := range nodes {
+			if err := check(n); err != nil {
+				return err
+			}
+			ids = append(ids, Identifier{Type: n.Type, ID: n.ID})
+		}
+		fieldValue.Set(reflect.ValueOf(ids))
+		return nil
+	}
+
+	var n *Node
+	if err := json.Unmarshal(linkage, &n); err != nil {
+		return err
+	}
+	if n == nil {
+		fieldValue.Set(reflect.Zero(fieldValue.Type()))
+		return nil
+	}
+	if err := check(n); err != nil {
+		return err
+	}
+
+	id := Identifier{Type: n.Type, ID: n.ID}
+	if fieldValue.Kind() == reflect.Ptr {
+		fieldValue.Set(reflect.ValueOf(&id))
+	} else {
+		fieldValue.Set(reflect.ValueOf(id))
+	}
+	return nil
+}
+
+// unmarshalRelated unmarshals the related resource n into m, resolving it
+// against included. Resource identifiers that weren't included only hold
+// linkage, so their required attributes aren't enforced.
+func unmarshalRelated(n *Node, m reflect.Value, included *map[string]*Node, options *UnmarshalOptions) error {
+	full := fullNode(n, included)
+
+	err := unmarshalNode(full, m, included, options)
+	if _, ok := err.(*ErrMissingAttributes); ok && full == n {
+		return nil
+	}
+	return err
+}
+
+func fullNode(n *Node, included *map[string]*Node) *Node {
+	if included != nil && (*included)[n.key()] != nil {
+		return (*included)[n.key()]
 	}
 
 	return n
@@ -411,6 +1524,8 @@ func assignValue(field, value reflect.Value) {
 		field.SetString(value.String())
 	case reflect.Bool:
 		field.SetBool(value.Bool())
+	case reflect.Complex64, reflect.Complex128:
+		field.SetComplex(value.Complex())
 	default:
 		field.Set(value)
 	}
@@ -426,12 +1541,6 @@ func unmarshalAttribute(
 
 	// TODO can't this just ba generic marshal unmarshal? Would probably be less performant though
 
-	// Handle field of type []string
-	if fieldValue.Type() == reflect.TypeOf([]string{}) {
-		value, err = handleStringSlice(attribute)
-		return
-	}
-
 	// Handle field of type time.Time
 	if fieldValue.Type() == reflect.TypeOf(time.Time{}) ||
 		fieldValue.Type() == reflect.TypeOf(new(time.Time)) {
@@ -439,12 +1548,45 @@ func unmarshalAttribute(
 		return
 	}
 
+	// Handle field types implementing AttrScanner
+	if scanner, v, ok := attrScanner(fieldValue.Type()); ok {
+		value, err = v, scanner.ScanJSONAPIAttr(attribute)
+		return
+	}
+
+	// Handle complex number fields with the complex option
+	if hasTagOption(args, annotationComplex) {
+		value, err = handleComplex(attribute, args, fieldValue)
+		return
+	}
+
+	// Accept a single value for a slice field with the scalar option, as a
+	// slice of one element
+	if _, isArray := attribute.([]interface{}); !isArray && attribute != nil &&
+		fieldValue.Kind() == reflect.Slice && hasTagOption(args, annotationScalar) {
+		attribute = []interface{}{attribute}
+	}
+
+	// Handle field of type slice of primitives, e.g. []string or []int
+	if isPrimitiveSlice(fieldValue.Type()) {
+		value, err = handlePrimitiveSlice(attribute, fieldValue)
+		return
+	}
+
 	// Handle field of type struct
 	if fieldValue.Type().Kind() == reflect.Struct {
 		value, err = handleStruct(attribute, fieldValue)
 		return
 	}
 
+	// Handle field of type map, e.g. a free-form JSON object, decoded like a
+	// struct so nested maps and struct values get their Go types
+	if t := fieldValue.Type(); t.Kind() == reflect.Map ||
+		(t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Map) {
+		value, err = handleStruct(attribute, fieldValue)
+		return
+	}
+
 	// Handle field containing slice of structs
 	if fieldValue.Type().Kind() == reflect.Slice &&
 		reflect.TypeOf(fieldValue.Interface()).Elem().Kind() == reflect.Struct {
@@ -454,6 +1596,9 @@ func unmarshalAttribute(
 
 	// JSON value was a float (numeric)
 	if value.Kind() == reflect.Float64 {
+		if hasTagOption(args, annotationClamp) {
+			attribute = clampFloat32(attribute.(float64), fieldType)
+		}
 		value, err = handleNumeric(attribute, fieldType, fieldValue)
 		return
 	}
@@ -480,18 +1625,85 @@ func unmarshalAttribute(
 	return
 }
 
-func handleStringSlice(attribute interface{}) (reflect.Value, error) {
-	v := reflect.ValueOf(attribute)
-	values := make([]string, v.Len())
-	for i := 0; i < v.Len(); i++ {
-		values[i] = v.Index(i).Interface().(string)
+var attrScannerType = reflect.TypeOf((*AttrScanner)(nil)).Elem()
+
+// attrScanner allocates a value of type t (or of the type t points to) and
+// returns it when a pointer to it implements AttrScanner. Nothing is
+// allocated for other types.
+func attrScanner(t reflect.Type) (AttrScanner, reflect.Value, bool) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if !reflect.PtrTo(t).Implements(attrScannerType) {
+		return nil, reflect.Value{}, false
+	}
+
+	v := reflect.New(t)
+	scanner, ok := v.Interface().(AttrScanner)
+	return scanner, v, ok
+}
+
+func isPrimitiveSlice(t reflect.Type) bool {
+	if t.Kind() != reflect.Slice {
+		return false
+	}
+
+	switch t.Elem().Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+
+	return false
+}
+
+func handlePrimitiveSlice(attribute interface{}, fieldValue reflect.Value) (reflect.Value, error) {
+	elements, ok := attribute.([]interface{})
+	if !ok {
+		return reflect.Value{}, ErrInvalidType
+	}
+
+	elemType := fieldValue.Type().Elem()
+	values := reflect.MakeSlice(fieldValue.Type(), len(elements), len(elements))
+
+	for i, element := range elements {
+		var v reflect.Value
+
+		switch elemType.Kind() {
+		case reflect.String:
+			s, ok := element.(string)
+			if !ok {
+				return reflect.Value{}, &ErrInvalidSliceElement{Index: i, Err: ErrInvalidType}
+			}
+			v = reflect.ValueOf(s)
+		case reflect.Bool:
+			b, ok := element.(bool)
+			if !ok {
+				return reflect.Value{}, &ErrInvalidSliceElement{Index: i, Err: ErrInvalidType}
+			}
+			v = reflect.ValueOf(b)
+		default:
+			if _, ok := element.(float64); !ok {
+				return reflect.Value{}, &ErrInvalidSliceElement{Index: i, Err: ErrInvalidType}
+			}
+			n, err := handleNumeric(element, elemType, values.Index(i))
+			if err != nil {
+				return reflect.Value{}, &ErrInvalidSliceElement{Index: i, Err: err}
+			}
+			v = reflect.Indirect(n)
+		}
+
+		values.Index(i).Set(v.Convert(elemType))
 	}
 
-	return reflect.ValueOf(values), nil
+	return values, nil
 }
 
 func handleTime(attribute interface{}, args []string, fieldValue reflect.Value) (reflect.Value, error) {
-	var isISO8601, isRFC3339 bool
+	var isISO8601, isRFC3339, isUnixMilli bool
+	var layout string
 	v := reflect.ValueOf(attribute)
 
 	if len(args) > 2 {
@@ -500,10 +1712,32 @@ func handleTime(attribute interface{}, args []string, fieldValue reflect.Value)
 				isISO8601 = true
 			} else if arg == annotationRFC3339 {
 				isRFC3339 = true
+			} else if arg == annotationUnixMilli {
+				isUnixMilli = true
+			} else if l, ok := tagOptionValue(arg, annotationLayout); ok {
+				layout = l
 			}
 		}
 	}
 
+	if layout != "" {
+		s, ok := attribute.(string)
+		if !ok {
+			return reflect.ValueOf(time.Now()), &ErrInvalidTimeLayout{Attribute: args[1], Value: attribute, Layout: layout}
+		}
+
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return reflect.ValueOf(time.Now()), &ErrInvalidTimeLayout{Attribute: args[1], Value: attribute, Layout: layout}
+		}
+
+		if fieldValue.Kind() == reflect.Ptr {
+			return reflect.ValueOf(&t), nil
+		}
+
+		return reflect.ValueOf(t), nil
+	}
+
 	if isISO8601 {
 		if v.Kind() != reflect.String {
 			return reflect.ValueOf(time.Now()), ErrInvalidISO8601
@@ -539,20 +1773,65 @@ func handleTime(attribute interface{}, args []string, fieldValue reflect.Value)
 	}
 
 	var at int64
+	var frac float64
 
 	if v.Kind() == reflect.Float64 {
-		at = int64(v.Interface().(float64))
+		// the fraction of a float epoch is kept rather than truncated
+		f := v.Float()
+		if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return reflect.ValueOf(time.Now()), ErrInvalidTime
+		}
+		var whole float64
+		whole, frac = math.Modf(f)
+		at = int64(whole)
 	} else if v.Kind() == reflect.Int {
 		at = v.Int()
 	} else {
 		return reflect.ValueOf(time.Now()), ErrInvalidTime
 	}
 
-	t := time.Unix(at, 0)
+	t := time.Unix(at, int64(math.Round(frac*float64(time.Second))))
+	if isUnixMilli {
+		t = time.UnixMilli(at).Add(time.Duration(math.Round(frac * float64(time.Millisecond))))
+	}
 
 	return reflect.ValueOf(t), nil
 }
 
+// handleComplex decodes a {"real": ..., "imag": ...} object into a complex
+// number.
+func handleComplex(attribute interface{}, args []string, fieldValue reflect.Value) (reflect.Value, error) {
+	t := fieldValue.Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Complex64 && t.Kind() != reflect.Complex128 {
+		return reflect.Value{}, ErrBadJSONAPIStructTag
+	}
+
+	obj, ok := attribute.(map[string]interface{})
+	if !ok || len(obj) != 2 {
+		return reflect.Value{}, &ErrInvalidComplex{Attribute: args[1], Value: attribute}
+	}
+	re, okRe := obj["real"].(float64)
+	im, okIm := obj["imag"].(float64)
+	if !okRe || !okIm {
+		return reflect.Value{}, &ErrInvalidComplex{Attribute: args[1], Value: attribute}
+	}
+
+	return reflect.ValueOf(complex(re, im)), nil
+}
+
+func isNumericKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
 func handleNumeric(
 	attribute interface{},
 	fieldType reflect.Type,
@@ -601,6 +1880,9 @@ func handleNumeric(
 		n := uint64(floatValue)
 		numericValue = reflect.ValueOf(&n)
 	case reflect.Float32:
+		if !fitsFloat32(floatValue) {
+			return reflect.Value{}, ErrFloat32OutOfRange
+		}
 		n := float32(floatValue)
 		numericValue = reflect.ValueOf(&n)
 	case reflect.Float64:
@@ -613,6 +1895,29 @@ func handleNumeric(
 	return numericValue, nil
 }
 
+// fitsFloat32 reports whether f can be stored in a float32 without overflowing
+// to infinity or underflowing to zero. Precision loss is accepted.
+func fitsFloat32(f float64) bool {
+	abs := math.Abs(f)
+	return f == 0 || (abs <= math.MaxFloat32 && abs >= math.SmallestNonzeroFloat32)
+}
+
+// clampFloat32 limits f to the range of a float32 when t is (a pointer to) a
+// float32, rounding overflows to the largest float32 and underflows to zero.
+func clampFloat32(f float64, t reflect.Type) float64 {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Float32 || fitsFloat32(f) {
+		return f
+	}
+
+	if math.Abs(f) < math.SmallestNonzeroFloat32 {
+		return 0
+	}
+	return math.Copysign(math.MaxFloat32, f)
+}
+
 func handlePointer(
 	attribute interface{},
 	args []string,
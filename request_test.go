@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
 	"sort"
 	"strings"
@@ -1409,3 +1410,1356 @@ func TestUnmarshalNestedStructSlice(t *testing.T) {
 			out.Teams[0].Members[0].Firstname)
 	}
 }
+
+func TestTimeLayout(t *testing.T) {
+	updated := time.Date(2021, 3, 4, 5, 6, 7, 123456789, time.UTC)
+	edition := &Edition{ID: "1", PublishedOn: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), UpdatedAt: &updated}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, edition); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "2021-03-01", payload.Data.Attributes["published_on"]; e != a {
+		t.Fatalf("Was expecting published_on %q, got %v", e, a)
+	}
+	if e, a := "2021-03-04T05:06:07.123456789Z", payload.Data.Attributes["updated_at"]; e != a {
+		t.Fatalf("Was expecting updated_at %q, got %v", e, a)
+	}
+
+	decoded := new(Edition)
+	if err := UnmarshalPayload(bytes.NewReader(out.Bytes()), decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.PublishedOn.Equal(edition.PublishedOn) || !decoded.UpdatedAt.Equal(updated) {
+		t.Fatalf("Was expecting %v and %v, got %v and %v", edition.PublishedOn, updated, decoded.PublishedOn, decoded.UpdatedAt)
+	}
+}
+
+func TestTimeLayout_invalid(t *testing.T) {
+	in := strings.NewReader(`{"data":{"type":"editions","id":"1","attributes":{"published_on":"03/01/2021"}}}`)
+
+	var layoutErr *ErrInvalidTimeLayout
+	if err := UnmarshalPayload(in, new(Edition)); !errors.As(err, &layoutErr) {
+		t.Fatalf("Was expecting an ErrInvalidTimeLayout, got %v", err)
+	}
+	if layoutErr.Attribute != "published_on" || layoutErr.Value != "03/01/2021" {
+		t.Fatalf("Was expecting the attribute and value in the error, got %v", layoutErr)
+	}
+}
+
+func TestUnmarshalClientID(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, &Post{ID: 5, ClientID: "tmp-1", Title: "Created"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the id and the client-id are set independently
+	post := new(Post)
+	if err := UnmarshalPayload(out, post); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := uint64(5), post.ID; e != a {
+		t.Fatalf("Was expecting id %d, got %d", e, a)
+	}
+	if e, a := "tmp-1", post.ClientID; e != a {
+		t.Fatalf("Was expecting client-id %q, got %q", e, a)
+	}
+
+	type correlationID string
+	type draft struct {
+		ID       string        `jsonapi:"primary,drafts"`
+		ClientID correlationID `jsonapi:"client-id"`
+	}
+	d := new(draft)
+	in := strings.NewReader(`{"data":{"type":"drafts","client-id":"tmp-2"}}`)
+	if err := UnmarshalPayload(in, d); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := correlationID("tmp-2"), d.ClientID; e != a {
+		t.Fatalf("Was expecting client-id %q, got %q", e, a)
+	}
+}
+
+func TestUnmarshalWithTimeParser(t *testing.T) {
+	parse := func(s string) (time.Time, error) {
+		for _, layout := range []string{time.RFC3339, iso8601TimeFormat, "2006-01-02"} {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("unsupported time %q", s)
+	}
+
+	in := `{"data": {"type": "timestamps", "id": "1", "attributes": {
+		"defaultv": "2021-03-04",
+		"defaultp": 1614816000,
+		"iso8601v": "2021-03-04T05:06:07+02:00",
+		"iso8601p": "2021-03-04",
+		"rfc3339v": "2021-03-04T05:06:07Z"
+	}}}`
+
+	ts := new(TimestampModel)
+	if err := UnmarshalPayloadWithOptions(strings.NewReader(in), ts, UnmarshalOptions{TimeParser: parse}); err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	if !ts.DefaultV.Equal(date) {
+		t.Fatalf("Was expecting defaultv %v, got %v", date, ts.DefaultV)
+	}
+	if ts.DefaultP == nil || !ts.DefaultP.Equal(date) {
+		t.Fatalf("Was expecting the unix timestamp defaultp %v, got %v", date, ts.DefaultP)
+	}
+	if e := time.Date(2021, 3, 4, 3, 6, 7, 0, time.UTC); !ts.ISO8601V.Equal(e) {
+		t.Fatalf("Was expecting iso8601v %v, got %v", e, ts.ISO8601V)
+	}
+	if ts.ISO8601P == nil || !ts.ISO8601P.Equal(date) {
+		t.Fatalf("Was expecting iso8601p %v, got %v", date, ts.ISO8601P)
+	}
+	if e := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC); !ts.RFC3339V.Equal(e) {
+		t.Fatalf("Was expecting rfc3339v %v, got %v", e, ts.RFC3339V)
+	}
+
+	in = `{"data": {"type": "timestamps", "id": "1", "attributes": {"rfc3339v": "March 4th"}}}`
+	err := UnmarshalPayloadWithOptions(strings.NewReader(in), ts, UnmarshalOptions{TimeParser: parse})
+	if err == nil || !strings.Contains(err.Error(), `"rfc3339v"`) || !strings.Contains(err.Error(), "March 4th") {
+		t.Fatalf("Was expecting the parser error naming the attribute, got %v", err)
+	}
+}
+
+func TestUnmarshalJSONAPIObject(t *testing.T) {
+	in := strings.NewReader(`{"jsonapi":{"version":"1.1","meta":{"ext":"none"}},"data":{"type":"posts","id":"1"}}`)
+
+	payload := new(OnePayload)
+	if err := json.NewDecoder(in).Decode(payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.JSONAPI == nil || payload.JSONAPI.Version != "1.1" || (*payload.JSONAPI.Meta)["ext"] != "none" {
+		t.Fatalf("Was expecting the jsonapi member, got %v", payload.JSONAPI)
+	}
+
+	post := new(Post)
+	if err := DecodeOnePayload(payload, post); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := uint64(1), post.ID; e != a {
+		t.Fatalf("Was expecting id %d, got %d", e, a)
+	}
+}
+
+func TestMapAttributes(t *testing.T) {
+	counts := map[string]int{"rows": 10}
+	dataset := &Dataset{
+		ID: "1",
+		Metadata: map[string]interface{}{
+			"source": "import",
+			"schema": map[string]interface{}{"version": float64(2), "tags": []interface{}{"a", "b"}},
+		},
+		Owners: map[string]Employee{"lead": {Firstname: "Ada", Age: 36}},
+		Counts: &counts,
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, dataset); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := new(Dataset)
+	if err := UnmarshalPayload(out, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dataset.Metadata, decoded.Metadata) {
+		t.Fatalf("Was expecting metadata %v, got %v", dataset.Metadata, decoded.Metadata)
+	}
+	if !reflect.DeepEqual(dataset.Owners, decoded.Owners) {
+		t.Fatalf("Was expecting owners %v, got %v", dataset.Owners, decoded.Owners)
+	}
+	if decoded.Counts == nil || !reflect.DeepEqual(counts, *decoded.Counts) {
+		t.Fatalf("Was expecting counts %v, got %v", counts, decoded.Counts)
+	}
+}
+
+func TestUnmarshalMapRelation(t *testing.T) {
+	in := strings.NewReader(`{
+		"data": {"type": "posts", "id": "1", "relationships": {
+			"comments": {"data": [{"type": "comments", "id": "2"}, {"type": "comments", "id": "5"}]}
+		}},
+		"included": [
+			{"type": "comments", "id": "2", "attributes": {"body": "Two"}},
+			{"type": "comments", "id": "5", "attributes": {"body": "Five"}}
+		]
+	}`)
+
+	post := new(IndexedPost)
+	if err := UnmarshalPayload(in, post); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := 2, len(post.Comments); e != a {
+		t.Fatalf("Was expecting %d comments, got %d", e, a)
+	}
+	if c := post.Comments["2"]; c == nil || c.ID != 2 || c.Body != "Two" {
+		t.Fatalf("Was expecting comment 2 under its id, got %#v", c)
+	}
+	if c := post.Comments["5"]; c == nil || c.Body != "Five" {
+		t.Fatalf("Was expecting comment 5 under its id, got %#v", c)
+	}
+}
+
+func TestUnmarshalManyPayloadWithIndex(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, []*Post{testModel().Posts[0]}); err != nil {
+		t.Fatal(err)
+	}
+
+	posts, index, err := UnmarshalManyPayloadWithIndex[Post](out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 {
+		t.Fatalf("Was expecting 1 post, got %d", len(posts))
+	}
+
+	if _, ok := index.Get("comments", "2"); !ok {
+		t.Fatal("Was expecting comments,2 to be in the included index")
+	}
+	if _, ok := index.Get("comments", "42"); ok {
+		t.Fatal("Was not expecting comments,42 to be in the included index")
+	}
+
+	comment := new(Comment)
+	if err := index.GetAs("comments", "2", comment); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "bar", comment.Body; e != a {
+		t.Fatalf("Was expecting comment body %q, got %q", e, a)
+	}
+
+	if err := index.GetAs("comments", "42", comment); err != ErrIncludedNotFound {
+		t.Fatalf("Was expecting %v, got %v", ErrIncludedNotFound, err)
+	}
+}
+
+func TestManyPayloadInto(t *testing.T) {
+	payload, err := Marshal([]*Post{testModel().Posts[0], testModel().Posts[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	many := payload.(*ManyPayload)
+
+	// drop the first post before converting back
+	many.Data = many.Data[1:]
+
+	posts, err := ManyPayloadInto[Post](many)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(posts); e != a {
+		t.Fatalf("Was expecting %d posts, got %d", e, a)
+	}
+	if e, a := uint64(2), posts[0].ID; e != a {
+		t.Fatalf("Was expecting post id %d, got %d", e, a)
+	}
+	if e, a := "bas", posts[0].Comments[1].Body; e != a {
+		t.Fatalf("Was expecting the included comment body %q, got %q", e, a)
+	}
+}
+
+func TestUnmarshalPayloadPreservingNode(t *testing.T) {
+	data := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "posts",
+			"id":   "1",
+			"attributes": map[string]interface{}{
+				"title":    "Post",
+				"unmapped": "value",
+			},
+			"links": map[string]interface{}{
+				"self": "http://example.com/posts/1",
+			},
+			"meta": map[string]interface{}{
+				"version": "3",
+			},
+		},
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := new(Post)
+	node, err := UnmarshalPayloadPreservingNode(bytes.NewReader(b), post)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := "Post", post.Title; e != a {
+		t.Fatalf("Was expecting title %q, got %q", e, a)
+	}
+	if e, a := "value", node.Attributes["unmapped"]; e != a {
+		t.Fatalf("Was expecting the unmapped attribute %q, got %v", e, a)
+	}
+	if e, a := "3", (*node.Meta)["version"]; e != a {
+		t.Fatalf("Was expecting meta.version %q, got %v", e, a)
+	}
+	if e, a := "http://example.com/posts/1", (*node.Links)["self"]; e != a {
+		t.Fatalf("Was expecting links.self %q, got %v", e, a)
+	}
+}
+
+func TestUnmarshalMetaField(t *testing.T) {
+	data := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "posts",
+			"id":   "1",
+			"meta": map[string]interface{}{
+				"version": 7,
+				"etag":    "abc",
+			},
+		},
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := new(VersionedPost)
+	if err := UnmarshalPayload(bytes.NewReader(b), post); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := 7, post.Version; e != a {
+		t.Fatalf("Was expecting version %d, got %d", e, a)
+	}
+	if e, a := "abc", post.ETag; e != a {
+		t.Fatalf("Was expecting etag %q, got %q", e, a)
+	}
+}
+
+func TestUnmarshalPayloadWithOptions_lenientRelationships(t *testing.T) {
+	data := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "posts",
+			"id":   "1",
+			"relationships": map[string]interface{}{
+				"comments": map[string]interface{}{
+					"data": []interface{}{
+						map[string]interface{}{"type": "comments", "id": "123"},
+						map[string]interface{}{"type": "comments"},
+					},
+				},
+				"latest_comment": map[string]interface{}{
+					"data": map[string]interface{}{"type": "comments"},
+				},
+			},
+		},
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := map[PendingKey][]*Node{}
+	post := new(Post)
+	if err := UnmarshalPayloadWithOptions(bytes.NewReader(b), post, UnmarshalOptions{
+		LenientRelationships: true,
+		PendingRelationships: pending,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := 1, len(post.Comments); e != a {
+		t.Fatalf("Was expecting %d comments, got %d", e, a)
+	}
+	if post.LatestComment != nil {
+		t.Fatalf("Was expecting the latest comment to be skipped, got %v", post.LatestComment)
+	}
+	comments := PendingKey{Type: "posts", ID: "1", Relationship: "comments"}
+	if e, a := 1, len(pending[comments]); e != a {
+		t.Fatalf("Was expecting %d pending comments, got %d", e, a)
+	}
+	latest := PendingKey{Type: "posts", ID: "1", Relationship: "latest_comment"}
+	if e, a := "comments", pending[latest][0].Type; e != a {
+		t.Fatalf("Was expecting a pending latest_comment of type %q, got %q", e, a)
+	}
+
+	// the default behaviour rejects the identifiers without an id
+	var invalid *ErrInvalidLinkage
+	if err := UnmarshalPayload(bytes.NewReader(b), new(Post)); !errors.As(err, &invalid) {
+		t.Fatalf("Was expecting an ErrInvalidLinkage, got %v", err)
+	}
+
+	// and with LenientLinkage unmarshals them into empty models
+	post = new(Post)
+	if err := UnmarshalPayloadWithOptions(bytes.NewReader(b), post, UnmarshalOptions{LenientLinkage: true}); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, len(post.Comments); e != a {
+		t.Fatalf("Was expecting %d comments, got %d", e, a)
+	}
+}
+
+func TestUnmarshalManyPayloadWithOptions_pendingRelationships(t *testing.T) {
+	post := func(id string) map[string]interface{} {
+		return map[string]interface{}{
+			"type": "posts",
+			"id":   id,
+			"relationships": map[string]interface{}{
+				"comments": map[string]interface{}{
+					"data": []interface{}{
+						map[string]interface{}{"type": "comments"},
+					},
+				},
+			},
+		}
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"data": []interface{}{post("1"), post("2")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := map[PendingKey][]*Node{}
+	if _, err := UnmarshalManyPayloadWithOptions[*Post](bytes.NewReader(b), UnmarshalOptions{
+		LenientRelationships: true,
+		PendingRelationships: pending,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// each post keeps its own pending comments
+	if e, a := 2, len(pending); e != a {
+		t.Fatalf("Was expecting pending relationships for %d posts, got %v", e, pending)
+	}
+	for _, id := range []string{"1", "2"} {
+		key := PendingKey{Type: "posts", ID: id, Relationship: "comments"}
+		if e, a := 1, len(pending[key]); e != a {
+			t.Fatalf("Was expecting %d pending comments for post %s, got %d", e, id, a)
+		}
+	}
+}
+
+func TestUnmarshalPayloadWithOptions_numericRelationshipIDs(t *testing.T) {
+	data := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "posts",
+			"id":   "1",
+			"relationships": map[string]interface{}{
+				"comments": map[string]interface{}{
+					"data": []interface{}{
+						map[string]interface{}{"type": "comments", "id": 5},
+					},
+				},
+				"latest_comment": map[string]interface{}{
+					"data": map[string]interface{}{"type": "comments", "id": 5},
+				},
+			},
+		},
+		"included": []interface{}{
+			map[string]interface{}{
+				"type":       "comments",
+				"id":         "5",
+				"attributes": map[string]interface{}{"body": "first"},
+			},
+		},
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := new(Post)
+	if err := UnmarshalPayloadWithOptions(bytes.NewReader(b), post, UnmarshalOptions{
+		NumericRelationshipIDs: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := 1, len(post.Comments); e != a {
+		t.Fatalf("Was expecting %d comments, got %d", e, a)
+	}
+	if e, a := "first", post.Comments[0].Body; e != a {
+		t.Fatalf("Was expecting the included comment body %q, got %q", e, a)
+	}
+	if post.LatestComment == nil || post.LatestComment.ID != 5 {
+		t.Fatalf("Was expecting latest comment 5, got %v", post.LatestComment)
+	}
+	if e, a := "first", post.LatestComment.Body; e != a {
+		t.Fatalf("Was expecting the included comment body %q, got %q", e, a)
+	}
+
+	// the default behaviour does not resolve numeric ids
+	post = new(Post)
+	if err := UnmarshalPayloadWithOptions(bytes.NewReader(b), post, UnmarshalOptions{LenientLinkage: true}); err != nil {
+		t.Fatal(err)
+	}
+	if post.LatestComment != nil && post.LatestComment.Body != "" {
+		t.Fatalf("Was not expecting the numeric id to be resolved, got %v", post.LatestComment)
+	}
+}
+
+func TestUnmarshalInvalidLinkage(t *testing.T) {
+	for member, linkage := range map[string]string{
+		"type": `{"id": "2"}`,
+		"id":   `{"type": "comments", "id": ""}`,
+	} {
+		in := `{"data": {"type": "posts", "id": "1", "relationships": {
+			"comments": {"data": [{"type": "comments", "id": "1"}, ` + linkage + `]}
+		}}}`
+
+		var invalid *ErrInvalidLinkage
+		if err := UnmarshalPayload(strings.NewReader(in), new(Post)); !errors.As(err, &invalid) {
+			t.Fatalf("Was expecting an ErrInvalidLinkage, got %v", err)
+		}
+		expected := ErrInvalidLinkage{Relationship: "comments", Type: "posts", ID: "1", Member: member}
+		if *invalid != expected {
+			t.Fatalf("Was expecting %v, got %v", expected, *invalid)
+		}
+	}
+
+	// local ids identify resources created in the same request
+	in := `{"data": {"type": "tasks", "id": "1", "relationships": {
+		"parent": {"data": {"type": "tasks", "lid": "a"}}
+	}}}`
+	if err := UnmarshalPayload(strings.NewReader(in), new(Task)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnmarshalPrimitiveSlices(t *testing.T) {
+	in := sampleWithPrimitiveSlices(map[string]interface{}{
+		"ints":     []interface{}{1, 2, 3},
+		"int64s":   []interface{}{int64(1) << 40},
+		"floats":   []interface{}{1.5, 2},
+		"bools":    []interface{}{true, false},
+		"strings":  []interface{}{"a", "b"},
+		"customs":  []interface{}{"c"},
+		"unsigned": []interface{}{7},
+	})
+
+	out := new(PrimitiveSlices)
+	if err := UnmarshalPayload(in, out); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &PrimitiveSlices{
+		ID:       "1",
+		Ints:     []int{1, 2, 3},
+		Int64s:   []int64{1 << 40},
+		Floats:   []float64{1.5, 2},
+		Bools:    []bool{true, false},
+		Strings:  []string{"a", "b"},
+		Customs:  []CustomStringType{"c"},
+		Unsigned: []uint8{7},
+	}
+	if !reflect.DeepEqual(expected, out) {
+		t.Fatalf("Was expecting %+v, got %+v", expected, out)
+	}
+}
+
+func TestUnmarshalPrimitiveSlices_invalidElements(t *testing.T) {
+	for name, attributes := range map[string]map[string]interface{}{
+		"mixed ints":    {"ints": []interface{}{1, "two", 3}},
+		"mixed bools":   {"bools": []interface{}{true, 0}},
+		"mixed strings": {"strings": []interface{}{"a", false}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := UnmarshalPayload(sampleWithPrimitiveSlices(attributes), new(PrimitiveSlices))
+
+			var elementErr *ErrInvalidSliceElement
+			if !errors.As(err, &elementErr) {
+				t.Fatalf("Was expecting an ErrInvalidSliceElement, got %v", err)
+			}
+			if e, a := 1, elementErr.Index; e != a {
+				t.Fatalf("Was expecting the error at index %d, got %d", e, a)
+			}
+			if !errors.Is(err, ErrInvalidType) {
+				t.Fatalf("Was expecting the error to wrap %v, got %v", ErrInvalidType, err)
+			}
+		})
+	}
+
+	if err := UnmarshalPayload(sampleWithPrimitiveSlices(map[string]interface{}{
+		"ints": "1,2,3",
+	}), new(PrimitiveSlices)); err != ErrInvalidType {
+		t.Fatalf("Was expecting %v for a non array value, got %v", ErrInvalidType, err)
+	}
+}
+
+func sampleWithPrimitiveSlices(m map[string]interface{}) io.Reader {
+	payload := &OnePayload{
+		Data: &Node{
+			ID:         "1",
+			Type:       "primitive-slices",
+			Attributes: m,
+		},
+	}
+
+	out := bytes.NewBuffer(nil)
+	json.NewEncoder(out).Encode(payload)
+
+	return out
+}
+
+func TestUnmarshalPayloadLimited(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, testModel().Posts[0]); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(out.Len())
+
+	post := new(Post)
+	if err := UnmarshalPayloadLimited(bytes.NewReader(out.Bytes()), post, size); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "Foo", post.Title; e != a {
+		t.Fatalf("Was expecting title %q, got %q", e, a)
+	}
+
+	err := UnmarshalPayloadLimited(bytes.NewReader(out.Bytes()), new(Post), size/2)
+	if err != ErrPayloadTooLarge {
+		t.Fatalf("Was expecting %v, got %v", ErrPayloadTooLarge, err)
+	}
+
+	// the document fits, but the body goes on past the limit
+	padded := append(out.Bytes(), bytes.Repeat([]byte(" "), 100)...)
+	err = UnmarshalPayloadLimited(bytes.NewReader(padded), new(Post), size+10)
+	if err != ErrPayloadTooLarge {
+		t.Fatalf("Was expecting %v, got %v", ErrPayloadTooLarge, err)
+	}
+
+	// invalid payloads within the limit are reported as usual
+	err = UnmarshalPayloadLimited(strings.NewReader(`{"data":`), new(Post), size)
+	if err == nil || err == ErrPayloadTooLarge {
+		t.Fatalf("Was expecting a decoding error, got %v", err)
+	}
+}
+
+func TestUnmarshalPayload_missingIDOnCreate(t *testing.T) {
+	in := `{"data":{"type":"posts","attributes":{"title":"New"}}}`
+
+	post := &Post{ID: 0}
+	if err := UnmarshalPayload(strings.NewReader(in), post); err != nil {
+		t.Fatal(err)
+	}
+	if post.ID != 0 {
+		t.Fatalf("Was expecting the id to be left zero, got %d", post.ID)
+	}
+	if e, a := "New", post.Title; e != a {
+		t.Fatalf("Was expecting title %q, got %q", e, a)
+	}
+
+	// the type is still validated without an id
+	err := UnmarshalPayload(strings.NewReader(`{"data":{"type":"blogs"}}`), new(Post))
+	if _, ok := err.(*ErrInvalidJSONAPIType); !ok {
+		t.Fatalf("Was expecting an ErrInvalidJSONAPIType, got %v", err)
+	}
+}
+
+func TestIsCreate(t *testing.T) {
+	for in, expected := range map[string]bool{
+		`{"data":{"type":"posts","attributes":{"title":"New"}}}`: true,
+		`{"data":{"type":"posts","id":""}}`:                      true,
+		`{"data":{"type":"posts","id":"1"}}`:                     false,
+	} {
+		isCreate, err := IsCreate(strings.NewReader(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isCreate != expected {
+			t.Fatalf("Was expecting IsCreate of %s to be %v", in, expected)
+		}
+	}
+
+	if _, err := IsCreate(strings.NewReader(`{"meta":{}}`)); err != ErrMissingData {
+		t.Fatalf("Was expecting %v, got %v", ErrMissingData, err)
+	}
+}
+
+func TestUnmarshalAttrScanner(t *testing.T) {
+	in := `{"data":{"type":"invoices","id":"1","attributes":{"total":"1234 EUR","discount":"100 EUR"}}}`
+
+	invoice := new(Invoice)
+	if err := UnmarshalPayload(strings.NewReader(in), invoice); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := (Money{1234, "EUR"}), invoice.Total; e != a {
+		t.Fatalf("Was expecting total %v, got %v", e, a)
+	}
+	if e, a := (Money{100, "EUR"}), *invoice.Discount; e != a {
+		t.Fatalf("Was expecting discount %v, got %v", e, a)
+	}
+
+	in = `{"data":{"type":"invoices","id":"1","attributes":{"total":1234}}}`
+	if err := UnmarshalPayload(strings.NewReader(in), new(Invoice)); err != ErrInvalidType {
+		t.Fatalf("Was expecting the AttrScanner error %v, got %v", ErrInvalidType, err)
+	}
+}
+
+func TestUnmarshalMetaDocument(t *testing.T) {
+	meta, err := UnmarshalMetaDocument(strings.NewReader(`{"meta":{"uptime":42}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := float64(42), (*meta)["uptime"]; e != a {
+		t.Fatalf("Was expecting meta.uptime %v, got %v", e, a)
+	}
+
+	if _, err := UnmarshalMetaDocument(strings.NewReader(`{"data":null}`)); err != ErrMissingMeta {
+		t.Fatalf("Was expecting %v, got %v", ErrMissingMeta, err)
+	}
+}
+
+func TestUnmarshalLocalID(t *testing.T) {
+	in := strings.NewReader(`{"data":{"type":"tasks","lid":"a","attributes":{"title":"New"}}}`)
+
+	task := new(Task)
+	if err := UnmarshalPayload(in, task); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "a", task.LID; e != a {
+		t.Fatalf("Was expecting lid %q, got %q", e, a)
+	}
+	if task.ID != "" {
+		t.Fatalf("Was not expecting an id, got %q", task.ID)
+	}
+
+	type localID string
+	type thing struct {
+		ID  string  `jsonapi:"primary,things"`
+		LID localID `jsonapi:"lid"`
+	}
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, &thing{LID: "tmp-1"}); err != nil {
+		t.Fatal(err)
+	}
+	th := new(thing)
+	if err := UnmarshalPayload(out, th); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := localID("tmp-1"), th.LID; e != a {
+		t.Fatalf("Was expecting lid %q, got %q", e, a)
+	}
+}
+
+func TestUnmarshalLocalID_relationships(t *testing.T) {
+	in := strings.NewReader(`{
+		"data": {
+			"type": "tasks",
+			"lid": "b",
+			"attributes": {"title": "Child"},
+			"relationships": {
+				"parent": {"data": {"type": "tasks", "lid": "a"}},
+				"subtasks": {"data": [{"type": "tasks", "id": "7"}, {"type": "tasks", "lid": "c"}]}
+			}
+		},
+		"included": [
+			{"type": "tasks", "lid": "a", "attributes": {"title": "Parent"}},
+			{"type": "tasks", "id": "7", "attributes": {"title": "Persisted"}},
+			{"type": "tasks", "lid": "c", "attributes": {"title": "Grandchild"}}
+		]
+	}`)
+
+	task := new(Task)
+	if err := UnmarshalPayload(in, task); err != nil {
+		t.Fatal(err)
+	}
+	if task.Parent == nil || task.Parent.LID != "a" || task.Parent.Title != "Parent" {
+		t.Fatalf("Was expecting the parent to resolve by lid, got %+v", task.Parent)
+	}
+	if len(task.Subtasks) != 2 {
+		t.Fatalf("Was expecting 2 subtasks, got %d", len(task.Subtasks))
+	}
+	if e, a := "Persisted", task.Subtasks[0].Title; e != a {
+		t.Fatalf("Was expecting subtask title %q, got %q", e, a)
+	}
+	if e, a := "Grandchild", task.Subtasks[1].Title; e != a {
+		t.Fatalf("Was expecting subtask title %q, got %q", e, a)
+	}
+}
+
+func TestUnmarshalRequiredAttributes(t *testing.T) {
+	in := strings.NewReader(`{"data":{"type":"signups","attributes":{"name":null,"note":"hi"}}}`)
+
+	err := UnmarshalPayload(in, new(Signup))
+	missing, ok := err.(*ErrMissingAttributes)
+	if !ok {
+		t.Fatalf("Was expecting an *ErrMissingAttributes, got %v", err)
+	}
+	if e, a := []string{"email", "name"}, missing.Attributes; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting missing attributes %v, got %v", e, a)
+	}
+
+	errs := missing.ErrorObjects()
+	if len(errs) != 2 {
+		t.Fatalf("Was expecting 2 error objects, got %d", len(errs))
+	}
+	if e, a := "/data/attributes/email", errs[0].Source.Pointer; e != a {
+		t.Fatalf("Was expecting the source pointer %q, got %q", e, a)
+	}
+	if e, a := "422", errs[1].Status; e != a {
+		t.Fatalf("Was expecting status %q, got %q", e, a)
+	}
+}
+
+func TestUnmarshalRequiredAttributes_relationships(t *testing.T) {
+	linkage := `{"data":{"type":"signups","attributes":{"email":"a@example.com","name":"A"},
+		"relationships":{"referrer":{"data":{"type":"signups","id":"1"}}}}}`
+
+	signup := new(Signup)
+	if err := UnmarshalPayload(strings.NewReader(linkage), signup); err != nil {
+		t.Fatalf("Was not expecting linkage only relationships to be checked, got %v", err)
+	}
+	if e, a := "1", signup.Referrer.ID; e != a {
+		t.Fatalf("Was expecting referrer %q, got %q", e, a)
+	}
+
+	included := linkage[:len(linkage)-1] + `,"included":[{"type":"signups","id":"1","attributes":{"name":"B"}}]}`
+	err := UnmarshalPayload(strings.NewReader(included), new(Signup))
+	missing, ok := err.(*ErrMissingAttributes)
+	if !ok {
+		t.Fatalf("Was expecting an *ErrMissingAttributes for the included referrer, got %v", err)
+	}
+	if e, a := "1", missing.ID; e != a {
+		t.Fatalf("Was expecting the error for signup %q, got %q", e, a)
+	}
+	if e, a := "/included/0/attributes/email", missing.ErrorObjects()[0].Source.Pointer; e != a {
+		t.Fatalf("Was expecting the source pointer %q, got %q", e, a)
+	}
+}
+
+func TestUnmarshalRequiredAttributes_location(t *testing.T) {
+	in := strings.NewReader(`{"data":[
+		{"type":"signups","id":"1","attributes":{"email":"a@example.com","name":"A"}},
+		{"type":"signups","id":"2","attributes":{"email":"b@example.com"}}]}`)
+
+	_, err := UnmarshalManyPayload[*Signup](in)
+	missing, ok := err.(*ErrMissingAttributes)
+	if !ok {
+		t.Fatalf("Was expecting an *ErrMissingAttributes, got %v", err)
+	}
+	if e, a := "/data/1/attributes/name", missing.ErrorObjects()[0].Source.Pointer; e != a {
+		t.Fatalf("Was expecting the source pointer %q, got %q", e, a)
+	}
+
+	// without a known location, the error objects have no source
+	missing = &ErrMissingAttributes{Type: "signups", Attributes: []string{"name"}}
+	if source := missing.ErrorObjects()[0].Source; source != nil {
+		t.Fatalf("Was not expecting a source, got %v", source)
+	}
+}
+
+func TestUnmarshalLinks(t *testing.T) {
+	in := strings.NewReader(`{
+		"data": {
+			"type": "articles",
+			"id": "1",
+			"links": {"self": "https://example.com/articles/1"},
+			"relationships": {
+				"comments": {
+					"links": {"related": {"href": "https://example.com/articles/1/comments", "meta": {"count": 2}}},
+					"data": [{"type": "comments", "id": "1"}]
+				}
+			}
+		}
+	}`)
+
+	article := new(Article)
+	if err := UnmarshalPayload(in, article); err != nil {
+		t.Fatal(err)
+	}
+
+	if href, _ := article.Links.Href("self"); href != "https://example.com/articles/1" {
+		t.Fatalf("Was expecting the self link, got %q", href)
+	}
+	related, ok := (*article.CommentLinks)["related"].(Link)
+	if !ok {
+		t.Fatalf("Was expecting the related link object as a Link, got %T", (*article.CommentLinks)["related"])
+	}
+	if e, a := "https://example.com/articles/1/comments", related.Href; e != a {
+		t.Fatalf("Was expecting href %q, got %q", e, a)
+	}
+	if e, a := float64(2), related.Meta["count"]; e != a {
+		t.Fatalf("Was expecting meta count %v, got %v", e, a)
+	}
+}
+
+func TestUnmarshalLinks_roundTrip(t *testing.T) {
+	article := &Article{
+		ID:           "1",
+		Comments:     []*Comment{{ID: 1}},
+		Links:        &Links{"self": "https://example.com/articles/1"},
+		CommentLinks: &Links{"related": Link{Href: "https://example.com/articles/1/comments"}},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, article); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := new(Article)
+	if err := UnmarshalPayload(out, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(article.Links, decoded.Links) {
+		t.Fatalf("Was expecting links %v, got %v", *article.Links, *decoded.Links)
+	}
+	if !reflect.DeepEqual(article.CommentLinks, decoded.CommentLinks) {
+		t.Fatalf("Was expecting comment links %v, got %v", *article.CommentLinks, *decoded.CommentLinks)
+	}
+}
+
+func TestUnmarshalMany(t *testing.T) {
+	in := `{"data":[{"type":"posts","id":"1","attributes":{"title":"First"}},{"type":"posts","id":"2","attributes":{"title":"Second"}}]}`
+
+	posts, err := UnmarshalMany[Post](strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 2 {
+		t.Fatalf("Was expecting 2 posts, got %d", len(posts))
+	}
+	if e, a := "Second", posts[1].Title; e != a {
+		t.Fatalf("Was expecting title %q, got %q", e, a)
+	}
+
+	in = `{"data":[{"type":"posts","id":"1"},{"type":"comments","id":"2"}]}`
+	_, err = UnmarshalMany[Post](strings.NewReader(in))
+	if _, ok := err.(*ErrInvalidJSONAPIType); !ok {
+		t.Fatalf("Was expecting an *ErrInvalidJSONAPIType for comments, got %v", err)
+	}
+}
+
+func TestUnmarshalUnixTimes(t *testing.T) {
+	in := `{"data":{"type":"readings","id":"1","attributes":{"taken_at":1700000000,"synced_at":1700000000123,"archive_at":1.700000000456e12}}}`
+
+	reading := new(Reading)
+	if err := UnmarshalPayload(strings.NewReader(in), reading); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := time.Unix(1700000000, 0), reading.TakenAt; !e.Equal(a) {
+		t.Fatalf("Was expecting taken_at %v, got %v", e, a)
+	}
+	if e, a := time.UnixMilli(1700000000123), *reading.SyncedAt; !e.Equal(a) {
+		t.Fatalf("Was expecting synced_at %v, got %v", e, a)
+	}
+	if e, a := time.UnixMilli(1700000000456), reading.ArchiveAt; !e.Equal(a) {
+		t.Fatalf("Was expecting archive_at %v, got %v", e, a)
+	}
+}
+
+func TestUnmarshalUnixTimes_fractions(t *testing.T) {
+	in := `{"data":{"type":"readings","id":"1","attributes":{"taken_at":1700000000.25,"archive_at":1700000000456.5}}}`
+
+	reading := new(Reading)
+	if err := UnmarshalPayload(strings.NewReader(in), reading); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := time.Unix(1700000000, 250*int64(time.Millisecond)), reading.TakenAt; !e.Equal(a) {
+		t.Fatalf("Was expecting taken_at %v, got %v", e, a)
+	}
+	if e, a := time.UnixMilli(1700000000456).Add(500*time.Microsecond), reading.ArchiveAt; !e.Equal(a) {
+		t.Fatalf("Was expecting archive_at %v, got %v", e, a)
+	}
+
+	in = `{"data":{"type":"readings","id":"1","attributes":{"taken_at":1e30}}}`
+	if err := UnmarshalPayload(strings.NewReader(in), new(Reading)); err != ErrInvalidTime {
+		t.Fatalf("Was expecting ErrInvalidTime for an out of range epoch, got %v", err)
+	}
+}
+
+func TestUnmarshalComplex(t *testing.T) {
+	in := `{"data":{"type":"signals","id":"1","attributes":{"impedance":{"real":50,"imag":-12.5},"gain":{"real":0.5,"imag":0}}}}`
+
+	signal := new(Signal)
+	if err := UnmarshalPayload(strings.NewReader(in), signal); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := complex(50, -12.5), signal.Impedance; e != a {
+		t.Fatalf("Was expecting impedance %v, got %v", e, a)
+	}
+	if e, a := complex64(complex(0.5, 0)), *signal.Gain; e != a {
+		t.Fatalf("Was expecting gain %v, got %v", e, a)
+	}
+
+	for _, malformed := range []string{`"50+12i"`, `{"real":50}`, `{"real":50,"imag":"1"}`, `{"real":1,"imag":2,"abs":3}`} {
+		in := `{"data":{"type":"signals","id":"1","attributes":{"impedance":` + malformed + `}}}`
+		err := UnmarshalPayload(strings.NewReader(in), new(Signal))
+		if e, ok := err.(*ErrInvalidComplex); !ok || e.Attribute != "impedance" {
+			t.Fatalf("Was expecting an *ErrInvalidComplex for %s, got %v", malformed, err)
+		}
+	}
+}
+
+func TestUnmarshalScalarAsSlice(t *testing.T) {
+	for in, e := range map[string][]string{
+		`"a"`:       {"a"},
+		`["a","b"]`: {"a", "b"},
+	} {
+		listing := new(Listing)
+		payload := `{"data":{"type":"listings","id":"1","attributes":{"tags":` + in + `}}}`
+		if err := UnmarshalPayload(strings.NewReader(payload), listing); err != nil {
+			t.Fatal(err)
+		}
+		if a := listing.Tags; !reflect.DeepEqual(e, a) {
+			t.Fatalf("Was expecting tags %v for %s, got %v", e, in, a)
+		}
+	}
+
+	in := `{"data":{"type":"listings","id":"1","attributes":{"tags":1}}}`
+	err := UnmarshalPayload(strings.NewReader(in), new(Listing))
+	var element *ErrInvalidSliceElement
+	if !errors.As(err, &element) || element.Index != 0 {
+		t.Fatalf("Was expecting an *ErrInvalidSliceElement, got %v", err)
+	}
+
+	in = `{"data":{"type":"listings","id":"1","attributes":{"labels":"a"}}}`
+	if err := UnmarshalPayload(strings.NewReader(in), new(Listing)); err != ErrInvalidType {
+		t.Fatalf("Was expecting ErrInvalidType without the scalar option, got %v", err)
+	}
+}
+
+func TestUnmarshalAttrExtra(t *testing.T) {
+	in := `{"data":{"type":"clippings","id":"1","attributes":{"title":"Hello","locale":"en","word_count":2,"tags":["a"]}}}`
+
+	clipping := new(Clipping)
+	if err := UnmarshalPayload(strings.NewReader(in), clipping); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "Hello", clipping.Title; e != a {
+		t.Fatalf("Was expecting title %q, got %q", e, a)
+	}
+	expected := map[string]interface{}{"locale": "en", "word_count": float64(2), "tags": []interface{}{"a"}}
+	if !reflect.DeepEqual(expected, clipping.Extra) {
+		t.Fatalf("Was expecting extra attributes %v, got %v", expected, clipping.Extra)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, clipping); err != nil {
+		t.Fatal(err)
+	}
+	var payload OnePayload
+	if err := json.Unmarshal(out.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+	expected["title"] = "Hello"
+	if !reflect.DeepEqual(expected, payload.Data.Attributes) {
+		t.Fatalf("Was expecting the attributes to round-trip as %v, got %v", expected, payload.Data.Attributes)
+	}
+
+	// the extra attributes keep the names they were read under
+	renamed, err := MarshalWithOptions(clipping, MarshalOptions{
+		KeyNamer:  strings.ToUpper,
+		AttrNames: map[string]map[string]string{"clippings": {"locale": "LANG"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := renamed.(*OnePayload).Data.Attributes
+	if _, ok := attrs["TITLE"]; !ok {
+		t.Fatalf("Was expecting the renamed title, got %v", attrs)
+	}
+	if _, ok := attrs["word_count"]; !ok {
+		t.Fatalf("Was expecting the extra word_count as is, got %v", attrs)
+	}
+	if _, ok := attrs["locale"]; !ok {
+		t.Fatalf("Was expecting the extra locale as is, got %v", attrs)
+	}
+
+	clipping = new(Clipping)
+	err = UnmarshalPayloadWithOptions(strings.NewReader(in), clipping, UnmarshalOptions{
+		AllowedFields: map[string][]string{"clippings": {"title", "locale"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := map[string]interface{}{"locale": "en"}, clipping.Extra; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting only the allowed extra attributes %v, got %v", e, a)
+	}
+}
+
+func TestUnmarshalPayloadDiff(t *testing.T) {
+	createdAt := time.Unix(1700000000, 0).UTC()
+	blog := &Blog{ID: 5, Title: "Title", ViewCount: 10, CreatedAt: createdAt}
+
+	in := `{"data":{"type":"blogs","id":"5","attributes":{"title":"Title","view_count":11,"created_at":1700000000}}}`
+	changed, err := UnmarshalPayloadDiff(strings.NewReader(in), blog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"view_count"}, changed; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting changed fields %v, got %v", e, a)
+	}
+	if e, a := 11, blog.ViewCount; e != a {
+		t.Fatalf("Was expecting view_count %d, got %d", e, a)
+	}
+
+	changed, err = UnmarshalPayloadDiff(strings.NewReader(`{"data":{"type":"blogs","id":"5"}}`), blog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Fatalf("Was expecting no changed fields, got %v", changed)
+	}
+}
+
+func TestUnmarshalIdentifierRelations(t *testing.T) {
+	in := `{"data":{"type":"shipments","id":"1","relationships":{
+		"customer":{"data":{"type":"customers","id":"c-9"}},
+		"carrier":{"data":{"type":"carriers","id":"dhl"}},
+		"parcels":{"data":[{"type":"parcels","id":"p-1"}]}
+	}}}`
+
+	shipment := new(Shipment)
+	if err := UnmarshalPayload(strings.NewReader(in), shipment); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := (Identifier{Type: "customers", ID: "c-9"}), shipment.Customer; e != a {
+		t.Fatalf("Was expecting customer %v, got %v", e, a)
+	}
+	if e, a := (Identifier{Type: "carriers", ID: "dhl"}), *shipment.Carrier; e != a {
+		t.Fatalf("Was expecting carrier %v, got %v", e, a)
+	}
+	if e, a := []Identifier{{Type: "parcels", ID: "p-1"}}, shipment.Parcels; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting parcels %v, got %v", e, a)
+	}
+
+	in = `{"data":{"type":"shipments","id":"1","relationships":{"parcels":{"data":[{"type":"parcels"}]}}}}`
+	if _, ok := UnmarshalPayload(strings.NewReader(in), new(Shipment)).(*ErrInvalidLinkage); !ok {
+		t.Fatal("Was expecting an *ErrInvalidLinkage for a parcel without id")
+	}
+
+	if err := ApplyRelationship(strings.NewReader(`{"data":{"type":"carriers","id":"ups"}}`), shipment, "carrier"); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "ups", shipment.Carrier.ID; e != a {
+		t.Fatalf("Was expecting carrier %q, got %q", e, a)
+	}
+}
+
+func TestUnmarshalPayload_dataWithErrors(t *testing.T) {
+	doc := `{"data":{"type":"posts","id":"1","attributes":{"title":"Partial"}},"errors":[{"title":"Upstream failure"}]}`
+
+	if err := UnmarshalPayload(strings.NewReader(doc), new(Post)); err != ErrDataWithErrors {
+		t.Fatalf("Was expecting ErrDataWithErrors, got %v", err)
+	}
+
+	post := new(Post)
+	if err := UnmarshalPayloadWithOptions(strings.NewReader(doc), post, UnmarshalOptions{
+		AllowDataWithErrors: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "Partial", post.Title; e != a {
+		t.Fatalf("Was expecting title %q, got %q", e, a)
+	}
+
+	many := `{"data":[{"type":"posts","id":"1"}],"errors":[{"title":"Upstream failure"}]}`
+	if _, err := UnmarshalManyPayload[*Post](strings.NewReader(many)); err != ErrDataWithErrors {
+		t.Fatalf("Was expecting ErrDataWithErrors, got %v", err)
+	}
+
+	// an errors document on its own is not affected
+	if _, err := UnmarshalManyPayload[*Post](strings.NewReader(`{"errors":[{"title":"Not found"}]}`)); err != nil {
+		t.Fatalf("Was not expecting an error, got %v", err)
+	}
+}
+
+func TestApplyRelationship(t *testing.T) {
+	post := &Post{ID: 1, Comments: []*Comment{{ID: 1}}, LatestComment: &Comment{ID: 1}}
+
+	in := strings.NewReader(`{"data":[{"type":"comments","id":"2"},{"type":"comments","id":"3"}]}`)
+	if err := ApplyRelationship(in, post, "comments"); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, len(post.Comments); e != a {
+		t.Fatalf("Was expecting %d comments, got %d", e, a)
+	}
+	if e, a := 3, post.Comments[1].ID; e != a {
+		t.Fatalf("Was expecting comment id %d, got %d", e, a)
+	}
+
+	if err := ApplyRelationship(strings.NewReader(`{"data":[]}`), post, "comments"); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 0, len(post.Comments); e != a {
+		t.Fatalf("Was expecting %d comments, got %d", e, a)
+	}
+
+	if err := ApplyRelationship(strings.NewReader(`{"data":{"type":"comments","id":"4"}}`), post, "latest_comment"); err != nil {
+		t.Fatal(err)
+	}
+	if post.LatestComment == nil || post.LatestComment.ID != 4 {
+		t.Fatalf("Was expecting latest comment 4, got %v", post.LatestComment)
+	}
+
+	if err := ApplyRelationship(strings.NewReader(`{"data":null}`), post, "latest_comment"); err != nil {
+		t.Fatal(err)
+	}
+	if post.LatestComment != nil {
+		t.Fatalf("Was expecting the latest comment to be cleared, got %v", post.LatestComment)
+	}
+}
+
+func TestApplyRelationship_errors(t *testing.T) {
+	post := new(Post)
+
+	if err := ApplyRelationship(strings.NewReader(`{"data":[]}`), post, "authors"); err != ErrUnknownRelation {
+		t.Fatalf("Was expecting ErrUnknownRelation, got %v", err)
+	}
+	if err := ApplyRelationship(strings.NewReader(`{}`), post, "comments"); err != ErrMissingData {
+		t.Fatalf("Was expecting ErrMissingData, got %v", err)
+	}
+
+	var invalidType *ErrInvalidJSONAPIType
+	in := strings.NewReader(`{"data":{"type":"posts","id":"4"}}`)
+	if err := ApplyRelationship(in, post, "latest_comment"); !errors.As(err, &invalidType) {
+		t.Fatalf("Was expecting an ErrInvalidJSONAPIType, got %v", err)
+	}
+
+	var invalidLinkage *ErrInvalidLinkage
+	in = strings.NewReader(`{"data":[{"type":"comments","id":"2"},null]}`)
+	if err := ApplyRelationship(in, post, "comments"); !errors.As(err, &invalidLinkage) {
+		t.Fatalf("Was expecting an ErrInvalidLinkage, got %v", err)
+	}
+
+	if err := ApplyRelationship(strings.NewReader(`{"data":[]}`), (*Post)(nil), "comments"); err != ErrInvalidType {
+		t.Fatalf("Was expecting ErrInvalidType, got %v", err)
+	}
+}
+
+func TestApplyRelationship_map(t *testing.T) {
+	post := new(IndexedPost)
+
+	in := strings.NewReader(`{"data":[{"type":"comments","id":"2"},{"type":"comments","id":"3"}]}`)
+	if err := ApplyRelationship(in, post, "comments"); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, len(post.Comments); e != a {
+		t.Fatalf("Was expecting %d comments, got %d", e, a)
+	}
+	if c := post.Comments["3"]; c == nil || c.ID != 3 {
+		t.Fatalf("Was expecting comment 3 under its id, got %v", c)
+	}
+}
+
+func TestApplyRelationship_sliceRef(t *testing.T) {
+	thread := new(Thread)
+
+	in := strings.NewReader(`{"data":[{"type":"comments","id":"2"}]}`)
+	if err := ApplyRelationship(in, thread, "comments"); err != nil {
+		t.Fatal(err)
+	}
+	if thread.Comments == nil || len(*thread.Comments) != 1 || (*thread.Comments)[0].ID != 2 {
+		t.Fatalf("Was expecting comment 2, got %v", thread.Comments)
+	}
+
+	if err := ApplyRelationship(strings.NewReader(`{"data":[]}`), thread, "comments"); err != nil {
+		t.Fatal(err)
+	}
+	if thread.Comments == nil || len(*thread.Comments) != 0 {
+		t.Fatalf("Was expecting an empty to-many, got %v", thread.Comments)
+	}
+
+	if err := ApplyRelationship(strings.NewReader(`{"data":null}`), thread, "comments"); err != nil {
+		t.Fatal(err)
+	}
+	if thread.Comments != nil {
+		t.Fatalf("Was expecting the comments to be cleared, got %v", thread.Comments)
+	}
+}
+
+func TestUnmarshalPayloadWithAllowedFields(t *testing.T) {
+	doc := `{"data":{"type":"posts","id":"1",
+		"attributes":{"title":"Title","body":"Body","blog_id":5},
+		"relationships":{"latest_comment":{"data":{"type":"comments","id":"2"}}}}}`
+	allowed := map[string][]string{"posts": {"title", "body"}}
+
+	post := new(Post)
+	if err := UnmarshalPayloadWithAllowedFields(strings.NewReader(doc), post, allowed); err != nil {
+		t.Fatal(err)
+	}
+	if post.Title != "Title" || post.Body != "Body" {
+		t.Fatalf("Was expecting the allowed attributes, got %q and %q", post.Title, post.Body)
+	}
+	if post.BlogID != 0 {
+		t.Fatalf("Was expecting blog_id to be ignored, got %d", post.BlogID)
+	}
+	if post.LatestComment != nil {
+		t.Fatalf("Was expecting latest_comment to be ignored, got %v", post.LatestComment)
+	}
+
+	err := UnmarshalPayloadWithOptions(strings.NewReader(doc), new(Post), UnmarshalOptions{
+		AllowedFields:          allowed,
+		RejectDisallowedFields: true,
+	})
+	var notAllowed *ErrFieldNotAllowed
+	if !errors.As(err, &notAllowed) {
+		t.Fatalf("Was expecting an ErrFieldNotAllowed, got %v", err)
+	}
+	if e, a := "blog_id", notAllowed.Field; e != a {
+		t.Fatalf("Was expecting field %q, got %q", e, a)
+	}
+}
+
+func TestUnmarshalFloat32Range(t *testing.T) {
+	for _, tc := range []struct {
+		reading interface{}
+		err     error
+	}{
+		{reading: math.MaxFloat32},
+		{reading: -math.MaxFloat32},
+		{reading: math.SmallestNonzeroFloat32},
+		{reading: 0.0},
+		{reading: 1.5},
+		{reading: math.MaxFloat32 * 2, err: ErrFloat32OutOfRange},
+		{reading: -math.MaxFloat32 * 2, err: ErrFloat32OutOfRange},
+		{reading: math.SmallestNonzeroFloat32 / 4, err: ErrFloat32OutOfRange},
+	} {
+		in := samplePayloadWithSensor(map[string]interface{}{"reading": tc.reading})
+
+		sensor := new(Sensor)
+		err := UnmarshalPayload(in, sensor)
+		if err != tc.err {
+			t.Fatalf("For %v, was expecting error %v, got %v", tc.reading, tc.err, err)
+		}
+		if err == nil && float64(sensor.Reading) != float64(float32(tc.reading.(float64))) {
+			t.Fatalf("For %v, got reading %v", tc.reading, sensor.Reading)
+		}
+	}
+}
+
+func TestUnmarshalFloat32Clamp(t *testing.T) {
+	for reading, expected := range map[float64]float32{
+		math.MaxFloat32 * 2:             math.MaxFloat32,
+		-math.MaxFloat32 * 2:            -math.MaxFloat32,
+		math.SmallestNonzeroFloat32 / 4: 0,
+		2.5:                             2.5,
+	} {
+		sensor := new(Sensor)
+		if err := UnmarshalPayload(samplePayloadWithSensor(map[string]interface{}{"peak": reading}), sensor); err != nil {
+			t.Fatal(err)
+		}
+		if e, a := expected, *sensor.Peak; e != a {
+			t.Fatalf("For %v, was expecting peak %v, got %v", reading, e, a)
+		}
+	}
+}
+
+func samplePayloadWithSensor(attributes map[string]interface{}) io.Reader {
+	out := bytes.NewBuffer(nil)
+	json.NewEncoder(out).Encode(map[string]interface{}{
+		"data": map[string]interface{}{
+			"type":       "sensors",
+			"id":         "1",
+			"attributes": attributes,
+		},
+	})
+	return out
+}
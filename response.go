@@ -1,11 +1,15 @@
 package jsonapi
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -26,6 +30,18 @@ var (
 	// ErrUnexpectedType is returned when marshalling an interface; the interface
 	// had to be a pointer or a slice; otherwise this error is returned.
 	ErrUnexpectedType = errors.New("models should be a struct pointer or slice of struct pointers")
+	// ErrInvalidRelationMap is returned when a "relation-map" field is not a
+	// map keyed by string whose values are nodes or struct pointers.
+	ErrInvalidRelationMap = errors.New("relation-map should be a map[string] of nodes, struct pointers or slices thereof")
+	// ErrConflictingMergedID is returned by MarshalMerged when a part has a
+	// primary field whose id differs from the id of the merged resource.
+	ErrConflictingMergedID = errors.New("merged parts have conflicting primary ids")
+	// ErrConflictingMergedType is returned by MarshalMerged when a part has a
+	// primary field whose type differs from the type of the merged resource.
+	ErrConflictingMergedType = errors.New("merged parts have conflicting primary types")
+	// ErrMaxNodesExceeded is returned when a payload would hold more primary
+	// and included resources than MarshalOptions.MaxNodes allows.
+	ErrMaxNodesExceeded = errors.New("payload exceeds the maximum number of resources")
 )
 
 type MarshalOptions struct {
@@ -69,9 +85,493 @@ type MarshalOptions struct {
 	// Links specifies the links object that will be included in the payload.
 	// (This will override any links specified in the Linkable interface.)
 	Links *Links
+	// JSONAPI sets the top-level "jsonapi" member of the payload, e.g.
+	// &JSONAPIObject{Version: "1.1"} for clients requiring the version to
+	// be declared. By default the member is left out.
+	JSONAPI *JSONAPIObject
+	// Extensions lists extension URIs to advertise in the "ext" member of
+	// the top-level "jsonapi" object, added to those of JSONAPI if set.
+	Extensions []string
 	// Meta specifies the meta object that will be included in the payload.
 	// (This will override any meta specified in the Metable interface.)
 	Meta *Meta
+	// NodeMeta sets the meta of the resources, primary or included, with the
+	// given type and id, e.g. per-resource permissions computed apart from
+	// the models. It is merged into the meta from the models' Metable and
+	// meta fields, taking precedence over them. As for Identifier linkage,
+	// an empty ID matches every resource of the type, and the meta of a
+	// specific id takes precedence over it.
+	NodeMeta map[Identifier]*Meta
+	// AutoTotalCount sets "total-count" in the top-level meta of a payload
+	// with many resources to the number of resources, unless the meta (from
+	// Meta or the models' Metable) already has a total count. This suits
+	// unpaginated endpoints, where the slice holds all resources.
+	AutoTotalCount bool
+	// OrderIncludedByTraversal orders the "included" array by the order in
+	// which resources are reached walking the relationships of the primary
+	// data, following the order the relationship fields are declared, instead
+	// of by type and id.
+	OrderIncludedByTraversal bool
+	// IncludedVia sets "included-via" in the meta of every included resource
+	// to the relationship path it is reached through from the primary data,
+	// e.g. "posts.comments". This is meant for debugging compound documents.
+	IncludedVia bool
+	// OrderedRelationships writes the members of the "relationships" object
+	// of every resource in the order their fields are declared on the model,
+	// instead of alphabetically, e.g. for golden files or clients rendering
+	// relationships in a meaningful order. The members of a relation-map
+	// field are written alphabetically at its position.
+	OrderedRelationships bool
+	// EmptyStringAsNull writes empty string attributes, of string and
+	// *string fields (including named string types), as null instead of "",
+	// for clients that tell "" apart from a missing value. Fields with
+	// omitempty are still dropped when empty.
+	EmptyStringAsNull bool
+	// DropNulls removes every attribute whose value would be written as JSON
+	// null (e.g. a nil *string without omitempty) from the primary and
+	// included resources.
+	DropNulls bool
+	// AutoSelfLinks, when set to a base URL, sets the "self" link of every
+	// primary and included resource without links to
+	// AutoSelfLinks + "/" + type + "/" + id. Models implementing Linkable keep
+	// their own links.
+	AutoSelfLinks string
+	// RESTLinks, when set to a base URL, sets the links of every relationship
+	// of the primary and included resources without links to
+	//
+	//	"self":    RESTLinks + "/" + type + "/" + id + "/relationships/" + name
+	//	"related": RESTLinks + "/" + type + "/" + id + "/" + name
+	//
+	// Relationships with links from RelationshipLinkable keep their own.
+	RESTLinks string
+	// IncludeDepths limits how deep resources are included per relationship
+	// path. It maps a relationship path to the number of levels that may be
+	// included from it: {"comments": 1} includes the comments, but nothing
+	// related to them (e.g. "comments.author", even if requested), and
+	// {"comments": 0} doesn't include comments at all. Paths not in the map
+	// are not limited.
+	IncludeDepths map[string]int
+	// KeepIncluded, when set, is called for every resource gathered into the
+	// "included" array. Returning false excludes the resource, e.g. one that
+	// is soft-deleted or the user can't access, as well as the resources that
+	// are only reachable through it.
+	KeepIncluded func(n *Node) bool
+	// AttrNames renames attributes in the output. It maps resource types to
+	// a map from the name in the attr tag to the name to write, e.g. to expose
+	// the same model with different attribute names in different API versions.
+	AttrNames map[string]map[string]string
+	// KeyNamer, when set, transforms the names of all attributes and
+	// relationships in the output, e.g. SnakeizeKeys to write "created_at"
+	// for an attr tag named "created-at". Attributes renamed by AttrNames
+	// are written with the name given there instead.
+	KeyNamer KeyNamer
+	// Fields restricts the attributes and relationships written per resource
+	// type, like the "fields[TYPE]" query parameters of sparse fieldsets. It
+	// maps a resource type to the names of the fields to keep, as written
+	// (after AttrNames). Types not in the map are written in full, and an
+	// empty list leaves only the type and id. It applies to the primary and
+	// the included resources alike.
+	Fields map[string][]string
+	// OmitLinkage maps resource types to relationships that are left out of
+	// the "relationships" of the resources of that type, while the related
+	// resources are still included. This is for consumers that find related
+	// resources by scanning the "included" array instead of following the
+	// linkage.
+	OmitLinkage map[string][]string
+	// MaxNodes, when positive, caps the number of primary and included
+	// resources of the payload. Marshaling fails with ErrMaxNodesExceeded as
+	// soon as the limit is passed, before anything is encoded. When the
+	// included resources are filtered (IncludeRelationPaths, KeepIncluded,
+	// IncludeDepths), only the resources left after filtering count.
+	MaxNodes int
+	// EmitEmptyRelationships writes "relationships": {} for resources whose
+	// model has relation fields that were all omitted (e.g. nil with
+	// omitempty). By default the member is left out.
+	EmitEmptyRelationships bool
+	// AlwaysEmitIncluded writes "included": [] when no resources are
+	// included, instead of omitting the member.
+	AlwaysEmitIncluded bool
+	// ZeroTimes controls how zero time.Time attributes (not pointers) are
+	// written, whatever their format: untagged, iso8601, rfc3339, layout,
+	// unix or unixmilli. By default they are omitted.
+	ZeroTimes ZeroTimePolicy
+	// Validators are run in order against the built payload, after all the
+	// other options were applied, e.g. to enforce that every resource has a
+	// self link. Marshaling fails with the first error returned.
+	Validators []func(Payloader) error
+	// ComputedConflicts controls what happens when a ComputedAttributer
+	// returns an attribute that an attr field already wrote. By default the
+	// computed value is written.
+	ComputedConflicts ComputedConflictPolicy
+	// TypeTransforms replaces the value of every attribute of a given Go
+	// type, or of a pointer to it, with the result of its function, e.g. to
+	// redact all fields of a PII type. It applies to attr fields, method
+	// attributes, computed attributes and attr-extra values alike. The
+	// result is written as is, in place of the usual formatting (time,
+	// precision) of the field.
+	TypeTransforms map[reflect.Type]func(interface{}) interface{}
+	// EmitEmptyMeta writes "meta": {} for models whose JSONAPIMeta returns
+	// an empty, non-nil meta. By default an empty meta is omitted.
+	EmitEmptyMeta bool
+	// Cardinality forces the linkage shape of relationships by name, to
+	// present the same model differently across endpoints. A slice forced
+	// to CardinalityOne is written as its only element (or null when empty),
+	// and a pointer forced to CardinalityMany as an array of at most one
+	// resource identifier.
+	Cardinality map[string]Cardinality
+	// CardinalitySelector picks the related model written for a slice with
+	// more than one element forced to CardinalityOne. It is called with the
+	// relationship name and the slice (e.g. []*Comment, sorted by the sort
+	// option if any) and returns one of its elements, or nil for null.
+	// Without it, such slices fail with an *ErrCardinality.
+	CardinalitySelector func(relation string, models interface{}) interface{}
+	// IDField names the Go field written as the "id" of the models passed
+	// in, instead of the field tagged primary, e.g. a new id during a
+	// migration from legacy ids. It applies to every model of that struct
+	// type, primary or related. The field must be a string, an integer or a
+	// fmt.Stringer, or marshaling fails with an *ErrInvalidIDField.
+	IDField string
+	// CompositeIDSeparator joins the parts of composite ids, see the
+	// constant of the same name for the default.
+	CompositeIDSeparator string
+
+	// idFields maps the struct types of the models to the index of their
+	// IDField.
+	idFields map[reflect.Type][]int
+	// ctx is passed to BeforeMarshaler models, see MarshalPayloadContext.
+	ctx context.Context
+}
+
+// Cardinality is the linkage shape of a relationship, see
+// MarshalOptions.Cardinality.
+type Cardinality string
+
+const (
+	// CardinalityOne writes a relationship as a single resource identifier.
+	CardinalityOne Cardinality = "one"
+	// CardinalityMany writes a relationship as an array of resource
+	// identifiers.
+	CardinalityMany Cardinality = "many"
+)
+
+// ErrCardinality is returned when a relationship with more than one related
+// model is forced to CardinalityOne without a CardinalitySelector.
+type ErrCardinality struct {
+	Relation string
+	Len      int
+}
+
+func (e *ErrCardinality) Error() string {
+	return fmt.Sprintf("jsonapi: relationship %q forced to one has %d related models", e.Relation, e.Len)
+}
+
+// ErrInvalidIDField is returned when MarshalOptions.IDField doesn't name a
+// field of the models that can be written as an id.
+type ErrInvalidIDField struct {
+	Field string
+	Type  reflect.Type
+}
+
+func (e *ErrInvalidIDField) Error() string {
+	return fmt.Sprintf("jsonapi: %s has no field %s usable as an id", e.Type, e.Field)
+}
+
+// ZeroTimePolicy is the handling of zero time.Time attributes, see
+// MarshalOptions.ZeroTimes.
+type ZeroTimePolicy int
+
+const (
+	// ZeroTimeOmit leaves zero times out of the attributes.
+	ZeroTimeOmit ZeroTimePolicy = iota
+	// ZeroTimeError fails marshaling with an *ErrZeroTime, catching times
+	// that were never set.
+	ZeroTimeError
+	// ZeroTimeNull writes zero times as null.
+	ZeroTimeNull
+)
+
+// ComputedConflictPolicy is the handling of computed attributes named like an
+// attr field, see MarshalOptions.ComputedConflicts.
+type ComputedConflictPolicy int
+
+const (
+	// ComputedOverride writes the computed value instead of the field's.
+	ComputedOverride ComputedConflictPolicy = iota
+	// ComputedKeepField keeps the value of the attr field, unless the
+	// computed value is an OverrideAttr.
+	ComputedKeepField
+	// ComputedError fails marshaling with an *ErrComputedConflict, unless
+	// the computed value is an OverrideAttr.
+	ComputedError
+)
+
+func (o *MarshalOptions) computedConflicts() ComputedConflictPolicy {
+	if o == nil {
+		return ComputedOverride
+	}
+	return o.ComputedConflicts
+}
+
+// ErrComputedConflict is returned when a computed attribute is named like an
+// attr field with the ComputedError policy.
+type ErrComputedConflict struct {
+	Attribute string
+}
+
+func (e *ErrComputedConflict) Error() string {
+	return fmt.Sprintf("jsonapi: computed attribute %q conflicts with an attr field", e.Attribute)
+}
+
+// ErrAttrMethod is returned when the method named by the method option of an
+// attr tag isn't a method of the model taking no arguments and returning one
+// value.
+type ErrAttrMethod struct {
+	Method string
+	Type   reflect.Type
+}
+
+func (e *ErrAttrMethod) Error() string {
+	return fmt.Sprintf("jsonapi: %s has no method %s returning an attribute value", e.Type, e.Method)
+}
+
+// attrMethod calls the method of model named name for the value of an
+// attribute.
+func attrMethod(model reflect.Value, name string) (reflect.Value, error) {
+	m := model.MethodByName(name)
+	if !m.IsValid() || m.Type().NumIn() != 0 || m.Type().NumOut() != 1 {
+		return reflect.Value{}, &ErrAttrMethod{Method: name, Type: model.Type()}
+	}
+	return m.Call(nil)[0], nil
+}
+
+// typeTransform returns the TypeTransforms function for the type of v, or for
+// the type v points to, along with the value to call it with.
+func (o *MarshalOptions) typeTransform(v reflect.Value) (func(interface{}) interface{}, interface{}, bool) {
+	if o == nil || o.TypeTransforms == nil || !v.IsValid() {
+		return nil, nil, false
+	}
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil, false
+		}
+		v = v.Elem()
+	}
+	if transform, ok := o.TypeTransforms[v.Type()]; ok {
+		return transform, v.Interface(), true
+	}
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		if transform, ok := o.TypeTransforms[v.Type().Elem()]; ok {
+			return transform, v.Elem().Interface(), true
+		}
+	}
+	return nil, nil, false
+}
+
+// transformAttrs returns a copy of attrs with the TypeTransforms applied to
+// its values, for the attributes that don't come from attr fields.
+func (o *MarshalOptions) transformAttrs(attrs map[string]interface{}) map[string]interface{} {
+	if o == nil || o.TypeTransforms == nil || len(attrs) == 0 {
+		return attrs
+	}
+
+	transformed := make(map[string]interface{}, len(attrs))
+	for k, v := range attrs {
+		if override, ok := v.(OverrideAttr); ok {
+			if transform, arg, ok := o.typeTransform(reflect.ValueOf(override.Value)); ok {
+				override.Value = transform(arg)
+			}
+			transformed[k] = override
+			continue
+		}
+		if transform, arg, ok := o.typeTransform(reflect.ValueOf(v)); ok {
+			v = transform(arg)
+		}
+		transformed[k] = v
+	}
+	return transformed
+}
+
+// checkGathered fails early with ErrMaxNodesExceeded when the count of
+// resources gathered so far already passes MaxNodes. With included filters,
+// the check is left to MarshalWithOptions, after filtering.
+func (o *MarshalOptions) checkGathered(count int) error {
+	if o == nil || o.MaxNodes <= 0 || count <= o.MaxNodes {
+		return nil
+	}
+	if o.IncludeRelationPaths != nil || o.KeepIncluded != nil || o.IncludeDepths != nil {
+		return nil
+	}
+	return ErrMaxNodesExceeded
+}
+
+func (o *MarshalOptions) cardinality(relation string) Cardinality {
+	if o == nil {
+		return ""
+	}
+	return o.Cardinality[relation]
+}
+
+// forceCardinality converts the value of the relation field to the shape
+// forced by Cardinality, if any: a slice to a single pointer, or a pointer to
+// a slice holding it.
+func (o *MarshalOptions) forceCardinality(relation string, fieldValue reflect.Value, sortBy string) (reflect.Value, error) {
+	isSlice := fieldValue.Kind() == reflect.Slice
+
+	switch o.cardinality(relation) {
+	case CardinalityOne:
+		if !isSlice {
+			return fieldValue, nil
+		}
+		if sortBy != "" {
+			sorted, err := sortRelated(fieldValue, sortBy)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			fieldValue = sorted
+		}
+
+		elemType := fieldValue.Type().Elem()
+		switch n := fieldValue.Len(); {
+		case n == 0:
+			return reflect.Zero(elemType), nil
+		case n == 1:
+			return fieldValue.Index(0), nil
+		case o.CardinalitySelector == nil:
+			return reflect.Value{}, &ErrCardinality{Relation: relation, Len: n}
+		}
+
+		selected := reflect.ValueOf(o.CardinalitySelector(relation, fieldValue.Interface()))
+		if !selected.IsValid() {
+			return reflect.Zero(elemType), nil
+		}
+		if !selected.Type().AssignableTo(elemType) {
+			return reflect.Value{}, ErrUnexpectedType
+		}
+		v := reflect.New(elemType).Elem()
+		v.Set(selected)
+		return v, nil
+	case CardinalityMany:
+		if isSlice {
+			return fieldValue, nil
+		}
+		sliceType := reflect.SliceOf(fieldValue.Type())
+		if fieldValue.IsNil() {
+			return reflect.Zero(sliceType), nil
+		}
+		return reflect.Append(reflect.MakeSlice(sliceType, 0, 1), fieldValue), nil
+	}
+
+	return fieldValue, nil
+}
+
+// resolveIDField looks up the IDField of the struct types of models, of
+// every element for a slice of interfaces.
+func (o *MarshalOptions) resolveIDField(models interface{}) error {
+	var types []reflect.Type
+	switch v := reflect.ValueOf(models); v.Kind() {
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Interface {
+			types = append(types, v.Type().Elem())
+			break
+		}
+		for i := 0; i < v.Len(); i++ {
+			if e := v.Index(i); !e.IsNil() {
+				types = append(types, e.Elem().Type())
+			}
+		}
+	case reflect.Ptr:
+		types = append(types, v.Type())
+	default:
+		return ErrUnexpectedType
+	}
+
+	o.idFields = make(map[reflect.Type][]int, len(types))
+	for _, t := range types {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return ErrUnexpectedType
+		}
+
+		field, ok := t.FieldByName(o.IDField)
+		if !ok || !isIDType(field.Type) {
+			return &ErrInvalidIDField{Field: o.IDField, Type: t}
+		}
+		o.idFields[t] = field.Index
+	}
+	return nil
+}
+
+// isIDType reports whether values of t can be written as an id by
+// visitModelNode.
+func isIDType(t reflect.Type) bool {
+	stringer := reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	if t.Implements(stringer) || reflect.PtrTo(t).Implements(stringer) {
+		return true
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// the primary branch asserts the unnamed types
+	return t.PkgPath() == "" && (t.Kind() == reflect.String || isNumericKind(t.Kind())) &&
+		t.Kind() != reflect.Float32 && t.Kind() != reflect.Float64
+}
+
+// idFieldOf returns the IDField of the model value, if it is of a struct
+// type of the models passed in.
+func (o *MarshalOptions) idFieldOf(model reflect.Value) (reflect.Value, bool) {
+	if o == nil {
+		return reflect.Value{}, false
+	}
+	index, ok := o.idFields[model.Type()]
+	if !ok {
+		return reflect.Value{}, false
+	}
+	return model.FieldByIndex(index), true
+}
+
+// beforeMarshal calls the BeforeMarshaler hook of model when marshaling with
+// a context.
+func (o *MarshalOptions) beforeMarshal(model interface{}) error {
+	if o == nil || o.ctx == nil {
+		return nil
+	}
+	if err := o.ctx.Err(); err != nil {
+		return err
+	}
+	if m, ok := model.(BeforeMarshaler); ok {
+		return m.JSONAPIBeforeMarshal(o.ctx)
+	}
+	return nil
+}
+
+func (o *MarshalOptions) zeroTimes() ZeroTimePolicy {
+	if o == nil {
+		return ZeroTimeOmit
+	}
+	return o.ZeroTimes
+}
+
+// ErrZeroTime is returned when marshaling a zero time.Time attribute with
+// the ZeroTimeError policy.
+type ErrZeroTime struct {
+	Attribute string
+}
+
+func (e *ErrZeroTime) Error() string {
+	return fmt.Sprintf("jsonapi: attribute %q is a zero time", e.Attribute)
+}
+
+// ErrNonFiniteFloat is returned when marshaling a NaN or infinite float
+// attribute with the precision option, which has no JSON number form.
+type ErrNonFiniteFloat struct {
+	Attribute string
+	Value     float64
+}
+
+func (e *ErrNonFiniteFloat) Error() string {
+	return fmt.Sprintf("jsonapi: attribute %q is %v, which is not a JSON number", e.Attribute, e.Value)
 }
 
 // MarshalPayload writes a jsonapi response for one or many records. The
@@ -113,13 +613,58 @@ func MarshalPayload(w io.Writer, models interface{}) error {
 		return err
 	}
 
-	return json.NewEncoder(w).Encode(payload)
+	return encodePayload(w, payload)
+}
+
+// MarshalPayloadContext does the same as MarshalPayload, calling the
+// JSONAPIBeforeMarshal hook of every primary and related model implementing
+// BeforeMarshaler with ctx before it is marshaled. Marshaling stops with the
+// first error returned by a hook, or with the error of ctx once it is done.
+// A model reachable through several relationships may be prepared more than
+// once, so hooks should be idempotent.
+func MarshalPayloadContext(ctx context.Context, w io.Writer, models interface{}) error {
+	return MarshalPayloadWithOptions(w, models, MarshalOptions{ctx: ctx})
 }
 
 // Marshal does the same as MarshalPayload except it just returns the payload
 // and doesn't write out results. Useful if you use your own JSON rendering
 // library.
 func Marshal(models interface{}) (Payloader, error) {
+	return marshal(models, nil)
+}
+
+// MarshalOne builds the payload MarshalPayload writes for model, a struct
+// pointer, without encoding it. The returned payload can be modified (e.g.
+// its Meta, Links or Included) before encoding it with json.Encoder.
+func MarshalOne(model interface{}) (*OnePayload, error) {
+	if v := reflect.ValueOf(model); v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, ErrUnexpectedType
+	}
+
+	payload, err := marshal(model, nil)
+	if err != nil {
+		return nil, err
+	}
+	return payload.(*OnePayload), nil
+}
+
+// MarshalMany builds the payload MarshalPayload writes for models, a slice of
+// struct pointers, without encoding it. See MarshalOne.
+func MarshalMany(models interface{}) (*ManyPayload, error) {
+	if reflect.ValueOf(models).Kind() != reflect.Slice {
+		return nil, ErrExpectedSlice
+	}
+
+	payload, err := marshal(models, nil)
+	if err != nil {
+		return nil, err
+	}
+	return payload.(*ManyPayload), nil
+}
+
+// marshal builds the payload for models, with the per-resource behaviour
+// adjusted by options, which may be nil.
+func marshal(models interface{}, options *MarshalOptions) (Payloader, error) {
 	switch vals := reflect.ValueOf(models); vals.Kind() {
 	case reflect.Slice:
 		m, err := convertToSliceInterface(&models)
@@ -127,7 +672,7 @@ func Marshal(models interface{}) (Payloader, error) {
 			return nil, err
 		}
 
-		payload, err := marshalMany(m)
+		payload, err := marshalMany(m, options)
 		if err != nil {
 			return nil, err
 		}
@@ -141,7 +686,7 @@ func Marshal(models interface{}) (Payloader, error) {
 		}
 
 		if metableModels, ok := models.(Metable); ok {
-			payload.Meta = metableModels.JSONAPIMeta()
+			payload.Meta = omitEmptyMeta(metableModels.JSONAPIMeta(), options)
 		}
 
 		return payload, nil
@@ -150,7 +695,7 @@ func Marshal(models interface{}) (Payloader, error) {
 		if reflect.Indirect(vals).Kind() != reflect.Struct {
 			return nil, ErrUnexpectedType
 		}
-		return marshalOne(models)
+		return marshalOne(models, options)
 	default:
 		return nil, ErrUnexpectedType
 	}
@@ -193,17 +738,25 @@ func MarshalPayloadWithOptions(w io.Writer, model interface{}, options MarshalOp
 		return err
 	}
 
-	return json.NewEncoder(w).Encode(payload)
+	return encodePayload(w, payload)
 }
 
 // MarshalWithOptions does the same as MarshalPayloadWithOptions except it just returns the payload
 // and doesn't write out results. Useful if you use your own JSON rendering
 // library.
 func MarshalWithOptions(model interface{}, options MarshalOptions) (Payloader, error) {
-	payload, err := Marshal(model)
+	if options.IDField != "" {
+		if err := options.resolveIDField(model); err != nil {
+			return nil, err
+		}
+	}
+	payload, err := marshal(model, &options)
 	if err != nil {
 		return nil, err
 	}
+	if options.KeepIncluded != nil {
+		keepIncluded(payload, options.KeepIncluded)
+	}
 	if options.IncludeRelationPaths != nil {
 		if len(options.IncludeRelationPaths) == 0 {
 			payload.clearIncluded()
@@ -211,15 +764,345 @@ func MarshalWithOptions(model interface{}, options MarshalOptions) (Payloader, e
 			payload.filterIncluded(options.IncludeRelationPaths)
 		}
 	}
+	if options.IncludeDepths != nil {
+		payload.setIncluded(limitIncludeDepth(payload.primaryNodes(), payload.includedNodes(), options.IncludeDepths))
+	}
+	if options.MaxNodes > 0 && len(payload.primaryNodes())+len(payload.includedNodes()) > options.MaxNodes {
+		return nil, ErrMaxNodesExceeded
+	}
 	if options.Links != nil {
 		payload.setLinks(options.Links)
 	}
 	if options.Meta != nil {
 		payload.setMeta(options.Meta)
 	}
+	if options.JSONAPI != nil || len(options.Extensions) > 0 {
+		payload.setJSONAPI(withExtensions(options.JSONAPI, options.Extensions))
+	}
+	if many, ok := payload.(*ManyPayload); ok && options.AutoTotalCount {
+		setTotalCount(many)
+	}
+	if options.OrderIncludedByTraversal {
+		payload.setIncluded(orderByTraversal(payload.primaryNodes(), payload.includedNodes()))
+	}
+	if options.IncludedVia {
+		paths := includedVia(payload.primaryNodes(), payload.includedNodes())
+		for _, n := range payload.includedNodes() {
+			if path, ok := paths[n.key()]; ok {
+				setIncludedVia(n, path)
+			}
+		}
+	}
+	if options.DropNulls {
+		for _, n := range payload.nodes() {
+			dropNullAttributes(n)
+		}
+	}
+	if options.AlwaysEmitIncluded {
+		payload.setAlwaysEmitIncluded()
+	}
+	if options.AttrNames != nil {
+		for _, n := range payload.nodes() {
+			renameAttributes(n, options.AttrNames[n.Type], options.KeyNamer)
+		}
+	} else if options.KeyNamer != nil {
+		for _, n := range payload.nodes() {
+			renameAttributes(n, nil, options.KeyNamer)
+		}
+	}
+	if options.KeyNamer != nil {
+		for _, n := range payload.nodes() {
+			renameRelationships(n, options.KeyNamer)
+		}
+	}
+	if options.OmitLinkage != nil {
+		for _, n := range payload.nodes() {
+			for _, name := range options.OmitLinkage[n.Type] {
+				delete(n.Relationships, name)
+			}
+		}
+	}
+	if options.Fields != nil {
+		for _, n := range payload.nodes() {
+			if fields, ok := options.Fields[n.Type]; ok {
+				keepFields(n, fields)
+			}
+		}
+	}
+	if options.RESTLinks != "" {
+		base := strings.TrimSuffix(options.RESTLinks, "/")
+		for _, n := range payload.nodes() {
+			if n.ID != "" {
+				setRelationshipLinks(n, base+"/"+n.Type+"/"+n.ID)
+			}
+		}
+	}
+	if options.AutoSelfLinks != "" {
+		base := strings.TrimSuffix(options.AutoSelfLinks, "/")
+		for _, n := range payload.nodes() {
+			if n.Links == nil && n.ID != "" {
+				n.Links = &Links{KeySelfLink: base + "/" + n.Type + "/" + n.ID}
+			}
+		}
+	}
+	if options.OrderedRelationships {
+		for _, n := range payload.nodes() {
+			n.orderRelationships = true
+		}
+	}
+	for _, validate := range options.Validators {
+		if err := validate(payload); err != nil {
+			return nil, err
+		}
+	}
 	return payload, nil
 }
 
+// isEmptyValue reports whether the attribute v is omitted by omitempty: the
+// zero value of its type or an empty slice or map. A non-nil pointer is never
+// empty, so a pointer to a zero value is still written.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// identifierRelationship builds the relationship object of a relation field
+// holding Identifier linkage, and reports whether it is empty: a nil pointer,
+// an Identifier without id, or an empty slice.
+func identifierRelationship(fieldValue reflect.Value) (interface{}, bool) {
+	if fieldValue.Kind() == reflect.Slice {
+		ids := fieldValue.Interface().([]Identifier)
+		data := make([]*Node, 0, len(ids))
+		for _, id := range ids {
+			data = append(data, &Node{Type: id.Type, ID: id.ID})
+		}
+		return &RelationshipManyNode{Data: data}, len(ids) == 0
+	}
+
+	if fieldValue.Kind() == reflect.Ptr {
+		if fieldValue.IsNil() {
+			return &RelationshipOneNode{}, true
+		}
+		fieldValue = fieldValue.Elem()
+	}
+	id := fieldValue.Interface().(Identifier)
+	if id.ID == "" {
+		return &RelationshipOneNode{}, true
+	}
+	return &RelationshipOneNode{Data: &Node{Type: id.Type, ID: id.ID}}, false
+}
+
+// complexAttr returns the {"real": ..., "imag": ...} object written for a
+// complex number, or a pointer to one.
+func complexAttr(v reflect.Value) (map[string]interface{}, bool) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, false
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Complex64:
+		c := complex64(v.Complex())
+		return map[string]interface{}{"real": real(c), "imag": imag(c)}, true
+	case reflect.Complex128:
+		c := v.Complex()
+		return map[string]interface{}{"real": real(c), "imag": imag(c)}, true
+	}
+	return nil, false
+}
+
+// isEmptyString reports whether v is an empty string, or a pointer to one.
+func isEmptyString(v reflect.Value) bool {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return false
+		}
+		v = v.Elem()
+	}
+	return v.Kind() == reflect.String && v.Len() == 0
+}
+
+// setRelationshipLinks sets the self and related links of the relationships
+// of n without links, for the resource URL.
+func setRelationshipLinks(n *Node, resourceURL string) {
+	for name, rel := range n.Relationships {
+		links := &Links{
+			KeySelfLink:    resourceURL + "/relationships/" + name,
+			KeyRelatedLink: resourceURL + "/" + name,
+		}
+		switch r := rel.(type) {
+		case *RelationshipOneNode:
+			if r.Links == nil {
+				r.Links = links
+			}
+		case *RelationshipManyNode:
+			if r.Links == nil {
+				r.Links = links
+			}
+		}
+	}
+}
+
+// setIncludedVia sets the included-via path in the meta of n, copying the meta
+// so the model's own map is left untouched.
+func setIncludedVia(n *Node, path string) {
+	meta := Meta{}
+	if n.Meta != nil {
+		for k, v := range *n.Meta {
+			meta[k] = v
+		}
+	}
+	meta[MetaKeyIncludedVia] = path
+	n.Meta = &meta
+}
+
+// withExtensions returns a copy of jsonapi with exts appended to its
+// extensions, leaving the caller's object untouched.
+func withExtensions(jsonapi *JSONAPIObject, exts []string) *JSONAPIObject {
+	if len(exts) == 0 {
+		return jsonapi
+	}
+
+	obj := &JSONAPIObject{}
+	if jsonapi != nil {
+		*obj = *jsonapi
+	}
+	obj.Ext = append(append([]string{}, obj.Ext...), exts...)
+	return obj
+}
+
+// setTotalCount sets the total count of p to the number of its resources,
+// unless its meta already has one.
+func setTotalCount(p *ManyPayload) {
+	if p.Meta != nil {
+		if _, ok := (*p.Meta)[MetaKeyTotalCount]; ok {
+			return
+		}
+	}
+
+	// copy the meta so the caller's or model's map is left untouched
+	meta := Meta{}
+	if p.Meta != nil {
+		for k, v := range *p.Meta {
+			meta[k] = v
+		}
+	}
+	meta[MetaKeyTotalCount] = len(p.Data)
+	p.Meta = &meta
+}
+
+func renameAttributes(n *Node, names map[string]string, namer KeyNamer) {
+	if (len(names) == 0 && namer == nil) || len(n.Attributes) == 0 {
+		return
+	}
+
+	attributes := make(map[string]interface{}, len(n.Attributes))
+	for k, v := range n.Attributes {
+		if n.extraAttributes[k] {
+			continue
+		}
+		if renamed, ok := names[k]; ok {
+			k = renamed
+		} else if namer != nil {
+			k = namer(k)
+		}
+		attributes[k] = v
+	}
+	// attr-extra attributes were read under their names in the document,
+	// and a renamed field of the same name takes precedence
+	for k := range n.extraAttributes {
+		if _, ok := attributes[k]; !ok {
+			attributes[k] = n.Attributes[k]
+		}
+	}
+	n.Attributes = attributes
+}
+
+// renameRelationships transforms the relationship names of n with namer,
+// keeping their declared order.
+func renameRelationships(n *Node, namer KeyNamer) {
+	if len(n.Relationships) == 0 {
+		return
+	}
+
+	relationships := make(map[string]interface{}, len(n.Relationships))
+	for k, v := range n.Relationships {
+		relationships[namer(k)] = v
+	}
+	n.Relationships = relationships
+	for i, name := range n.relationshipOrder {
+		n.relationshipOrder[i] = namer(name)
+	}
+}
+
+// keepFields removes the attributes and relationships of n that are not in
+// fields.
+func keepFields(n *Node, fields []string) {
+	keep := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		keep[f] = true
+	}
+
+	for k := range n.Attributes {
+		if !keep[k] {
+			delete(n.Attributes, k)
+		}
+	}
+	for k := range n.Relationships {
+		if !keep[k] {
+			delete(n.Relationships, k)
+		}
+	}
+}
+
+// keepIncluded drops the included nodes rejected by keep, and the ones that
+// can then no longer be reached from the primary data.
+func keepIncluded(payload Payloader, keep func(n *Node) bool) {
+	kept := []*Node{}
+	for _, n := range payload.includedNodes() {
+		if keep(n) {
+			kept = append(kept, n)
+		}
+	}
+
+	_, unreachable := traverseIncluded(payload.primaryNodes(), kept)
+
+	included := []*Node{}
+	for _, n := range kept {
+		if _, ok := unreachable[n.key()]; !ok {
+			included = append(included, n)
+		}
+	}
+	payload.setIncluded(included)
+}
+
+func dropNullAttributes(n *Node) {
+	for k, v := range n.Attributes {
+		if isNull(v) {
+			delete(n.Attributes, k)
+		}
+	}
+}
+
+// isNull reports whether v is encoded as JSON null.
+func isNull(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return rv.IsNil()
+	}
+
+	return false
+}
+
 // MarshalPayloadFilterIncluded writes a jsonapi response with one or many
 // records, filtering the related records sideloaded into "included" array.
 // If you want to serialize the relations into the "included" array see
@@ -264,8 +1147,103 @@ func MarshalPayloadFilterIncluded(w io.Writer, model interface{}, relationPaths
 	})
 }
 
-// MarshalFilterIncluded does the same as MarshalPayloadFilterIncluded except it just returns the payload
-// and doesn't write out results. Useful if you use your own JSON rendering
+// MarshalPayloadWithIncludeFilter writes a jsonapi response with one or many
+// records like MarshalPayloadFilterIncluded, additionally dropping the related
+// records for which keep returns false from the "included" array, together
+// with the records only reachable through them. A nil includes sideloads all
+// relations.
+func MarshalPayloadWithIncludeFilter(w io.Writer, models interface{}, includes []string, keep func(n *Node) bool) error {
+	return MarshalPayloadWithOptions(w, models, MarshalOptions{
+		IncludeRelationPaths: includes,
+		KeepIncluded:         keep,
+	})
+}
+
+// MarshalPayloadWithAttrNames writes a jsonapi response with one or many
+// records like MarshalPayload, renaming attributes. rename maps resource types
+// to a map from the name in the attr tag to the name to write. Documents can
+// be read back with UnmarshalPayloadWithAttrNames and the same map.
+func MarshalPayloadWithAttrNames(w io.Writer, models interface{}, rename map[string]map[string]string) error {
+	return MarshalPayloadWithOptions(w, models, MarshalOptions{AttrNames: rename})
+}
+
+// MarshalPayloadWithFieldsets writes a jsonapi response for one or many
+// records like MarshalPayload, keeping only the attributes and relationships
+// listed in fields for each resource type, see MarshalOptions.Fields.
+//
+//	fields := map[string][]string{"posts": {"title"}, "comments": {}}
+func MarshalPayloadWithFieldsets(w io.Writer, models interface{}, fields map[string][]string) error {
+	return MarshalPayloadWithOptions(w, models, MarshalOptions{Fields: fields})
+}
+
+// MarshalWithFieldsets does the same as MarshalPayloadWithFieldsets except
+// it just returns the payload and doesn't write out results.
+func MarshalWithFieldsets(models interface{}, fields map[string][]string) (Payloader, error) {
+	return MarshalWithOptions(models, MarshalOptions{Fields: fields})
+}
+
+// MarshalPayloadWithTypeTransforms writes a jsonapi response for one or many
+// records like MarshalPayload, transforming the attribute values of the Go
+// types in transforms, see MarshalOptions.TypeTransforms.
+//
+//	transforms := map[reflect.Type]func(interface{}) interface{}{
+//		reflect.TypeOf(SSN("")): func(interface{}) interface{} { return "***" },
+//	}
+func MarshalPayloadWithTypeTransforms(w io.Writer, models interface{}, transforms map[reflect.Type]func(interface{}) interface{}) error {
+	return MarshalPayloadWithOptions(w, models, MarshalOptions{TypeTransforms: transforms})
+}
+
+// MarshalPayloadWithRESTLinks writes a jsonapi response for one or many
+// records like MarshalPayload, with the conventional REST links under
+// baseURL: "self" for every resource without links (see
+// MarshalOptions.AutoSelfLinks), and "self" and "related" for every
+// relationship without links (see MarshalOptions.RESTLinks).
+func MarshalPayloadWithRESTLinks(w io.Writer, models interface{}, baseURL string) error {
+	return MarshalPayloadWithOptions(w, models, MarshalOptions{
+		AutoSelfLinks: baseURL,
+		RESTLinks:     baseURL,
+	})
+}
+
+// MarshalPayloadWithExtensions writes models like MarshalPayload, advertising
+// the extension URIs exts in the top-level "jsonapi" object:
+//
+//	jsonapi.MarshalPayloadWithExtensions(w, results, []string{"https://jsonapi.org/ext/atomic"})
+//
+// Without extensions the "jsonapi" member is left out.
+func MarshalPayloadWithExtensions(w io.Writer, models interface{}, exts []string) error {
+	return MarshalPayloadWithOptions(w, models, MarshalOptions{Extensions: exts})
+}
+
+// MarshalPayloadWithNodeMeta writes models like MarshalPayload, adding meta
+// to the resources, primary or included, identified by type and id. See
+// MarshalOptions.NodeMeta.
+func MarshalPayloadWithNodeMeta(w io.Writer, models interface{}, meta map[Identifier]*Meta) error {
+	return MarshalPayloadWithOptions(w, models, MarshalOptions{NodeMeta: meta})
+}
+
+// MarshalPayloadWithIDField writes models like MarshalPayload, with the Go
+// field named fieldName written as the "id" of the models instead of the
+// field tagged primary. See MarshalOptions.IDField.
+func MarshalPayloadWithIDField(w io.Writer, models interface{}, fieldName string) error {
+	return MarshalPayloadWithOptions(w, models, MarshalOptions{IDField: fieldName})
+}
+
+// MarshalPayloadWithValidators writes models like MarshalPayload, once every
+// validator accepted the payload. See MarshalOptions.Validators.
+func MarshalPayloadWithValidators(w io.Writer, models interface{}, validators ...func(Payloader) error) error {
+	return MarshalPayloadWithOptions(w, models, MarshalOptions{Validators: validators})
+}
+
+// MarshalPayloadOrderedRelations writes models like MarshalPayload, with the
+// relationships of every resource in the order their fields are declared on
+// the model. See MarshalOptions.OrderedRelationships.
+func MarshalPayloadOrderedRelations(w io.Writer, models interface{}) error {
+	return MarshalPayloadWithOptions(w, models, MarshalOptions{OrderedRelationships: true})
+}
+
+// MarshalFilterIncluded does the same as MarshalPayloadFilterIncluded except it just returns the payload
+// and doesn't write out results. Useful if you use your own JSON rendering
 // library.
 func MarshalFilterIncluded(model interface{}, relationPaths []string) (Payloader, error) {
 	return MarshalWithOptions(model, MarshalOptions{
@@ -276,16 +1254,22 @@ func MarshalFilterIncluded(model interface{}, relationPaths []string) (Payloader
 // marshalOne does the same as MarshalOnePayload except it just returns the
 // payload and doesn't write out results. Useful is you use your JSON rendering
 // library.
-func marshalOne(model interface{}) (*OnePayload, error) {
+func marshalOne(model interface{}, options *MarshalOptions) (*OnePayload, error) {
 	included := make(map[string]*Node)
 
-	rootNode, err := visitModelNode(model, &included, true)
+	rootNode, err := visitModelNode(model, &included, true, options)
 	if err != nil {
 		return nil, err
 	}
+	if err := visitProvidedIncludes(model, &included, options); err != nil {
+		return nil, err
+	}
+	if err := options.checkGathered(1 + len(included)); err != nil {
+		return nil, err
+	}
 	payload := &OnePayload{Data: rootNode}
 
-	payload.Included = nodeMapValues(&included)
+	payload.Included = nodeMapValuesSorted(&included)
 
 	return payload, nil
 }
@@ -293,24 +1277,185 @@ func marshalOne(model interface{}) (*OnePayload, error) {
 // marshalMany does the same as MarshalManyPayload except it just returns the
 // payload and doesn't write out results. Useful is you use your JSON rendering
 // library.
-func marshalMany(models []interface{}) (*ManyPayload, error) {
+func marshalMany(models []interface{}, options *MarshalOptions) (*ManyPayload, error) {
 	payload := &ManyPayload{
 		Data: []*Node{},
 	}
 	included := map[string]*Node{}
 
 	for _, model := range models {
-		node, err := visitModelNode(model, &included, true)
+		node, err := visitModelNode(model, &included, true, options)
 		if err != nil {
 			return nil, err
 		}
+		if err := visitProvidedIncludes(model, &included, options); err != nil {
+			return nil, err
+		}
 		payload.Data = append(payload.Data, node)
+
+		if err := options.checkGathered(len(payload.Data) + len(included)); err != nil {
+			return nil, err
+		}
 	}
-	payload.Included = nodeMapValues(&included)
+	payload.Included = nodeMapValuesSorted(&included)
 
 	return payload, nil
 }
 
+// visitProvidedIncludes sideloads the resources returned by the
+// JSONAPIIncluded method of model, when it is an IncludeProvider.
+func visitProvidedIncludes(model interface{}, included *map[string]*Node, options *MarshalOptions) error {
+	provider, ok := model.(IncludeProvider)
+	if !ok {
+		return nil
+	}
+
+	for _, m := range provider.JSONAPIIncluded() {
+		if v := reflect.ValueOf(m); v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			return ErrUnexpectedType
+		}
+
+		node, err := visitModelNode(m, included, true, options)
+		if err != nil {
+			return err
+		}
+		if node != nil {
+			appendIncluded(included, node)
+		}
+	}
+
+	return nil
+}
+
+// MarshalPayloadOmitType writes the same document as MarshalPayload, but
+// without the "type" member of the resource objects and resource identifiers.
+//
+// The output does NOT conform to the JSON API spec. It is only meant as a
+// diagnostic for tests and tooling, e.g. to diff resources of a known type.
+func MarshalPayloadOmitType(w io.Writer, models interface{}) error {
+	payload, err := Marshal(models)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return err
+	}
+
+	omitResourceType(doc["data"])
+	omitResourceType(doc["included"])
+
+	return encodePayload(w, doc)
+}
+
+// omitResourceType removes the "type" member of the decoded resource objects
+// in v, and of the linkage in their relationships.
+func omitResourceType(v interface{}) {
+	switch r := v.(type) {
+	case []interface{}:
+		for _, e := range r {
+			omitResourceType(e)
+		}
+	case map[string]interface{}:
+		delete(r, "type")
+
+		relationships, _ := r["relationships"].(map[string]interface{})
+		for _, relationship := range relationships {
+			if rel, ok := relationship.(map[string]interface{}); ok {
+				omitResourceType(rel["data"])
+			}
+		}
+	}
+}
+
+// MarshalMerged writes a jsonapi response with a single resource of the given
+// type and id, whose attributes and relationships are read from the attr and
+// relation fields of all parts, e.g. a base model and an overlay struct. Later
+// parts override earlier ones on conflicting keys. Parts must be struct
+// pointers; a part with a primary field must have the same type and id.
+func MarshalMerged(w io.Writer, typ, id string, parts ...interface{}) error {
+	included := make(map[string]*Node)
+	merged := &Node{Type: typ, ID: id}
+
+	for _, part := range parts {
+		if v := reflect.ValueOf(part); v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			return ErrUnexpectedType
+		}
+
+		node, err := visitModelNode(part, &included, true, nil)
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			continue
+		}
+
+		// only parts with a primary field have a type
+		if node.Type != "" && node.Type != typ {
+			return ErrConflictingMergedType
+		}
+		if node.Type != "" && node.ID != id {
+			return ErrConflictingMergedID
+		}
+
+		for k, v := range node.Attributes {
+			if merged.Attributes == nil {
+				merged.Attributes = make(map[string]interface{})
+			}
+			merged.Attributes[k] = v
+		}
+		for k, v := range node.Relationships {
+			if merged.Relationships == nil {
+				merged.Relationships = make(map[string]interface{})
+			}
+			merged.Relationships[k] = v
+		}
+		if node.Links != nil {
+			merged.Links = node.Links
+		}
+		if node.Meta != nil {
+			meta := Meta{}
+			if merged.Meta != nil {
+				for k, v := range *merged.Meta {
+					meta[k] = v
+				}
+			}
+			for k, v := range *node.Meta {
+				meta[k] = v
+			}
+			merged.Meta = &meta
+		}
+	}
+
+	payload := &OnePayload{Data: merged, Included: nodeMapValuesSorted(&included)}
+
+	return encodePayload(w, payload)
+}
+
+// MarshalMetaDocument writes a document holding only a top-level "meta"
+// object, without "data" or "errors", e.g. for a stats endpoint.
+func MarshalMetaDocument(w io.Writer, meta *Meta) error {
+	if meta == nil {
+		meta = &Meta{}
+	}
+
+	return encodePayload(w, &MetaPayload{Meta: meta})
+}
+
+// MetaPayload is used to represent a JSON API document that only has a
+// top-level "meta" object.
+type MetaPayload struct {
+	Meta *Meta `json:"meta"`
+}
+
 // MarshalOnePayloadEmbedded - This method not meant to for use in
 // implementation code, although feel free.  The purpose of this
 // method is for use in tests.  In most cases, your request
@@ -327,19 +1472,26 @@ func marshalMany(models []interface{}) (*ManyPayload, error) {
 //
 // model interface{} should be a pointer to a struct.
 func MarshalOnePayloadEmbedded(w io.Writer, model interface{}) error {
-	rootNode, err := visitModelNode(model, nil, false)
+	rootNode, err := visitModelNode(model, nil, false, nil)
 	if err != nil {
 		return err
 	}
 
 	payload := &OnePayload{Data: rootNode}
 
-	return json.NewEncoder(w).Encode(payload)
+	return encodePayload(w, payload)
 }
 
 func visitModelNode(model interface{}, included *map[string]*Node,
-	sideload bool) (*Node, error) {
+	sideload bool, options *MarshalOptions) (*Node, error) {
 	node := new(Node)
+	var fieldMeta Meta
+	var extraAttrs map[string]interface{}
+	var declaredAttrs map[string]bool
+	var fieldLinks *Links
+	var fieldRelLinks map[string]*Links
+	var hasRelations bool
+	var compositeParts []compositePart
 
 	var er error
 	value := reflect.ValueOf(model)
@@ -347,8 +1499,11 @@ func visitModelNode(model interface{}, included *map[string]*Node,
 		return nil, nil
 	}
 
+	if err := options.beforeMarshal(model); err != nil {
+		return nil, err
+	}
+
 	modelValue := value.Elem()
-	modelType := value.Type().Elem()
 
 	for i := 0; i < modelValue.NumField(); i++ {
 		structField := modelValue.Type().Field(i)
@@ -358,7 +1513,6 @@ func visitModelNode(model interface{}, included *map[string]*Node,
 		}
 
 		fieldValue := modelValue.Field(i)
-		fieldType := modelType.Field(i)
 
 		args := strings.Split(tag, annotationSeperator)
 
@@ -369,26 +1523,34 @@ func visitModelNode(model interface{}, included *map[string]*Node,
 
 		annotation := args[0]
 
-		if (annotation == annotationClientID && len(args) != 1) ||
-			(annotation != annotationClientID && len(args) < 2) {
+		if !validTagArgs(args) {
 			er = ErrBadJSONAPIStructTag
 			break
 		}
 
 		if annotation == annotationPrimary {
 			v := fieldValue
+			idField, overridden := options.idFieldOf(modelValue)
+			if overridden {
+				v = idField
+			}
 
 			// Deal with PTRS
 			var kind reflect.Kind
-			if fieldValue.Kind() == reflect.Ptr {
-				kind = fieldType.Type.Elem().Kind()
-				v = reflect.Indirect(fieldValue)
+			if v.Kind() == reflect.Ptr && v.IsNil() {
+				// a nil id pointer, e.g. a new id that isn't set yet,
+				// leaves the id empty
+				kind = reflect.Invalid
+			} else if v.Kind() == reflect.Ptr {
+				kind = v.Type().Elem().Kind()
+				v = reflect.Indirect(v)
 			} else {
-				kind = fieldType.Type.Kind()
+				kind = v.Kind()
 			}
 
 			// Handle allowed types
 			switch kind {
+			case reflect.Invalid:
 			case reflect.String:
 				node.ID = v.Interface().(string)
 			case reflect.Int:
@@ -412,6 +1574,12 @@ func visitModelNode(model interface{}, included *map[string]*Node,
 			case reflect.Uint64:
 				node.ID = strconv.FormatUint(v.Interface().(uint64), 10)
 			default:
+				// Other types may describe themselves as a string
+				if id, ok := stringID(v); ok {
+					node.ID = id
+					break
+				}
+
 				// We had a JSON float (numeric), but our field was not one of the
 				// allowed numeric types
 				er = ErrBadJSONAPIID
@@ -421,14 +1589,37 @@ func visitModelNode(model interface{}, included *map[string]*Node,
 				break
 			}
 
+			if n, ok, err := compositeKey(args); ok && !overridden {
+				if err != nil {
+					er = err
+					break
+				}
+				compositeParts = append(compositeParts, compositePart{n: n, id: node.ID})
+				node.ID = ""
+			}
+
 			node.Type = args[1]
+			if typeableModel, ok := model.(Typeable); ok {
+				if t := typeableModel.JSONAPIType(); t != "" {
+					node.Type = t
+				}
+			}
+		} else if annotation == annotationLID {
+			node.LID = fieldValue.String()
 		} else if annotation == annotationClientID {
 			clientID := fieldValue.String()
 			if clientID != "" {
 				node.ClientID = clientID
 			}
 		} else if annotation == annotationAttribute {
-			var omitEmpty, iso8601, rfc3339 bool
+			if declaredAttrs == nil {
+				declaredAttrs = make(map[string]bool)
+			}
+			declaredAttrs[args[1]] = true
+
+			var omitEmpty, iso8601, rfc3339, unixMilli, complexObject bool
+			var layout string
+			precision := -1
 
 			if len(args) > 2 {
 				for _, arg := range args[2:] {
@@ -439,25 +1630,91 @@ func visitModelNode(model interface{}, included *map[string]*Node,
 						iso8601 = true
 					case annotationRFC3339:
 						rfc3339 = true
+					case annotationUnixMilli:
+						unixMilli = true
+					case annotationComplex:
+						complexObject = true
+					default:
+						if v, ok := tagOptionValue(arg, annotationPrecision); ok {
+							n, err := strconv.Atoi(v)
+							if err != nil || n < 0 {
+								er = ErrBadJSONAPIStructTag
+								break
+							}
+							precision = n
+						} else if v, ok := tagOptionValue(arg, annotationLayout); ok {
+							layout = v
+						}
 					}
 				}
+				if er != nil {
+					break
+				}
+			}
+
+			// the value of a method-backed attribute is the result of the
+			// method, formatted like a field of its type
+			if method, ok := tagOptionArg(args, annotationMethod); ok {
+				if fieldValue, er = attrMethod(value, method); er != nil {
+					break
+				}
 			}
 
 			if node.Attributes == nil {
 				node.Attributes = make(map[string]interface{})
 			}
 
+			codec, err := attrCodec(args)
+			if err != nil {
+				er = err
+				break
+			}
+			if codec != nil {
+				if omitEmpty && isEmptyValue(fieldValue) {
+					continue
+				}
+				v, err := codec.Encode(fieldValue.Interface())
+				if err != nil {
+					er = err
+					break
+				}
+				node.Attributes[args[1]] = v
+				continue
+			}
+
+			if transform, arg, ok := options.typeTransform(fieldValue); ok {
+				if omitEmpty && isEmptyValue(fieldValue) {
+					continue
+				}
+				node.Attributes[args[1]] = transform(arg)
+				continue
+			}
+
 			if fieldValue.Type() == reflect.TypeOf(time.Time{}) {
 				t := fieldValue.Interface().(time.Time)
 
+				// zero times are handled alike whatever their format
 				if t.IsZero() {
+					switch options.zeroTimes() {
+					case ZeroTimeError:
+						er = &ErrZeroTime{Attribute: args[1]}
+					case ZeroTimeNull:
+						node.Attributes[args[1]] = nil
+					}
+					if er != nil {
+						break
+					}
 					continue
 				}
 
-				if iso8601 {
+				if layout != "" {
+					node.Attributes[args[1]] = t.Format(layout)
+				} else if iso8601 {
 					node.Attributes[args[1]] = t.UTC().Format(iso8601TimeFormat)
 				} else if rfc3339 {
 					node.Attributes[args[1]] = t.UTC().Format(time.RFC3339)
+				} else if unixMilli {
+					node.Attributes[args[1]] = t.UnixMilli()
 				} else {
 					node.Attributes[args[1]] = t.Unix()
 				}
@@ -470,26 +1727,58 @@ func visitModelNode(model interface{}, included *map[string]*Node,
 
 					node.Attributes[args[1]] = nil
 				} else {
+					// a set pointer is written even to a zero time
 					tm := fieldValue.Interface().(*time.Time)
 
-					if tm.IsZero() && omitEmpty {
-						continue
-					}
-
-					if iso8601 {
+					if layout != "" {
+						node.Attributes[args[1]] = tm.Format(layout)
+					} else if iso8601 {
 						node.Attributes[args[1]] = tm.UTC().Format(iso8601TimeFormat)
 					} else if rfc3339 {
 						node.Attributes[args[1]] = tm.UTC().Format(time.RFC3339)
+					} else if unixMilli {
+						node.Attributes[args[1]] = tm.UnixMilli()
 					} else {
 						node.Attributes[args[1]] = tm.Unix()
 					}
 				}
 			} else {
 				// Dealing with a fieldValue that is not a time
-				emptyValue := reflect.Zero(fieldValue.Type())
 
 				// See if we need to omit this field
-				if omitEmpty && reflect.DeepEqual(fieldValue.Interface(), emptyValue.Interface()) {
+				if omitEmpty && isEmptyValue(fieldValue) {
+					continue
+				}
+
+				if valuer, ok := attrValuer(fieldValue); ok {
+					v, err := valuer.JSONAPIAttrValue()
+					if err != nil {
+						er = err
+						break
+					}
+					node.Attributes[args[1]] = v
+					continue
+				}
+
+				if precision >= 0 {
+					if n, ok, err := formatFloat(args[1], fieldValue, precision); err != nil {
+						er = err
+						break
+					} else if ok {
+						node.Attributes[args[1]] = n
+						continue
+					}
+				}
+
+				if complexObject {
+					if c, ok := complexAttr(fieldValue); ok {
+						node.Attributes[args[1]] = c
+						continue
+					}
+				}
+
+				if options != nil && options.EmptyStringAsNull && isEmptyString(fieldValue) {
+					node.Attributes[args[1]] = nil
 					continue
 				}
 
@@ -501,17 +1790,106 @@ func visitModelNode(model interface{}, included *map[string]*Node,
 				}
 			}
 		} else if annotation == annotationRelation {
+			hasRelations = true
+
 			var omitEmpty bool
+			var emptyHasMany, sortBy string
+			var maxLinkage int
 
 			//add support for 'omitempty' struct tag for marshaling as absent
 			if len(args) > 2 {
-				omitEmpty = args[2] == annotationOmitEmpty
+				for _, arg := range args[2:] {
+					if arg == annotationOmitEmpty {
+						omitEmpty = true
+					} else if v, ok := tagOptionValue(arg, annotationEmptyHasMany); ok {
+						if v != emptyHasManyOmit && v != emptyHasManyEmpty {
+							er = ErrBadJSONAPIStructTag
+							break
+						}
+						emptyHasMany = v
+					} else if v, ok := tagOptionValue(arg, annotationMax); ok {
+						n, err := strconv.Atoi(v)
+						if err != nil || n < 1 {
+							er = ErrBadJSONAPIStructTag
+							break
+						}
+						maxLinkage = n
+					} else if v, ok := tagOptionValue(arg, annotationSort); ok {
+						sortBy = v
+					}
+				}
+				if er != nil {
+					break
+				}
+			}
+
+			// a pointer to a has-many is left out when nil and written even
+			// when empty, to tell a relationship that wasn't loaded from an
+			// empty one
+			sliceRef := isSliceRef(fieldValue.Type())
+			if sliceRef {
+				if fieldValue.IsNil() {
+					continue
+				}
+				fieldValue = fieldValue.Elem()
+			}
+
+			if isIdentifierField(fieldValue.Type()) {
+				relationship, empty := identifierRelationship(fieldValue)
+				if empty && omitEmpty {
+					continue
+				}
+				if node.Relationships == nil {
+					node.Relationships = make(map[string]interface{})
+				}
+
+				var relLinks *Links
+				if linkableModel, ok := model.(RelationshipLinkable); ok {
+					relLinks = linkableModel.JSONAPIRelationshipLinks(args[1])
+				}
+				var relMeta *Meta
+				if metableModel, ok := model.(RelationshipMetable); ok {
+					relMeta = metableModel.JSONAPIRelationshipMeta(args[1])
+				}
+				switch r := relationship.(type) {
+				case *RelationshipOneNode:
+					r.Links, r.Meta = relLinks, relMeta
+				case *RelationshipManyNode:
+					r.Links, r.Meta = relLinks, relMeta
+				}
+
+				node.Relationships[args[1]] = relationship
+				node.relationshipOrder = append(node.relationshipOrder, args[1])
+				continue
+			}
+
+			if fieldValue.Kind() == reflect.Map {
+				// a has-many held in a map is written in key order
+				if fieldValue, er = mapValues(fieldValue); er != nil {
+					break
+				}
+			}
+
+			if fieldValue, er = options.forceCardinality(args[1], fieldValue, sortBy); er != nil {
+				break
 			}
 
 			isSlice := fieldValue.Type().Kind() == reflect.Slice
-			if omitEmpty &&
-				(isSlice && fieldValue.Len() < 1 ||
-					(!isSlice && fieldValue.IsNil())) {
+			if isSlice && fieldValue.Len() < 1 && !sliceRef {
+				switch emptyHasMany {
+				case emptyHasManyOmit:
+					continue
+				case emptyHasManyEmpty:
+					// only a nil slice is considered empty by omitempty
+					if omitEmpty && fieldValue.IsNil() {
+						continue
+					}
+				case "":
+					if omitEmpty {
+						continue
+					}
+				}
+			} else if omitEmpty && !isSlice && fieldValue.IsNil() {
 				continue
 			}
 
@@ -531,11 +1909,21 @@ func visitModelNode(model interface{}, included *map[string]*Node,
 
 			if isSlice {
 				// to-many relationship
-				relationship, err := visitModelNodeRelationships(
-					fieldValue,
-					included,
-					sideload,
-				)
+				if sortBy != "" {
+					sorted, err := sortRelated(fieldValue, sortBy)
+					if err != nil {
+						er = err
+						break
+					}
+					fieldValue = sorted
+				}
+
+				hasMore := maxLinkage > 0 && fieldValue.Len() > maxLinkage
+				if hasMore {
+					fieldValue = fieldValue.Slice(0, maxLinkage)
+				}
+
+				relationship, err := visitToManyRelationship(fieldValue, included, sideload, options)
 				if err != nil {
 					er = err
 					break
@@ -543,56 +1931,100 @@ func visitModelNode(model interface{}, included *map[string]*Node,
 				relationship.Links = relLinks
 				relationship.Meta = relMeta
 
-				if sideload {
-					shallowNodes := []*Node{}
-					for _, n := range relationship.Data {
-						appendIncluded(included, n)
-						shallowNodes = append(shallowNodes, toShallowNode(n))
-					}
-
-					node.Relationships[args[1]] = &RelationshipManyNode{
-						Data:  shallowNodes,
-						Links: relationship.Links,
-						Meta:  relationship.Meta,
+				if hasMore {
+					// copy the meta so the model's own map is left untouched
+					meta := Meta{}
+					if relMeta != nil {
+						for k, v := range *relMeta {
+							meta[k] = v
+						}
 					}
-				} else {
-					node.Relationships[args[1]] = relationship
+					meta[MetaKeyHasMore] = true
+					relationship.Meta = &meta
 				}
+
+				node.Relationships[args[1]] = relationship
+				node.relationshipOrder = append(node.relationshipOrder, args[1])
 			} else {
 				// to-one relationships
-
-				// Handle null relationship case
-				if fieldValue.IsNil() {
-					node.Relationships[args[1]] = &RelationshipOneNode{Data: nil}
-					continue
-				}
-
-				relationship, err := visitModelNode(
-					fieldValue.Interface(),
-					included,
-					sideload,
-				)
+				relationship, err := visitToOneRelationship(fieldValue, included, sideload, options)
 				if err != nil {
 					er = err
 					break
 				}
+				relationship.Links = relLinks
+				relationship.Meta = relMeta
 
-				if sideload {
-					appendIncluded(included, relationship)
-					node.Relationships[args[1]] = &RelationshipOneNode{
-						Data:  toShallowNode(relationship),
-						Links: relLinks,
-						Meta:  relMeta,
-					}
-				} else {
-					node.Relationships[args[1]] = &RelationshipOneNode{
-						Data:  relationship,
-						Links: relLinks,
-						Meta:  relMeta,
-					}
+				node.Relationships[args[1]] = relationship
+				node.relationshipOrder = append(node.relationshipOrder, args[1])
+			}
+		} else if annotation == annotationAttrExtra {
+			extra, ok := fieldValue.Interface().(map[string]interface{})
+			if !ok {
+				er = ErrBadJSONAPIStructTag
+				break
+			}
+			extraAttrs = extra
+		} else if annotation == annotationMeta {
+			var omitEmpty bool
+			for _, arg := range args[2:] {
+				if arg == annotationOmitEmpty {
+					omitEmpty = true
 				}
 			}
 
+			if omitEmpty && fieldValue.IsZero() {
+				continue
+			}
+
+			if fieldMeta == nil {
+				fieldMeta = make(Meta)
+			}
+			fieldMeta[args[1]] = fieldValue.Interface()
+		} else if annotation == annotationRelationMap {
+			hasRelations = true
+
+			if fieldValue.Kind() == reflect.Map && fieldValue.Len() == 0 {
+				continue
+			}
+
+			if node.Relationships == nil {
+				node.Relationships = make(map[string]interface{})
+			}
+
+			relationships, err := visitRelationMap(model, fieldValue, included, sideload, options)
+			if err != nil {
+				er = err
+				break
+			}
+			names := make([]string, 0, len(relationships))
+			for name, relationship := range relationships {
+				node.Relationships[name] = relationship
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			node.relationshipOrder = append(node.relationshipOrder, names...)
+		} else if annotation == annotationLinks {
+			links, ok := fieldValue.Interface().(*Links)
+			if !ok {
+				er = ErrBadJSONAPIStructTag
+				break
+			}
+			if links == nil {
+				continue
+			}
+			if er = links.validate(); er != nil {
+				break
+			}
+
+			if len(args) == 1 {
+				fieldLinks = links
+				continue
+			}
+			if fieldRelLinks == nil {
+				fieldRelLinks = make(map[string]*Links)
+			}
+			fieldRelLinks[args[1]] = links
 		} else {
 			er = ErrBadJSONAPIStructTag
 			break
@@ -603,6 +2035,39 @@ func visitModelNode(model interface{}, included *map[string]*Node,
 		return nil, er
 	}
 
+	if len(compositeParts) > 0 {
+		id, err := joinCompositeID(compositeParts, options.compositeIDSeparator())
+		if err != nil {
+			return nil, err
+		}
+		node.ID = id
+	}
+
+	if hasRelations && len(node.Relationships) == 0 && options != nil && options.EmitEmptyRelationships {
+		node.emitEmptyRelationships = true
+	}
+
+	if computed, ok := model.(ComputedAttributer); ok {
+		if err := mergeComputedAttrs(node, options.transformAttrs(computed.JSONAPIComputedAttrs()), declaredAttrs, options.computedConflicts()); err != nil {
+			return nil, err
+		}
+	}
+
+	// attributes captured by an attr-extra field are written back, unless a
+	// field of the model has the same name
+	for k, v := range options.transformAttrs(extraAttrs) {
+		if node.Attributes == nil {
+			node.Attributes = make(map[string]interface{})
+		}
+		if _, ok := node.Attributes[k]; !ok {
+			node.Attributes[k] = v
+			if node.extraAttributes == nil {
+				node.extraAttributes = make(map[string]bool, len(extraAttrs))
+			}
+			node.extraAttributes[k] = true
+		}
+	}
+
 	if linkableModel, isLinkable := model.(Linkable); isLinkable {
 		jl := linkableModel.JSONAPILinks()
 		if er := jl.validate(); er != nil {
@@ -611,28 +2076,471 @@ func visitModelNode(model interface{}, included *map[string]*Node,
 		node.Links = linkableModel.JSONAPILinks()
 	}
 
+	// links fields are written unless the model provides its own links
+	if node.Links == nil {
+		node.Links = fieldLinks
+	}
+	for name, links := range fieldRelLinks {
+		switch rel := node.Relationships[name].(type) {
+		case *RelationshipOneNode:
+			if rel.Links == nil {
+				rel.Links = links
+			}
+		case *RelationshipManyNode:
+			if rel.Links == nil {
+				rel.Links = links
+			}
+		}
+	}
+
 	if metableModel, ok := model.(Metable); ok {
 		node.Meta = metableModel.JSONAPIMeta()
 	}
 
+	if len(fieldMeta) > 0 {
+		// merge into a copy, field values take precedence over Metable
+		meta := Meta{}
+		if node.Meta != nil {
+			for k, v := range *node.Meta {
+				meta[k] = v
+			}
+		}
+		for k, v := range fieldMeta {
+			meta[k] = v
+		}
+		node.Meta = &meta
+	}
+
+	node.Meta = options.nodeMeta(node)
+	node.Meta = omitEmptyMeta(node.Meta, options)
+
+	runNodeHook(model, node)
+
 	return node, nil
 }
 
+// nodeMeta returns the meta of node merged with its NodeMeta, if any: first
+// the meta of every resource of its type, then the meta of its id.
+func (o *MarshalOptions) nodeMeta(node *Node) *Meta {
+	if o == nil {
+		return node.Meta
+	}
+	typeMeta := o.NodeMeta[Identifier{Type: node.Type}]
+	var idMeta *Meta
+	if node.ID != "" {
+		idMeta = o.NodeMeta[Identifier{Type: node.Type, ID: node.ID}]
+	}
+	if typeMeta == nil && idMeta == nil {
+		return node.Meta
+	}
+
+	meta := Meta{}
+	for _, m := range []*Meta{node.Meta, typeMeta, idMeta} {
+		if m == nil {
+			continue
+		}
+		for k, v := range *m {
+			meta[k] = v
+		}
+	}
+	return &meta
+}
+
+// formatFloat formats the float (or non-nil float pointer) v of the attribute
+// name with a fixed number of decimals, as a JSON number. NaN and infinities,
+// which have no JSON number form, fail with an *ErrNonFiniteFloat.
+func formatFloat(name string, v reflect.Value, precision int) (json.Number, bool, error) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", false, nil
+		}
+		v = v.Elem()
+	}
+
+	bitSize := 64
+	switch v.Kind() {
+	case reflect.Float32:
+		bitSize = 32
+	case reflect.Float64:
+	default:
+		return "", false, nil
+	}
+
+	f := v.Float()
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", false, &ErrNonFiniteFloat{Attribute: name, Value: f}
+	}
+	return json.Number(strconv.FormatFloat(f, 'f', precision, bitSize)), true, nil
+}
+
+// mergeComputedAttrs merges computed into the attributes of node. Attributes
+// named like a declared attr field are handled according to policy, unless the
+// computed value is an OverrideAttr.
+func mergeComputedAttrs(node *Node, computed map[string]interface{}, declared map[string]bool, policy ComputedConflictPolicy) error {
+	for k, v := range computed {
+		if node.Attributes == nil {
+			node.Attributes = make(map[string]interface{})
+		}
+
+		if o, ok := v.(OverrideAttr); ok {
+			node.Attributes[k] = o.Value
+			continue
+		}
+		// an attr field conflicts even when it was omitted as empty
+		if !declared[k] || policy == ComputedOverride {
+			node.Attributes[k] = v
+		} else if policy == ComputedError {
+			return &ErrComputedConflict{Attribute: k}
+		}
+	}
+	return nil
+}
+
+// omitEmptyMeta returns nil for an empty meta, unless options ask for empty
+// meta objects to be written.
+func omitEmptyMeta(meta *Meta, options *MarshalOptions) *Meta {
+	if meta == nil || len(*meta) > 0 || (options != nil && options.EmitEmptyMeta) {
+		return meta
+	}
+	return nil
+}
+
+// sortRelated returns a sorted copy of the slice of related models by the
+// attribute named by sortBy, descending when it is prefixed with "-".
+func sortRelated(models reflect.Value, sortBy string) (reflect.Value, error) {
+	attr := strings.TrimPrefix(sortBy, "-")
+	descending := attr != sortBy
+
+	// the index of the attr field in the struct t points to, -1 if there is
+	// none; the elements of an interface slice may be of several types
+	indexes := map[reflect.Type]int{}
+	fieldIndex := func(t reflect.Type) int {
+		if index, ok := indexes[t]; ok {
+			return index
+		}
+		index := -1
+		if t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
+			for i := 0; i < t.Elem().NumField(); i++ {
+				args := strings.Split(t.Elem().Field(i).Tag.Get(annotationJSONAPI), annotationSeperator)
+				if len(args) >= 2 && args[0] == annotationAttribute && args[1] == attr {
+					index = i
+					break
+				}
+			}
+		}
+		indexes[t] = index
+		return index
+	}
+
+	if elemType := models.Type().Elem(); elemType.Kind() != reflect.Interface && fieldIndex(elemType) < 0 {
+		return models, ErrBadJSONAPIStructTag
+	}
+
+	keys := make([]reflect.Value, models.Len())
+	for i := range keys {
+		m := models.Index(i)
+		if m.Kind() == reflect.Interface {
+			m = m.Elem()
+		}
+		if !m.IsValid() {
+			continue
+		}
+		index := fieldIndex(m.Type())
+		if index < 0 {
+			return models, ErrBadJSONAPIStructTag
+		}
+		if !m.IsNil() {
+			keys[i] = reflect.Indirect(m.Elem().Field(index))
+		}
+	}
+
+	order := make([]int, models.Len())
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		if descending {
+			return compareValues(keys[order[j]], keys[order[i]]) < 0
+		}
+		return compareValues(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	sorted := reflect.MakeSlice(models.Type(), models.Len(), models.Len())
+	for i, o := range order {
+		sorted.Index(i).Set(models.Index(o))
+	}
+
+	return sorted, nil
+}
+
+// compareValues compares two attribute values of the same type, ordering
+// invalid (nil) values first.
+func compareValues(a, b reflect.Value) int {
+	switch {
+	case !a.IsValid() && !b.IsValid():
+		return 0
+	case !a.IsValid():
+		return -1
+	case !b.IsValid():
+		return 1
+	}
+
+	if t, ok := a.Interface().(time.Time); ok {
+		return t.Compare(b.Interface().(time.Time))
+	}
+
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareOrdered(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return compareOrdered(a.Uint(), b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return compareOrdered(a.Float(), b.Float())
+	case reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case reflect.Bool:
+		return compareOrdered(boolToInt(a.Bool()), boolToInt(b.Bool()))
+	}
+
+	return strings.Compare(fmt.Sprint(a.Interface()), fmt.Sprint(b.Interface()))
+}
+
+func compareOrdered[T int64 | uint64 | float64 | int](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// visitToManyRelationship builds the relationship object for a slice of
+// related models, sideloading them into included when requested.
+func visitToManyRelationship(fieldValue reflect.Value, included *map[string]*Node,
+	sideload bool, options *MarshalOptions) (*RelationshipManyNode, error) {
+	relationship, err := visitModelNodeRelationships(fieldValue, included, sideload, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if !sideload {
+		return relationship, nil
+	}
+
+	shallowNodes := []*Node{}
+	for _, n := range relationship.Data {
+		appendIncluded(included, n)
+		shallowNodes = append(shallowNodes, toShallowNode(n))
+	}
+
+	return &RelationshipManyNode{Data: shallowNodes}, nil
+}
+
+// visitToOneRelationship builds the relationship object for a pointer to a
+// related model, sideloading it into included when requested.
+func visitToOneRelationship(fieldValue reflect.Value, included *map[string]*Node,
+	sideload bool, options *MarshalOptions) (*RelationshipOneNode, error) {
+	// Handle null relationship case
+	if fieldValue.IsNil() {
+		return &RelationshipOneNode{Data: nil}, nil
+	}
+
+	relationship, err := visitModelNode(fieldValue.Interface(), included, sideload, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// embedded related models are written in full, even when they are new
+	if !sideload {
+		return &RelationshipOneNode{Data: relationship}, nil
+	}
+
+	// A related model without an id (and no lid) isn't set yet, and a resource
+	// identifier with an empty id would be invalid, so it is written as null
+	if relationship.ID == "" && relationship.LID == "" {
+		return &RelationshipOneNode{Data: nil}, nil
+	}
+
+	appendIncluded(included, relationship)
+	return &RelationshipOneNode{Data: toShallowNode(relationship)}, nil
+}
+
+// visitRelationMap builds a relationship object for every entry of a
+// "relation-map" field. Entries may hold *Node or []*Node linkage, which is
+// used as is, or struct pointers and slices of struct pointers, which are
+// marshaled like regular relation fields.
+func visitRelationMap(model interface{}, fieldValue reflect.Value, included *map[string]*Node,
+	sideload bool, options *MarshalOptions) (map[string]interface{}, error) {
+	if fieldValue.Kind() != reflect.Map {
+		return nil, ErrBadJSONAPIStructTag
+	}
+	if fieldValue.Type().Key().Kind() != reflect.String {
+		return nil, ErrInvalidRelationMap
+	}
+
+	relationships := make(map[string]interface{}, fieldValue.Len())
+
+	iter := fieldValue.MapRange()
+	for iter.Next() {
+		name := iter.Key().String()
+		value := iter.Value()
+
+		var relLinks *Links
+		if linkableModel, ok := model.(RelationshipLinkable); ok {
+			relLinks = linkableModel.JSONAPIRelationshipLinks(name)
+		}
+
+		var relMeta *Meta
+		if metableModel, ok := model.(RelationshipMetable); ok {
+			relMeta = metableModel.JSONAPIRelationshipMeta(name)
+		}
+
+		// null relationships keep their links and meta, like relation fields
+		if value.Kind() == reflect.Interface {
+			if value.IsNil() {
+				relationships[name] = &RelationshipOneNode{Data: nil, Links: relLinks, Meta: relMeta}
+				continue
+			}
+			value = value.Elem()
+		}
+
+		switch {
+		case value.Type() == reflect.TypeOf(&Node{}):
+			n := value.Interface().(*Node)
+			if n == nil {
+				relationships[name] = &RelationshipOneNode{Data: nil, Links: relLinks, Meta: relMeta}
+				continue
+			}
+			if sideload {
+				n = toShallowNode(n)
+			}
+			relationships[name] = &RelationshipOneNode{Data: n, Links: relLinks, Meta: relMeta}
+		case value.Type() == reflect.TypeOf([]*Node{}):
+			nodes := []*Node{}
+			for _, n := range value.Interface().([]*Node) {
+				if n == nil {
+					continue
+				}
+				if sideload {
+					n = toShallowNode(n)
+				}
+				nodes = append(nodes, n)
+			}
+			relationships[name] = &RelationshipManyNode{Data: nodes, Links: relLinks, Meta: relMeta}
+		case value.Kind() == reflect.Slice:
+			relationship, err := visitToManyRelationship(value, included, sideload, options)
+			if err != nil {
+				return nil, err
+			}
+			relationship.Links = relLinks
+			relationship.Meta = relMeta
+			relationships[name] = relationship
+		case value.Kind() == reflect.Ptr && value.Type().Elem().Kind() == reflect.Struct:
+			relationship, err := visitToOneRelationship(value, included, sideload, options)
+			if err != nil {
+				return nil, err
+			}
+			relationship.Links = relLinks
+			relationship.Meta = relMeta
+			relationships[name] = relationship
+		default:
+			return nil, ErrInvalidRelationMap
+		}
+	}
+
+	return relationships, nil
+}
+
+// attrValuer returns the AttrValuer implemented by the field value or a
+// pointer to it. Nil pointers are left to the regular handling.
+func attrValuer(fieldValue reflect.Value) (AttrValuer, bool) {
+	if fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil() {
+		return nil, false
+	}
+	if valuer, ok := fieldValue.Interface().(AttrValuer); ok {
+		return valuer, true
+	}
+	if fieldValue.CanAddr() {
+		if valuer, ok := fieldValue.Addr().Interface().(AttrValuer); ok {
+			return valuer, true
+		}
+	}
+	return nil, false
+}
+
+// isSliceRef reports whether t is a pointer to a slice, for a has-many
+// relationship that may be absent.
+func isSliceRef(t reflect.Type) bool {
+	return t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Slice
+}
+
+// stringID returns the id of a primary field whose type implements
+// fmt.Stringer.
+func stringID(v reflect.Value) (string, bool) {
+	if !v.IsValid() {
+		return "", false
+	}
+	if s, ok := v.Interface().(fmt.Stringer); ok {
+		return s.String(), true
+	}
+	if v.CanAddr() {
+		if s, ok := v.Addr().Interface().(fmt.Stringer); ok {
+			return s.String(), true
+		}
+	}
+	return "", false
+}
+
 func toShallowNode(node *Node) *Node {
-	return &Node{
+	shallow := &Node{
 		ID:   node.ID,
 		Type: node.Type,
 	}
+	if node.ID == "" {
+		// resources that aren't persisted yet are referenced by local id
+		shallow.LID = node.LID
+	}
+	return shallow
+}
+
+// mapValues returns the values of a map with string keys as a slice, ordered
+// by key. A nil map gives a nil slice.
+func mapValues(m reflect.Value) (reflect.Value, error) {
+	if m.Type().Key().Kind() != reflect.String {
+		return reflect.Value{}, ErrBadJSONAPIStructTag
+	}
+
+	values := reflect.Zero(reflect.SliceOf(m.Type().Elem()))
+	if m.IsNil() {
+		return values, nil
+	}
+
+	keys := m.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	values = reflect.MakeSlice(values.Type(), 0, len(keys))
+	for _, k := range keys {
+		values = reflect.Append(values, m.MapIndex(k))
+	}
+	return values, nil
 }
 
 func visitModelNodeRelationships(models reflect.Value, included *map[string]*Node,
-	sideload bool) (*RelationshipManyNode, error) {
+	sideload bool, options *MarshalOptions) (*RelationshipManyNode, error) {
 	nodes := []*Node{}
 
 	for i := 0; i < models.Len(); i++ {
 		n := models.Index(i).Interface()
 
-		node, err := visitModelNode(n, included, sideload)
+		node, err := visitModelNode(n, included, sideload, options)
 		if err != nil {
 			return nil, err
 		}
@@ -647,7 +2555,7 @@ func appendIncluded(m *map[string]*Node, nodes ...*Node) {
 	included := *m
 
 	for _, n := range nodes {
-		k := fmt.Sprintf("%s,%s", n.Type, n.ID)
+		k := n.key()
 
 		if _, hasNode := included[k]; hasNode {
 			continue
@@ -659,12 +2567,12 @@ func appendIncluded(m *map[string]*Node, nodes ...*Node) {
 
 func nodeMapValues(m *map[string]*Node) []*Node {
 	mp := *m
-	nodes := make([]*Node, len(mp))
+	nodes := make([]*Node, 0, len(mp))
 
-	i := 0
 	for _, n := range mp {
-		nodes[i] = n
-		i++
+		if n != nil {
+			nodes = append(nodes, n)
+		}
 	}
 
 	return nodes
@@ -681,3 +2589,10 @@ func convertToSliceInterface(i *interface{}) ([]interface{}, error) {
 	}
 	return response, nil
 }
+
+// isSingleArgAnnotation reports whether the annotation is used on its own,
+// without a name argument.
+func isSingleArgAnnotation(annotation string) bool {
+	return annotation == annotationClientID || annotation == annotationLID ||
+		annotation == annotationRelationMap || annotation == annotationAttrExtra
+}
@@ -2,10 +2,14 @@ package jsonapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -1023,3 +1027,2180 @@ func testBlog() *Blog {
 		},
 	}
 }
+
+func TestMarshalRelationMap(t *testing.T) {
+	type Metric struct {
+		ID         string                 `jsonapi:"primary,metrics"`
+		Name       string                 `jsonapi:"attr,name"`
+		Dimensions map[string]interface{} `jsonapi:"relation-map"`
+	}
+
+	metric := &Metric{
+		ID:   "1",
+		Name: "requests",
+		Dimensions: map[string]interface{}{
+			"dimension-region":   []*Node{{Type: "regions", ID: "eu"}},
+			"dimension-comments": []*Comment{{ID: 1, Body: "foo"}, {ID: 2, Body: "bar"}},
+			"dimension-post":     &Post{ID: 3, Title: "baz"},
+			"dimension-empty":    nil,
+		},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, metric); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	relationships := resp.Data.Relationships
+	if e, a := 4, len(relationships); e != a {
+		t.Fatalf("Was expecting %d relationships, got %d", e, a)
+	}
+
+	region := relationships["dimension-region"].(map[string]interface{})["data"].([]interface{})
+	if e, a := "regions", region[0].(map[string]interface{})["type"]; e != a {
+		t.Fatalf("Was expecting linkage type %q, got %q", e, a)
+	}
+
+	comments := relationships["dimension-comments"].(map[string]interface{})["data"].([]interface{})
+	if e, a := 2, len(comments); e != a {
+		t.Fatalf("Was expecting %d comments, got %d", e, a)
+	}
+
+	post := relationships["dimension-post"].(map[string]interface{})["data"].(map[string]interface{})
+	if e, a := "3", post["id"]; e != a {
+		t.Fatalf("Was expecting post id %q, got %q", e, a)
+	}
+
+	if data := relationships["dimension-empty"].(map[string]interface{})["data"]; data != nil {
+		t.Fatalf("Was expecting null linkage, got %v", data)
+	}
+
+	// the comments and the post are sideloaded, the region node is not
+	if e, a := 3, len(resp.Included); e != a {
+		t.Fatalf("Was expecting %d included resources, got %d", e, a)
+	}
+}
+
+func TestMarshalRelationMap_invalidValue(t *testing.T) {
+	type Metric struct {
+		ID         string                 `jsonapi:"primary,metrics"`
+		Dimensions map[string]interface{} `jsonapi:"relation-map"`
+	}
+
+	metric := &Metric{ID: "1", Dimensions: map[string]interface{}{"dimension-bad": 5}}
+	if err := MarshalPayload(bytes.NewBuffer(nil), metric); err != ErrInvalidRelationMap {
+		t.Fatalf("Was expecting %v, got %v", ErrInvalidRelationMap, err)
+	}
+
+	type Gauge struct {
+		ID        string `jsonapi:"primary,gauges"`
+		Dimension int    `jsonapi:"relation-map"`
+	}
+
+	if err := MarshalPayload(bytes.NewBuffer(nil), &Gauge{ID: "1", Dimension: 5}); err != ErrBadJSONAPIStructTag {
+		t.Fatalf("Was expecting %v, got %v", ErrBadJSONAPIStructTag, err)
+	}
+}
+
+func TestMarshalRelationMap_null(t *testing.T) {
+	dashboard := &Dashboard{
+		ID: "1",
+		Widgets: map[string]interface{}{
+			"widget-nodes": []*Node{{Type: "widgets", ID: "1"}, nil},
+			"widget-node":  (*Node)(nil),
+			"widget-post":  (*Post)(nil),
+			"widget-none":  nil,
+		},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, dashboard); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := resp.Data.Relationships["widget-nodes"].(map[string]interface{})["data"].([]interface{})
+	if e, a := 1, len(nodes); e != a {
+		t.Fatalf("Was expecting %d linkage objects, got %d", e, a)
+	}
+
+	// null relationships keep their links
+	for _, name := range []string{"widget-node", "widget-post", "widget-none"} {
+		relationship := resp.Data.Relationships[name].(map[string]interface{})
+		if data, ok := relationship["data"]; !ok || data != nil {
+			t.Fatalf("Was expecting null linkage for %s, got %v", name, data)
+		}
+		links, _ := relationship["links"].(map[string]interface{})
+		if e, a := "https://example.com/api/dashboards/1/"+name, links["related"]; e != a {
+			t.Fatalf("Was expecting the related link %q for %s, got %v", e, name, a)
+		}
+	}
+}
+
+func TestMarshalEmptyHasMany(t *testing.T) {
+	type BlogEmptyHasMany struct {
+		ID          int        `jsonapi:"primary,blogs"`
+		Omitted     []*Post    `jsonapi:"relation,omitted,emptyhasmany=omit"`
+		Empty       []*Post    `jsonapi:"relation,empty,emptyhasmany=empty"`
+		NilOmitted  []*Comment `jsonapi:"relation,nil_omitted,omitempty,emptyhasmany=empty"`
+		EmptyKept   []*Comment `jsonapi:"relation,empty_kept,omitempty,emptyhasmany=empty"`
+		NotEmptyYet []*Comment `jsonapi:"relation,not_empty_yet,emptyhasmany=omit"`
+	}
+
+	blog := &BlogEmptyHasMany{
+		ID:          1,
+		Omitted:     []*Post{},
+		EmptyKept:   []*Comment{},
+		NotEmptyYet: []*Comment{{ID: 1}},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, blog); err != nil {
+		t.Fatal(err)
+	}
+
+	var jsonData map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &jsonData); err != nil {
+		t.Fatal(err)
+	}
+	relationships := jsonData["data"].(map[string]interface{})["relationships"].(map[string]interface{})
+
+	for _, name := range []string{"omitted", "nil_omitted"} {
+		if _, ok := relationships[name]; ok {
+			t.Fatalf("Was expecting the %s relationship to be omitted", name)
+		}
+	}
+	for _, name := range []string{"empty", "empty_kept"} {
+		rel, ok := relationships[name]
+		if !ok {
+			t.Fatalf("Was expecting the %s relationship to be present", name)
+		}
+		if data := rel.(map[string]interface{})["data"].([]interface{}); len(data) != 0 {
+			t.Fatalf("Was expecting the %s relationship data to be empty, got %v", name, data)
+		}
+	}
+	if _, ok := relationships["not_empty_yet"]; !ok {
+		t.Fatal("Was expecting the not_empty_yet relationship to be present")
+	}
+}
+
+func TestMarshalEmptyHasMany_invalidMode(t *testing.T) {
+	type BlogBadEmptyHasMany struct {
+		ID    int     `jsonapi:"primary,blogs"`
+		Posts []*Post `jsonapi:"relation,posts,emptyhasmany=sometimes"`
+	}
+
+	if err := MarshalPayload(bytes.NewBuffer(nil), &BlogBadEmptyHasMany{ID: 1}); err != ErrBadJSONAPIStructTag {
+		t.Fatalf("Was expecting %v, got %v", ErrBadJSONAPIStructTag, err)
+	}
+
+	// the mode is checked whether or not the slice is empty
+	blog := &BlogBadEmptyHasMany{ID: 1, Posts: []*Post{{ID: 1}}}
+	if err := MarshalPayload(bytes.NewBuffer(nil), blog); err != ErrBadJSONAPIStructTag {
+		t.Fatalf("Was expecting %v for a non-empty slice, got %v", ErrBadJSONAPIStructTag, err)
+	}
+}
+
+func TestMarshalRelationMaxLinkage(t *testing.T) {
+	type CappedPost struct {
+		ID       uint64     `jsonapi:"primary,posts"`
+		Comments []*Comment `jsonapi:"relation,comments,max=2"`
+		Related  []*Post    `jsonapi:"relation,related,max=2"`
+	}
+
+	post := &CappedPost{
+		ID:       1,
+		Comments: []*Comment{{ID: 1}, {ID: 2}, {ID: 3}},
+		Related:  []*Post{{ID: 2}},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, post); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	comments := resp.Data.Relationships["comments"].(map[string]interface{})
+	if e, a := 2, len(comments["data"].([]interface{})); e != a {
+		t.Fatalf("Was expecting %d comments in the linkage, got %d", e, a)
+	}
+	if e, a := true, comments["meta"].(map[string]interface{})[MetaKeyHasMore]; e != a {
+		t.Fatalf("Was expecting meta.%s to be %v, got %v", MetaKeyHasMore, e, a)
+	}
+
+	related := resp.Data.Relationships["related"].(map[string]interface{})
+	if _, ok := related["meta"]; ok {
+		t.Fatal("Was not expecting meta on a relationship below its max")
+	}
+
+	// only the linked comments and the related post are sideloaded
+	if e, a := 3, len(resp.Included); e != a {
+		t.Fatalf("Was expecting %d included resources, got %d", e, a)
+	}
+}
+
+func TestMarshalRelationMaxLinkage_invalid(t *testing.T) {
+	type zeroMax struct {
+		ID       uint64     `jsonapi:"primary,posts"`
+		Comments []*Comment `jsonapi:"relation,comments,max=0"`
+	}
+	type negativeMax struct {
+		ID       uint64     `jsonapi:"primary,posts"`
+		Comments []*Comment `jsonapi:"relation,comments,max=-1"`
+	}
+
+	for _, model := range []interface{}{&zeroMax{ID: 1}, &negativeMax{ID: 1}} {
+		if _, err := Marshal(model); err != ErrBadJSONAPIStructTag {
+			t.Fatalf("Was expecting %v for %T, got %v", ErrBadJSONAPIStructTag, model, err)
+		}
+	}
+}
+
+func TestMarshalMetaField(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, &VersionedPost{ID: 1, Title: "Post", Version: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := *resp.Data.Meta
+	if e, a := float64(7), meta["version"]; e != a {
+		t.Fatalf("Was expecting meta.version %v, got %v", e, a)
+	}
+	if e, a := "extra details regarding the post", meta["detail"]; e != a {
+		t.Fatalf("Was expecting meta.detail %q, got %v", e, a)
+	}
+	if _, ok := meta["etag"]; ok {
+		t.Fatal("Was expecting the empty meta.etag to be omitted")
+	}
+}
+
+func TestMarshalWithOptions_dropNulls(t *testing.T) {
+	book := &Book{ID: 1, Author: "aren55555"}
+
+	for _, dropNulls := range []bool{false, true} {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayloadWithOptions(out, book, MarshalOptions{DropNulls: dropNulls}); err != nil {
+			t.Fatal(err)
+		}
+
+		var jsonData map[string]interface{}
+		if err := json.Unmarshal(out.Bytes(), &jsonData); err != nil {
+			t.Fatal(err)
+		}
+		attributes := jsonData["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+
+		// description is a nil *string and tags a nil []string
+		for _, key := range []string{"description", "tags"} {
+			if _, ok := attributes[key]; ok == dropNulls {
+				t.Fatalf("With DropNulls %v, was expecting attribute %s present to be %v", dropNulls, key, !dropNulls)
+			}
+		}
+		if e, a := "aren55555", attributes["author"]; e != a {
+			t.Fatalf("Was expecting author %q, got %v", e, a)
+		}
+		// omitempty is still honoured
+		if _, ok := attributes["pages"]; ok {
+			t.Fatal("Was expecting the omitempty pages attribute to be omitted")
+		}
+	}
+}
+
+func TestMarshalWithOptions_autoSelfLinks(t *testing.T) {
+	payload, err := MarshalWithOptions(testBlog(), MarshalOptions{
+		AutoSelfLinks: "https://other.example/v2/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	one := payload.(*OnePayload)
+	// Blog implements Linkable
+	if e, a := "https://example.com/api/blogs/"+one.Data.ID, (*one.Data.Links)[KeySelfLink]; e != a {
+		t.Fatalf("Was expecting the Linkable self link %q, got %v", e, a)
+	}
+
+	comments := 0
+	for _, n := range one.Included {
+		if n.Type != "comments" {
+			continue
+		}
+		comments++
+		if e, a := "https://other.example/v2/comments/"+n.ID, (*n.Links)[KeySelfLink]; e != a {
+			t.Fatalf("Was expecting self link %q, got %v", e, a)
+		}
+	}
+	if comments == 0 {
+		t.Fatal("Was expecting included comments")
+	}
+}
+
+func TestMarshalWithOptions_orderIncludedByTraversal(t *testing.T) {
+	type Article struct {
+		ID     int        `jsonapi:"primary,articles"`
+		Writer *Post      `jsonapi:"relation,writer"`
+		Notes  []*Comment `jsonapi:"relation,notes"`
+	}
+
+	article := &Article{
+		ID:     1,
+		Writer: &Post{ID: 9, Comments: []*Comment{{ID: 5}}},
+		Notes:  []*Comment{{ID: 2}, {ID: 1}},
+	}
+
+	payload, err := MarshalWithOptions(article, MarshalOptions{OrderIncludedByTraversal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actual []string
+	for _, n := range payload.(*OnePayload).Included {
+		actual = append(actual, n.Type+","+n.ID)
+	}
+	expected := []string{"posts,9", "comments,5", "comments,2", "comments,1"}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("Was expecting included in order %v, got %v", expected, actual)
+	}
+}
+
+func TestMarshalAttrValuer(t *testing.T) {
+	invoice := &Invoice{
+		ID:       "1",
+		Total:    Money{1234, "EUR"},
+		Discount: &Money{100, "EUR"},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, invoice); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "1234 EUR", resp.Data.Attributes["total"]; e != a {
+		t.Fatalf("Was expecting total %q, got %v", e, a)
+	}
+	if e, a := "100 EUR", resp.Data.Attributes["discount"]; e != a {
+		t.Fatalf("Was expecting discount %q, got %v", e, a)
+	}
+
+	invoice.Total = Money{Cents: 1}
+	if err := MarshalPayload(bytes.NewBuffer(nil), invoice); err == nil {
+		t.Fatal("Was expecting the AttrValuer error to be returned")
+	}
+}
+
+func TestMarshalTypeable(t *testing.T) {
+	fleet := &Vehicle{ID: "9", Kind: "fleets"}
+	vehicles := []interface{}{
+		&Vehicle{ID: "1", Kind: "cars", Wheels: 4, Owner: fleet},
+		&Vehicle{ID: "2", Kind: "trucks", Wheels: 6, Owner: fleet},
+		&Vehicle{ID: "3", Wheels: 2},
+	}
+
+	payload, err := Marshal(vehicles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	many := payload.(*ManyPayload)
+
+	for i, expected := range []string{"cars", "trucks", "vehicles"} {
+		if a := many.Data[i].Type; a != expected {
+			t.Fatalf("Was expecting data[%d] of type %q, got %q", i, expected, a)
+		}
+	}
+
+	owner := many.Data[0].Relationships["owner"].(*RelationshipOneNode)
+	if e, a := "fleets", owner.Data.Type; e != a {
+		t.Fatalf("Was expecting the owner linkage of type %q, got %q", e, a)
+	}
+	if e, a := 1, len(many.Included); e != a {
+		t.Fatalf("Was expecting %d included resource, got %d", e, a)
+	}
+	if e, a := "fleets", many.Included[0].Type; e != a {
+		t.Fatalf("Was expecting the included owner of type %q, got %q", e, a)
+	}
+}
+
+func TestMarshalTypeable_nestedIncludes(t *testing.T) {
+	company := &Vehicle{ID: "1", Kind: "companies"}
+	fleet := &Vehicle{ID: "9", Kind: "fleets", Owner: company}
+	car := &Vehicle{ID: "1", Kind: "cars", Owner: fleet}
+
+	payload, err := MarshalWithOptions(car, MarshalOptions{
+		IncludeRelationPaths: []string{"owner.owner"},
+		Fields:               map[string][]string{"fleets": {"owner"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := payload.(*OnePayload)
+
+	var types []string
+	for _, n := range one.Included {
+		types = append(types, n.Type)
+	}
+	if e, a := []string{"companies", "fleets"}, types; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting included types %v, got %v", e, a)
+	}
+
+	// linkage types match the types of the included resources
+	included := map[string]*Node{}
+	for _, n := range one.Included {
+		included[n.key()] = n
+	}
+	for _, n := range append([]*Node{one.Data}, one.Included...) {
+		owner, ok := n.Relationships["owner"].(*RelationshipOneNode)
+		if !ok || owner.Data == nil {
+			continue
+		}
+		if _, ok := included[owner.Data.key()]; !ok {
+			t.Fatalf("Was expecting the %s owner linkage %s to be included", n.Type, owner.Data.key())
+		}
+	}
+
+	if one.Included[1].Relationships["owner"] == nil {
+		t.Fatal("Was expecting the fleets fieldset to keep the owner relationship")
+	}
+}
+
+func TestMarshalMetaDocument(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalMetaDocument(out, &Meta{"uptime": 42}); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := `{"meta":{"uptime":42}}`+"\n", out.String(); e != a {
+		t.Fatalf("Was expecting %s, got %s", e, a)
+	}
+}
+
+func TestMarshalPayloadOmitType(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadOmitType(out, testBlog()); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out.String(), `"type"`) {
+		t.Fatalf("Was not expecting any type member, got %s", out.String())
+	}
+
+	var jsonData map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &jsonData); err != nil {
+		t.Fatal(err)
+	}
+	data := jsonData["data"].(map[string]interface{})
+	if e, a := "5", data["id"]; e != a {
+		t.Fatalf("Was expecting id %q, got %v", e, a)
+	}
+	if e, a := float64(0), data["attributes"].(map[string]interface{})["view_count"]; e != a {
+		t.Fatalf("Was expecting view_count %v, got %v", e, a)
+	}
+	if _, ok := jsonData["included"]; !ok {
+		t.Fatal("Was expecting the included resources")
+	}
+}
+
+func TestMarshalAttributePrecision(t *testing.T) {
+	a, b := 0.1, 0.2
+	ratio := float32(0.26)
+	rate := &Rate{ID: "1", Rate: a + b, Ratio: &ratio, Raw: a + b}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, rate); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []string{`"rate":0.30`, `"ratio":0.3`, `"factor":null`, `"raw":0.30000000000000004`} {
+		if !strings.Contains(out.String(), e) {
+			t.Fatalf("Was expecting %s in %s", e, out.String())
+		}
+	}
+
+	decoded := new(Rate)
+	if err := UnmarshalPayload(out, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 0.3, decoded.Rate; e != a {
+		t.Fatalf("Was expecting rate %v, got %v", e, a)
+	}
+}
+
+func TestMarshalAttributePrecision_invalid(t *testing.T) {
+	type badPrecision struct {
+		ID   string  `jsonapi:"primary,rates"`
+		Rate float64 `jsonapi:"attr,rate,precision=two"`
+	}
+
+	if _, err := Marshal(&badPrecision{ID: "1"}); err != ErrBadJSONAPIStructTag {
+		t.Fatalf("Was expecting ErrBadJSONAPIStructTag, got %v", err)
+	}
+}
+
+func TestMarshalAttributePrecision_nonFinite(t *testing.T) {
+	inf := math.Inf(1)
+
+	for _, rate := range []*Rate{
+		{ID: "1", Rate: math.NaN()},
+		{ID: "1", Factor: &inf},
+	} {
+		var nonFinite *ErrNonFiniteFloat
+		if err := MarshalPayload(bytes.NewBuffer(nil), rate); !errors.As(err, &nonFinite) {
+			t.Fatalf("Was expecting an *ErrNonFiniteFloat, got %v", err)
+		}
+	}
+}
+
+func TestMarshalLocalIDs(t *testing.T) {
+	parent := &Task{LID: "a", Title: "Parent"}
+	persisted := &Task{ID: "7", LID: "ignored", Title: "Persisted"}
+	child := &Task{LID: "b", Title: "Child", Parent: parent}
+	parent.Subtasks = []*Task{persisted}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, []*Task{parent, child}); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload struct {
+		Data []struct {
+			ID            string                     `json:"id"`
+			LID           string                     `json:"lid"`
+			Relationships map[string]json.RawMessage `json:"relationships"`
+		} `json:"data"`
+		Included []*Node `json:"included"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := "a", payload.Data[0].LID; e != a {
+		t.Fatalf("Was expecting lid %q, got %q", e, a)
+	}
+	if e, a := `{"data":{"type":"tasks","lid":"a"}}`, string(payload.Data[1].Relationships["parent"]); e != a {
+		t.Fatalf("Was expecting the parent linkage %s, got %s", e, a)
+	}
+	if e, a := `{"data":[{"type":"tasks","id":"7"}]}`, string(payload.Data[0].Relationships["subtasks"]); e != a {
+		t.Fatalf("Was expecting the subtasks linkage %s, got %s", e, a)
+	}
+
+	// the parent is sideloaded once by its lid, next to the persisted task
+	if e, a := 2, len(payload.Included); e != a {
+		t.Fatalf("Was expecting %d included resources, got %d", e, a)
+	}
+}
+
+func TestMarshalToOneWithoutID(t *testing.T) {
+	task := &Task{ID: "1", Title: "Child", Parent: &Task{Title: "Unsaved"}}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, task); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload struct {
+		Data struct {
+			Relationships map[string]json.RawMessage `json:"relationships"`
+		} `json:"data"`
+		Included []*Node `json:"included"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := `{"data":null}`, string(payload.Data.Relationships["parent"]); e != a {
+		t.Fatalf("Was expecting the parent linkage %s, got %s", e, a)
+	}
+	if len(payload.Included) != 0 {
+		t.Fatalf("Was expecting no included resources, got %d", len(payload.Included))
+	}
+}
+
+func TestMarshalToOneWithoutID_embedded(t *testing.T) {
+	task := &Task{ID: "1", Title: "Child", Parent: &Task{Title: "Unsaved"}}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalOnePayloadEmbedded(out, task); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+
+	parent, ok := payload.Data.Relationships["parent"].(map[string]interface{})["data"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Was expecting the new parent to be embedded, got %v", payload.Data.Relationships["parent"])
+	}
+	if e, a := "Unsaved", parent["attributes"].(map[string]interface{})["title"]; e != a {
+		t.Fatalf("Was expecting the embedded parent title %q, got %v", e, a)
+	}
+}
+
+func TestMarshalMerged(t *testing.T) {
+	post := &Post{ID: 1, Title: "Base", Body: "Body"}
+	stats := &PostStats{Views: 42, Title: "Overlay", LatestComment: &Comment{ID: 3, Body: "Latest"}}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalMerged(out, "posts", "1", post, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := "posts", payload.Data.Type; e != a {
+		t.Fatalf("Was expecting type %q, got %q", e, a)
+	}
+	if e, a := "1", payload.Data.ID; e != a {
+		t.Fatalf("Was expecting id %q, got %q", e, a)
+	}
+	for k, e := range map[string]interface{}{"body": "Body", "views": float64(42), "title": "Overlay"} {
+		if a := payload.Data.Attributes[k]; e != a {
+			t.Fatalf("Was expecting attribute %s to be %v, got %v", k, e, a)
+		}
+	}
+	if _, ok := payload.Data.Relationships["latest_comment"]; !ok {
+		t.Fatal("Was expecting the latest_comment relationship of the overlay")
+	}
+	if e, a := 1, len(payload.Included); e != a {
+		t.Fatalf("Was expecting %d included resources, got %d", e, a)
+	}
+}
+
+func TestMarshalMerged_conflictingID(t *testing.T) {
+	err := MarshalMerged(bytes.NewBuffer(nil), "posts", "1", &Post{ID: 1}, &Post{ID: 2})
+	if err != ErrConflictingMergedID {
+		t.Fatalf("Was expecting ErrConflictingMergedID, got %v", err)
+	}
+}
+
+func TestMarshalMerged_conflictingType(t *testing.T) {
+	err := MarshalMerged(bytes.NewBuffer(nil), "posts", "1", &Post{ID: 1}, &Comment{ID: 1})
+	if err != ErrConflictingMergedType {
+		t.Fatalf("Was expecting ErrConflictingMergedType, got %v", err)
+	}
+}
+
+func TestMarshalEmptyMeta(t *testing.T) {
+	tag := &Tag{ID: "1", Name: "go"}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, tag); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), `"meta"`) {
+		t.Fatalf("Was expecting the empty meta to be omitted, got %s", out.String())
+	}
+
+	out.Reset()
+	if err := MarshalPayloadWithOptions(out, tag, MarshalOptions{EmitEmptyMeta: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"meta":{}`) {
+		t.Fatalf("Was expecting an empty meta object, got %s", out.String())
+	}
+}
+
+func TestMarshalPayloadWithIncludeFilter(t *testing.T) {
+	dropPost2 := func(n *Node) bool {
+		return !(n.Type == "posts" && n.ID == "2")
+	}
+
+	for _, includes := range [][]string{nil, {"posts.comments"}} {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayloadWithIncludeFilter(out, testBlog(), includes, dropPost2); err != nil {
+			t.Fatal(err)
+		}
+
+		payload := new(OnePayload)
+		if err := json.NewDecoder(out).Decode(payload); err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		for _, n := range payload.Included {
+			keys = append(keys, n.Type+","+n.ID)
+		}
+		sort.Strings(keys)
+
+		// comment 3 is only reachable through post 2
+		if e, a := []string{"comments,1", "comments,2", "posts,1"}, keys; !reflect.DeepEqual(e, a) {
+			t.Fatalf("With includes %v, was expecting included %v, got %v", includes, e, a)
+		}
+	}
+}
+
+func TestMarshalPayloadWithAttrNames(t *testing.T) {
+	rename := map[string]map[string]string{
+		"posts":    {"title": "headline", "body": "title"},
+		"comments": {"body": "text"},
+	}
+	post := &Post{ID: 1, Title: "Headline", Body: "Text", Comments: []*Comment{{ID: 2, Body: "Comment"}}}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithAttrNames(out, post, rename); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "Headline", payload.Data.Attributes["headline"]; e != a {
+		t.Fatalf("Was expecting headline %q, got %v", e, a)
+	}
+	if e, a := "Text", payload.Data.Attributes["title"]; e != a {
+		t.Fatalf("Was expecting title %q, got %v", e, a)
+	}
+	if e, a := "Comment", payload.Included[0].Attributes["text"]; e != a {
+		t.Fatalf("Was expecting the included comment text %q, got %v", e, a)
+	}
+
+	decoded := new(Post)
+	if err := UnmarshalPayloadWithAttrNames(bytes.NewReader(out.Bytes()), decoded, rename); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Title != post.Title || decoded.Body != post.Body {
+		t.Fatalf("Was expecting title %q and body %q, got %q and %q", post.Title, post.Body, decoded.Title, decoded.Body)
+	}
+	if e, a := "Comment", decoded.Comments[0].Body; e != a {
+		t.Fatalf("Was expecting the comment body %q, got %q", e, a)
+	}
+}
+
+func TestMarshalKeyNamer(t *testing.T) {
+	blog := testBlog()
+	blog.CurrentPostID, blog.ViewCount = 2, 1000
+	payload, err := MarshalWithOptions(blog, MarshalOptions{
+		KeyNamer:  CamelizeKeys,
+		AttrNames: map[string]map[string]string{"blogs": {"view_count": "views"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := payload.(*OnePayload).Data
+	for _, name := range []string{"title", "createdAt", "currentPostId", "views"} {
+		if _, ok := data.Attributes[name]; !ok {
+			t.Fatalf("Was expecting the attribute %q, got %v", name, data.Attributes)
+		}
+	}
+	if _, ok := data.Relationships["currentPost"]; !ok {
+		t.Fatalf("Was expecting the currentPost relationship, got %v", data.Relationships)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(out).Encode(payload); err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(Blog)
+	if err := UnmarshalPayloadWithOptions(out, decoded, UnmarshalOptions{
+		KeyNamer:  CamelizeKeys,
+		AttrNames: map[string]map[string]string{"blogs": {"view_count": "views"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.CurrentPostID != blog.CurrentPostID || decoded.ViewCount != blog.ViewCount {
+		t.Fatalf("Was expecting the renamed attributes to be read back, got %+v", decoded)
+	}
+	if decoded.CurrentPost == nil || decoded.CurrentPost.ID != blog.CurrentPost.ID {
+		t.Fatalf("Was expecting the current post %d, got %v", blog.CurrentPost.ID, decoded.CurrentPost)
+	}
+}
+
+func TestMarshalPayloadWithFieldsets(t *testing.T) {
+	fields := map[string][]string{
+		"blogs":    {"title", "posts"},
+		"posts":    {},
+		"comments": {"body"},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithFieldsets(out, []*Blog{testBlog()}, fields); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(ManyPayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+
+	blog := payload.Data[0]
+	if len(blog.Attributes) != 1 || blog.Attributes["title"] != "Title 1" {
+		t.Fatalf("Was expecting only the title attribute, got %v", blog.Attributes)
+	}
+	if _, ok := blog.Relationships["posts"]; !ok || len(blog.Relationships) != 1 {
+		t.Fatalf("Was expecting only the posts relationship, got %v", blog.Relationships)
+	}
+
+	// included resources are filtered by their own type, and stay included
+	// even when the relationship leading to them is left out
+	var comments int
+	for _, n := range payload.Included {
+		switch n.Type {
+		case "posts":
+			if len(n.Attributes) != 0 || len(n.Relationships) != 0 || n.ID == "" {
+				t.Fatalf("Was expecting only the type and id of post %s, got %v and %v", n.ID, n.Attributes, n.Relationships)
+			}
+		case "comments":
+			comments++
+			if _, ok := n.Attributes["body"]; !ok || len(n.Attributes) != 1 {
+				t.Fatalf("Was expecting only the body of comment %s, got %v", n.ID, n.Attributes)
+			}
+		}
+	}
+	if comments == 0 {
+		t.Fatal("Was expecting the comments to be included")
+	}
+}
+
+func TestMarshalWithFieldsets_unlisted(t *testing.T) {
+	payload, err := MarshalWithFieldsets(testBlog(), map[string][]string{"comments": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blog := payload.(*OnePayload).Data
+	if e, a := 4, len(blog.Attributes); e != a {
+		t.Fatalf("Was expecting %d attributes for a type without a fieldset, got %d", e, a)
+	}
+}
+
+func TestMarshalPayloadWithTypeTransforms(t *testing.T) {
+	patient := &Patient{
+		ID:      "1",
+		Name:    "Jane",
+		SSN:     "123-45-6789",
+		Contact: &Patient{ID: "2", Name: "John", SSN: "987-65-4321"},
+	}
+	transforms := map[reflect.Type]func(interface{}) interface{}{
+		reflect.TypeOf(SSN("")): func(v interface{}) interface{} {
+			ssn := string(v.(SSN))
+			return "***-**-" + ssn[len(ssn)-4:]
+		},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithTypeTransforms(out, patient, transforms); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "***-**-6789", payload.Data.Attributes["ssn"]; e != a {
+		t.Fatalf("Was expecting the redacted ssn %q, got %v", e, a)
+	}
+	if e, a := "***-**-4321", payload.Included[0].Attributes["ssn"]; e != a {
+		t.Fatalf("Was expecting the included redacted ssn %q, got %v", e, a)
+	}
+	if e, a := "Jane", payload.Data.Attributes["name"]; e != a {
+		t.Fatalf("Was expecting the name %q untouched, got %v", e, a)
+	}
+	if _, ok := payload.Data.Attributes["spouse-ssn"]; ok {
+		t.Fatal("Was expecting the empty spouse-ssn to be omitted")
+	}
+}
+
+func TestMarshalPayloadWithTypeTransforms_allAttributes(t *testing.T) {
+	ssn := SSN("123-45-6789")
+	insured := &Insured{
+		ID:    "1",
+		SSN:   &ssn,
+		Extra: map[string]interface{}{"previous-ssn": SSN("777-88-9999")},
+	}
+	transforms := map[reflect.Type]func(interface{}) interface{}{
+		reflect.TypeOf(SSN("")): func(interface{}) interface{} { return "***" },
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithTypeTransforms(out, insured, transforms); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	for _, attr := range []string{"ssn", "holder-ssn", "beneficiary-ssn", "previous-ssn"} {
+		if e, a := "***", payload.Data.Attributes[attr]; e != a {
+			t.Fatalf("Was expecting the redacted %s %q, got %v", attr, e, a)
+		}
+	}
+	if a, ok := payload.Data.Attributes["partner-ssn"]; !ok || a != nil {
+		t.Fatalf("Was expecting a null partner-ssn, got %v", a)
+	}
+}
+
+func TestMarshalPayloadWithTypeTransforms_omitEmpty(t *testing.T) {
+	type household struct {
+		ID   string `jsonapi:"primary,households"`
+		SSNs []SSN  `jsonapi:"attr,ssns,omitempty"`
+	}
+	transforms := map[reflect.Type]func(interface{}) interface{}{
+		reflect.TypeOf([]SSN{}): func(interface{}) interface{} { return "***" },
+	}
+
+	// an empty slice is omitted like without a transform
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithTypeTransforms(out, &household{ID: "1", SSNs: []SSN{}}, transforms); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := payload.Data.Attributes["ssns"]; ok {
+		t.Fatalf("Was expecting the empty ssns to be omitted, got %v", a)
+	}
+}
+
+func TestMarshalMapRelation(t *testing.T) {
+	post := &IndexedPost{ID: "1", Title: "Indexed", Comments: map[string]*Comment{
+		"3": {ID: 3, Body: "Third"},
+		"1": {ID: 1, Body: "First"},
+		"2": {ID: 2, Body: "Second"},
+	}}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, post); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload struct {
+		Data struct {
+			Relationships map[string]json.RawMessage `json:"relationships"`
+		} `json:"data"`
+		Included []*Node `json:"included"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	e := `{"data":[{"type":"comments","id":"1"},{"type":"comments","id":"2"},{"type":"comments","id":"3"}]}`
+	if a := string(payload.Data.Relationships["comments"]); e != a {
+		t.Fatalf("Was expecting the linkage in key order %s, got %s", e, a)
+	}
+	if e, a := 3, len(payload.Included); e != a {
+		t.Fatalf("Was expecting %d included comments, got %d", e, a)
+	}
+}
+
+func TestMarshalMaxNodes(t *testing.T) {
+	// the blog, its 2 posts and their 3 comments
+	if _, err := MarshalWithOptions(testBlog(), MarshalOptions{MaxNodes: 6}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	err := MarshalPayloadWithOptions(out, testBlog(), MarshalOptions{MaxNodes: 5})
+	if err != ErrMaxNodesExceeded {
+		t.Fatalf("Was expecting ErrMaxNodesExceeded, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("Was expecting nothing to be written, got %s", out.String())
+	}
+
+	blogs := []*Blog{testBlog(), {ID: 6}, {ID: 7}}
+	if _, err := MarshalWithOptions(blogs, MarshalOptions{MaxNodes: 7}); err != ErrMaxNodesExceeded {
+		t.Fatalf("Was expecting ErrMaxNodesExceeded for many blogs, got %v", err)
+	}
+}
+
+func TestMarshalMaxNodes_filtered(t *testing.T) {
+	options := MarshalOptions{MaxNodes: 3, IncludeRelationPaths: []string{"posts"}}
+	if _, err := MarshalWithOptions(testBlog(), options); err != nil {
+		t.Fatalf("Was expecting only the included posts to count, got %v", err)
+	}
+
+	options.MaxNodes = 2
+	if _, err := MarshalWithOptions(testBlog(), options); err != ErrMaxNodesExceeded {
+		t.Fatalf("Was expecting ErrMaxNodesExceeded, got %v", err)
+	}
+}
+
+func TestMarshalOne(t *testing.T) {
+	expected := bytes.NewBuffer(nil)
+	if err := MarshalPayload(expected, testBlog()); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := MarshalOne(testBlog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(out).Encode(payload); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := expected.String(), out.String(); e != a {
+		t.Fatalf("Was expecting the MarshalPayload output %s, got %s", e, a)
+	}
+
+	if _, err := MarshalOne([]*Blog{testBlog()}); err != ErrUnexpectedType {
+		t.Fatalf("Was expecting ErrUnexpectedType, got %v", err)
+	}
+}
+
+func TestMarshalMany(t *testing.T) {
+	blogs := []*Blog{testBlog(), {ID: 6, Title: "Other"}}
+
+	expected := bytes.NewBuffer(nil)
+	if err := MarshalPayload(expected, blogs); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := MarshalMany(blogs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(out).Encode(payload); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := expected.String(), out.String(); e != a {
+		t.Fatalf("Was expecting the MarshalPayload output %s, got %s", e, a)
+	}
+
+	if _, err := MarshalMany(testBlog()); err != ErrExpectedSlice {
+		t.Fatalf("Was expecting ErrExpectedSlice, got %v", err)
+	}
+}
+
+func TestMarshalAttrOmitEmpty(t *testing.T) {
+	payload, err := Marshal(&Draft{ID: "1", Tags: []string{}, Labels: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := payload.(*OnePayload).Data.Attributes; len(a) != 0 {
+		t.Fatalf("Was expecting the empty attributes to be omitted, got %v", a)
+	}
+
+	zero := 0
+	saved := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	payload, err = Marshal(&Draft{ID: "1", Count: 2, Rating: &zero, DueAt: &time.Time{}, SavedAt: saved})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attributes := payload.(*OnePayload).Data.Attributes
+	if e, a := 2, attributes["count"]; e != a {
+		t.Fatalf("Was expecting count %v, got %v", e, a)
+	}
+	// set pointers are written, even to zero values
+	if e, a := &zero, attributes["rating"]; e != a {
+		t.Fatalf("Was expecting the rating pointer, got %v", a)
+	}
+	if e, a := "0001-01-01T00:00:00Z", attributes["due-at"]; e != a {
+		t.Fatalf("Was expecting due-at %q, got %v", e, a)
+	}
+	if e, a := "2020-01-02T03:04:05Z", attributes["saved-at"]; e != a {
+		t.Fatalf("Was expecting saved-at %q, got %v", e, a)
+	}
+	if e, a := 4, len(attributes); e != a {
+		t.Fatalf("Was expecting %d attributes, got %v", e, attributes)
+	}
+}
+
+func TestMarshalAutoTotalCount(t *testing.T) {
+	blogs := []*Blog{testBlog(), {ID: 6}, {ID: 7}}
+
+	payload, err := MarshalWithOptions(blogs, MarshalOptions{AutoTotalCount: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 3, (*payload.(*ManyPayload).Meta)[MetaKeyTotalCount]; e != a {
+		t.Fatalf("Was expecting a total count of %v, got %v", e, a)
+	}
+
+	// an explicit total count is kept, and the given meta isn't modified
+	meta := &Meta{MetaKeyTotalCount: 120, "page": 2}
+	payload, err = MarshalWithOptions(blogs, MarshalOptions{AutoTotalCount: true, Meta: meta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 120, (*payload.(*ManyPayload).Meta)[MetaKeyTotalCount]; e != a {
+		t.Fatalf("Was expecting the explicit total count %v, got %v", e, a)
+	}
+
+	meta = &Meta{"page": 1}
+	payload, err = MarshalWithOptions(blogs, MarshalOptions{AutoTotalCount: true, Meta: meta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 3, (*payload.(*ManyPayload).Meta)[MetaKeyTotalCount]; e != a {
+		t.Fatalf("Was expecting a total count of %v, got %v", e, a)
+	}
+	if _, ok := (*meta)[MetaKeyTotalCount]; ok {
+		t.Fatal("Was expecting the given meta to be left untouched")
+	}
+
+	one, err := MarshalWithOptions(testBlog(), MarshalOptions{AutoTotalCount: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := one.(*OnePayload).Meta; m != nil {
+		t.Fatalf("Was expecting no total count for a single resource, got %v", *m)
+	}
+}
+
+func TestMarshalJSONAPIObject(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, testBlog()); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), `"jsonapi"`) {
+		t.Fatalf("Was expecting no jsonapi member by default, got %s", out.String())
+	}
+
+	for _, models := range []interface{}{testBlog(), []*Blog{testBlog()}} {
+		out := bytes.NewBuffer(nil)
+		options := MarshalOptions{JSONAPI: &JSONAPIObject{Version: "1.1"}}
+		if err := MarshalPayloadWithOptions(out, models, options); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(out.String(), `{"jsonapi":{"version":"1.1"},"data":`) {
+			t.Fatalf("Was expecting the jsonapi member, got %s", out.String())
+		}
+
+		var payload struct {
+			JSONAPI *JSONAPIObject `json:"jsonapi"`
+		}
+		if err := json.Unmarshal(out.Bytes(), &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.JSONAPI == nil || payload.JSONAPI.Version != "1.1" {
+			t.Fatalf("Was expecting version 1.1, got %v", payload.JSONAPI)
+		}
+	}
+}
+
+func TestMarshalIncludedVia(t *testing.T) {
+	payload, err := MarshalWithOptions(testBlog(), MarshalOptions{IncludedVia: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	included := payload.(*OnePayload).Included
+	if e, a := 5, len(included); e != a {
+		t.Fatalf("Was expecting %d included resources, got %d", e, a)
+	}
+	for _, n := range included {
+		if n.Meta == nil {
+			t.Fatalf("Was expecting meta for %s %s", n.Type, n.ID)
+		}
+
+		expected := map[string]string{"posts": "posts", "comments": "posts.comments"}[n.Type]
+		if a := (*n.Meta)[MetaKeyIncludedVia]; expected != a {
+			t.Fatalf("Was expecting %s %s to be included via %q, got %v", n.Type, n.ID, expected, a)
+		}
+		// the meta of the model is kept
+		if _, ok := (*n.Meta)["detail"]; n.Type == "posts" && !ok {
+			t.Fatalf("Was expecting the meta of post %s to be kept, got %v", n.ID, *n.Meta)
+		}
+	}
+
+	if m := payload.(*OnePayload).Data.Meta; m != nil {
+		if _, ok := (*m)[MetaKeyIncludedVia]; ok {
+			t.Fatal("Was expecting no included-via path for the primary data")
+		}
+	}
+}
+
+func TestMarshalDeterministicOrder(t *testing.T) {
+	post := &Post{ID: 1, Comments: []*Comment{{ID: 3}, {ID: 1}, {ID: 2}}}
+	blog := &Blog{ID: 1, Posts: []*Post{post, {ID: 10}, {ID: 2}}, CurrentPost: post}
+
+	first := bytes.NewBuffer(nil)
+	if err := MarshalPayload(first, blog); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayload(out, blog); err != nil {
+			t.Fatal(err)
+		}
+		if e, a := first.String(), out.String(); e != a {
+			t.Fatalf("Was expecting identical output, got %s and %s", e, a)
+		}
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(first.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+
+	// included resources are sorted by type, then id
+	var included []string
+	for _, n := range payload.Included {
+		included = append(included, n.Type+","+n.ID)
+	}
+	e := "comments,1 comments,2 comments,3 posts,1 posts,10 posts,2"
+	if a := strings.Join(included, " "); e != a {
+		t.Fatalf("Was expecting the included order %q, got %q", e, a)
+	}
+
+	// has-many linkage keeps the order of the slice
+	var linkage []string
+	for _, n := range payload.Included[3].Relationships["comments"].(map[string]interface{})["data"].([]interface{}) {
+		linkage = append(linkage, n.(map[string]interface{})["id"].(string))
+	}
+	if e, a := "3 1 2", strings.Join(linkage, " "); e != a {
+		t.Fatalf("Was expecting the linkage order %q, got %q", e, a)
+	}
+}
+
+func TestMarshalOmitLinkage(t *testing.T) {
+	options := MarshalOptions{OmitLinkage: map[string][]string{"blogs": {"posts", "current_post"}}}
+	payload, err := MarshalWithOptions(testBlog(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blog := payload.(*OnePayload).Data
+	if len(blog.Relationships) != 0 {
+		t.Fatalf("Was expecting no blog relationships, got %v", blog.Relationships)
+	}
+
+	var posts int
+	for _, n := range payload.(*OnePayload).Included {
+		if n.Type == "posts" {
+			posts++
+			// other types keep their linkage
+			if _, ok := n.Relationships["comments"]; !ok {
+				t.Fatalf("Was expecting the comments linkage of post %s", n.ID)
+			}
+		}
+	}
+	if e, a := 2, posts; e != a {
+		t.Fatalf("Was expecting %d included posts, got %d", e, a)
+	}
+}
+
+func TestMarshalPayloadWithRESTLinks(t *testing.T) {
+	post := &Post{ID: 1, Comments: []*Comment{{ID: 2}}, LatestComment: &Comment{ID: 2}}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithRESTLinks(out, post, "https://api.example.com/"); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload struct {
+		Data struct {
+			Relationships map[string]struct {
+				Links map[string]string `json:"links"`
+			} `json:"relationships"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"comments", "latest_comment"} {
+		links := payload.Data.Relationships[name].Links
+		if e, a := "https://api.example.com/posts/1/relationships/"+name, links["self"]; e != a {
+			t.Fatalf("Was expecting the %s self link %q, got %q", name, e, a)
+		}
+		if e, a := "https://api.example.com/posts/1/"+name, links["related"]; e != a {
+			t.Fatalf("Was expecting the %s related link %q, got %q", name, e, a)
+		}
+	}
+}
+
+func TestMarshalRESTLinks_keepsRelationshipLinkable(t *testing.T) {
+	payload, err := MarshalWithOptions(testBlog(), MarshalOptions{RESTLinks: "https://api.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	posts := payload.(*OnePayload).Data.Relationships["posts"].(*RelationshipManyNode)
+	if _, ok := (*posts.Links)[KeySelfLink]; ok {
+		t.Fatalf("Was expecting the blog's own posts links, got %v", *posts.Links)
+	}
+}
+
+func TestMarshalCardinality(t *testing.T) {
+	post := &Post{ID: 1, Comments: []*Comment{{ID: 2}}, LatestComment: &Comment{ID: 3}}
+
+	payload, err := MarshalWithOptions(post, MarshalOptions{Cardinality: map[string]Cardinality{
+		"comments":       CardinalityOne,
+		"latest_comment": CardinalityMany,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relationships := payload.(*OnePayload).Data.Relationships
+	comments, ok := relationships["comments"].(*RelationshipOneNode)
+	if !ok {
+		t.Fatalf("Was expecting comments as a to-one relationship, got %T", relationships["comments"])
+	}
+	if e, a := "2", comments.Data.ID; e != a {
+		t.Fatalf("Was expecting comment %q, got %q", e, a)
+	}
+	latest, ok := relationships["latest_comment"].(*RelationshipManyNode)
+	if !ok {
+		t.Fatalf("Was expecting latest_comment as a to-many relationship, got %T", relationships["latest_comment"])
+	}
+	if len(latest.Data) != 1 || latest.Data[0].ID != "3" {
+		t.Fatalf("Was expecting latest_comment to hold comment 3, got %v", latest.Data)
+	}
+
+	empty, err := MarshalWithOptions(&Post{ID: 1}, MarshalOptions{Cardinality: map[string]Cardinality{
+		"comments":       CardinalityOne,
+		"latest_comment": CardinalityMany,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relationships = empty.(*OnePayload).Data.Relationships
+	if data := relationships["comments"].(*RelationshipOneNode).Data; data != nil {
+		t.Fatalf("Was expecting null comments, got %v", data)
+	}
+	if data := relationships["latest_comment"].(*RelationshipManyNode).Data; len(data) != 0 {
+		t.Fatalf("Was expecting no latest_comment, got %v", data)
+	}
+}
+
+func TestMarshalCardinality_selector(t *testing.T) {
+	post := &Post{ID: 1, Comments: []*Comment{{ID: 2}, {ID: 5}}}
+	options := MarshalOptions{Cardinality: map[string]Cardinality{"comments": CardinalityOne}}
+
+	_, err := MarshalWithOptions(post, options)
+	if e, ok := err.(*ErrCardinality); !ok || e.Relation != "comments" || e.Len != 2 {
+		t.Fatalf("Was expecting an *ErrCardinality for comments, got %v", err)
+	}
+
+	options.CardinalitySelector = func(relation string, models interface{}) interface{} {
+		comments := models.([]*Comment)
+		return comments[len(comments)-1]
+	}
+	payload, err := MarshalWithOptions(post, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comments := payload.(*OnePayload).Data.Relationships["comments"].(*RelationshipOneNode)
+	if e, a := "5", comments.Data.ID; e != a {
+		t.Fatalf("Was expecting the selected comment %q, got %q", e, a)
+	}
+	if e, a := 1, len(payload.(*OnePayload).Included); e != a {
+		t.Fatalf("Was expecting %d included resource, got %d", e, a)
+	}
+}
+
+func TestMarshalPayloadContext(t *testing.T) {
+	profile := &Profile{ID: "1", Email: "me@example.com", Friends: []*Profile{{ID: "2", Email: "friend@example.com"}}}
+	ctx := context.WithValue(context.Background(), viewerKey{}, "1")
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadContext(ctx, out, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "me@example.com", payload.Data.Attributes["email"]; e != a {
+		t.Fatalf("Was expecting the viewer's email %q, got %v", e, a)
+	}
+	if len(payload.Included) != 1 {
+		t.Fatalf("Was expecting 1 included profile, got %d", len(payload.Included))
+	}
+	if email, ok := payload.Included[0].Attributes["email"]; ok {
+		t.Fatalf("Was expecting the friend's email to be redacted, got %v", email)
+	}
+}
+
+func TestMarshalPayloadContext_errors(t *testing.T) {
+	profile := &Profile{ID: "1", Friends: []*Profile{{}}}
+
+	out := bytes.NewBuffer(nil)
+	err := MarshalPayloadContext(context.Background(), out, profile)
+	if err == nil || err.Error() != "profile without id" {
+		t.Fatalf("Was expecting the hook error, got %v", err)
+	}
+	if out.Len() > 0 {
+		t.Fatalf("Was not expecting any output, got %s", out.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := MarshalPayloadContext(ctx, out, &Profile{ID: "1"}); err != context.Canceled {
+		t.Fatalf("Was expecting %v, got %v", context.Canceled, err)
+	}
+
+	// without a context, hooks aren't called
+	if err := MarshalPayload(out, profile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMarshalEmptyStringAsNull(t *testing.T) {
+	empty := ""
+	contact := &Contact{ID: "1", Nickname: &empty, Phone: "555-0100"}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithOptions(out, contact, MarshalOptions{EmptyStringAsNull: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload struct {
+		Data struct {
+			Attributes map[string]interface{} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+	attrs := payload.Data.Attributes
+
+	for _, name := range []string{"name", "nickname"} {
+		if v, ok := attrs[name]; !ok || v != nil {
+			t.Fatalf("Was expecting %s to be null, got %v (present: %v)", name, v, ok)
+		}
+	}
+	if _, ok := attrs["note"]; ok {
+		t.Fatal("Was expecting the omitempty note to be dropped")
+	}
+	if e, a := "555-0100", attrs["phone"]; e != a {
+		t.Fatalf("Was expecting phone %q, got %v", e, a)
+	}
+}
+
+func TestMarshalPayloadOrderedRelations(t *testing.T) {
+	blog := &Blog{ID: 1, Posts: []*Post{{ID: 2}}, CurrentPost: &Post{ID: 2}}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadOrderedRelations(out, blog); err != nil {
+		t.Fatal(err)
+	}
+	data := out.String()
+	if posts, current := strings.Index(data, `"posts":`), strings.Index(data, `"current_post":`); posts < 0 || current < 0 || posts > current {
+		t.Fatalf("Was expecting posts before current_post, got %s", data)
+	}
+
+	out.Reset()
+	if err := MarshalPayload(out, blog); err != nil {
+		t.Fatal(err)
+	}
+	data = out.String()
+	if posts, current := strings.Index(data, `"posts":`), strings.Index(data, `"current_post":`); posts < current {
+		t.Fatalf("Was expecting alphabetical relationships by default, got %s", data)
+	}
+}
+
+func TestMarshalOrderedRelationships_fields(t *testing.T) {
+	blog := &Blog{ID: 1, Posts: []*Post{{ID: 2}}, CurrentPost: &Post{ID: 2}}
+
+	payload, err := MarshalWithOptions(blog, MarshalOptions{
+		OrderedRelationships: true,
+		Fields:               map[string][]string{"blogs": {"current_post"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Data struct {
+			Relationships map[string]json.RawMessage `json:"relationships"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded.Data.Relationships["posts"]; ok || len(decoded.Data.Relationships) != 1 {
+		t.Fatalf("Was expecting only current_post, got %s", out)
+	}
+}
+
+func TestMarshalUnixTimes(t *testing.T) {
+	synced := time.UnixMilli(1700000000123)
+	reading := &Reading{ID: "1", TakenAt: time.Unix(1700000000, 0), SyncedAt: &synced}
+
+	payload, err := MarshalOne(reading)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := payload.Data.Attributes
+
+	if e, a := int64(1700000000), attrs["taken_at"]; e != a {
+		t.Fatalf("Was expecting taken_at %v, got %v", e, a)
+	}
+	if e, a := int64(1700000000123), attrs["synced_at"]; e != a {
+		t.Fatalf("Was expecting synced_at %v, got %v", e, a)
+	}
+	if _, ok := attrs["archive_at"]; ok {
+		t.Fatal("Was expecting the zero archive_at to be omitted")
+	}
+}
+
+func TestMarshalComplex(t *testing.T) {
+	gain := complex64(complex(0.5, 0.25))
+	signal := &Signal{ID: "1", Impedance: complex(50, -12.5), Gain: &gain}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, signal); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := new(Signal)
+	if err := UnmarshalPayload(bytes.NewReader(out.Bytes()), decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(signal, decoded) {
+		t.Fatalf("Was expecting %+v to round trip, got %+v from %s", signal, decoded, out.String())
+	}
+	if !strings.Contains(out.String(), `"impedance":{"imag":-12.5,"real":50}`) {
+		t.Fatalf("Was expecting impedance as an object, got %s", out.String())
+	}
+}
+
+func TestMarshalPayloadWithExtensions(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithExtensions(out, &Comment{ID: 1}, []string{"https://jsonapi.org/ext/atomic"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"jsonapi":{"ext":["https://jsonapi.org/ext/atomic"]}`) {
+		t.Fatalf("Was expecting the extension in the jsonapi object, got %s", out.String())
+	}
+
+	out.Reset()
+	if err := MarshalPayloadWithExtensions(out, &Comment{ID: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), `"jsonapi"`) {
+		t.Fatalf("Was not expecting a jsonapi object, got %s", out.String())
+	}
+}
+
+func TestMarshalPayloadWithNodeMeta(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithNodeMeta(out, testBlog(), map[Identifier]*Meta{
+		{Type: "blogs", ID: "5"}:    {"detail": "overridden", "can-edit": true},
+		{Type: "comments", ID: "3"}: {"can-delete": false},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload OnePayload
+	if err := json.Unmarshal(out.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := (Meta{"detail": "overridden", "can-edit": true}), *payload.Data.Meta; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting the blog meta %v, got %v", e, a)
+	}
+	for _, n := range payload.Included {
+		switch {
+		case n.Type == "comments" && n.ID == "3":
+			if n.Meta == nil || (*n.Meta)["can-delete"] != false {
+				t.Fatalf("Was expecting the meta of comment 3, got %v", n.Meta)
+			}
+		case n.Type == "comments" && n.Meta != nil:
+			t.Fatalf("Was not expecting meta for %s %s, got %v", n.Type, n.ID, *n.Meta)
+		}
+	}
+}
+
+func TestMarshalPayloadWithNodeMeta_typeWildcard(t *testing.T) {
+	payload, err := MarshalWithOptions(testBlog(), MarshalOptions{NodeMeta: map[Identifier]*Meta{
+		{Type: "comments"}:          {"can-delete": false, "can-edit": false},
+		{Type: "comments", ID: "3"}: {"can-delete": true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comments := 0
+	for _, n := range payload.(*OnePayload).Included {
+		if n.Type != "comments" {
+			continue
+		}
+		comments++
+
+		e := Meta{"can-delete": false, "can-edit": false}
+		if n.ID == "3" {
+			e["can-delete"] = true
+		}
+		if n.Meta == nil || !reflect.DeepEqual(e, *n.Meta) {
+			t.Fatalf("Was expecting the meta %v for comment %s, got %v", e, n.ID, n.Meta)
+		}
+	}
+	if comments == 0 {
+		t.Fatal("Was expecting included comments")
+	}
+}
+
+func TestMarshalPayloadWithIDField(t *testing.T) {
+	ledger := &Ledger{ID: 2, UUID: "b2", Parent: &Ledger{ID: 1, UUID: "a1"}}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithIDField(out, ledger, "UUID"); err != nil {
+		t.Fatal(err)
+	}
+	var payload OnePayload
+	if err := json.Unmarshal(out.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "b2", payload.Data.ID; e != a {
+		t.Fatalf("Was expecting id %q, got %q", e, a)
+	}
+	parent := payload.Data.Relationships["parent"].(map[string]interface{})["data"].(map[string]interface{})
+	if e, a := "a1", parent["id"]; e != a {
+		t.Fatalf("Was expecting the parent linkage id %q, got %v", e, a)
+	}
+	if e, a := "a1", payload.Included[0].ID; e != a {
+		t.Fatalf("Was expecting the included parent id %q, got %q", e, a)
+	}
+
+	// a nil pointer id is left empty
+	withoutID, err := MarshalWithOptions(ledger, MarshalOptions{IDField: "NewID"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := withoutID.(*OnePayload).Data.ID; a != "" {
+		t.Fatalf("Was expecting an empty id for a nil NewID, got %q", a)
+	}
+
+	// slices of interfaces are resolved per element
+	newID := "n2"
+	many, err := MarshalWithOptions([]interface{}{&Ledger{ID: 2, NewID: &newID}}, MarshalOptions{IDField: "NewID"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "n2", many.(*ManyPayload).Data[0].ID; e != a {
+		t.Fatalf("Was expecting id %q, got %q", e, a)
+	}
+
+	for _, field := range []string{"Missing", "Balance"} {
+		err := MarshalPayloadWithIDField(bytes.NewBuffer(nil), []*Ledger{ledger}, field)
+		if e, ok := err.(*ErrInvalidIDField); !ok || e.Field != field {
+			t.Fatalf("Was expecting an *ErrInvalidIDField for %s, got %v", field, err)
+		}
+	}
+}
+
+func TestMarshalSliceRefRelationship(t *testing.T) {
+	for _, tc := range []struct {
+		comments *[]*Comment
+		expected string
+	}{
+		{nil, ``},
+		{&[]*Comment{}, `"relationships":{"comments":{"data":[]}}`},
+		{&[]*Comment{{ID: 1}}, `"relationships":{"comments":{"data":[{"type":"comments","id":"1"}]}}`},
+	} {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayload(out, &Thread{ID: "1", Comments: tc.comments}); err != nil {
+			t.Fatal(err)
+		}
+		hasRelationships := strings.Contains(out.String(), `"relationships"`)
+		if tc.expected == "" && hasRelationships {
+			t.Fatalf("Was not expecting the comments relationship, got %s", out.String())
+		}
+		if tc.expected != "" && !strings.Contains(out.String(), tc.expected) {
+			t.Fatalf("Was expecting %s, got %s", tc.expected, out.String())
+		}
+
+		thread := new(Thread)
+		if err := UnmarshalPayload(out, thread); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case tc.comments == nil:
+			if thread.Comments != nil {
+				t.Fatalf("Was expecting nil comments, got %v", *thread.Comments)
+			}
+		case thread.Comments == nil || *thread.Comments == nil:
+			t.Fatal("Was expecting a pointer to a non-nil slice of comments")
+		case len(*thread.Comments) != len(*tc.comments):
+			t.Fatalf("Was expecting %d comments, got %d", len(*tc.comments), len(*thread.Comments))
+		}
+	}
+}
+
+func TestMarshalPayloadWithValidators(t *testing.T) {
+	errNoSelfLink := errors.New("resource without a self link")
+	selfLinks := func(p Payloader) error {
+		var nodes []*Node
+		switch p := p.(type) {
+		case *OnePayload:
+			nodes = append([]*Node{p.Data}, p.Included...)
+		case *ManyPayload:
+			nodes = append(append(nodes, p.Data...), p.Included...)
+		}
+		for _, n := range nodes {
+			if n == nil {
+				continue
+			}
+			if _, ok := n.Links.Href(KeySelfLink); !ok {
+				return fmt.Errorf("%w: %s %s", errNoSelfLink, n.Type, n.ID)
+			}
+		}
+		return nil
+	}
+	valid := func(p Payloader) error {
+		switch p := p.(type) {
+		case *OnePayload:
+			return p.Validate()
+		case *ManyPayload:
+			return p.Validate()
+		}
+		return nil
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithValidators(out, &Comment{ID: 1}, valid); err != nil {
+		t.Fatal(err)
+	}
+
+	// the validators see the payload after include filtering
+	_, err := MarshalWithOptions(testBlog(), MarshalOptions{
+		IncludeRelationPaths: []string{},
+		Validators:           []func(Payloader) error{valid, selfLinks},
+	})
+	if err != nil {
+		t.Fatalf("Was not expecting an error, got %v", err)
+	}
+
+	out.Reset()
+	err = MarshalPayloadWithValidators(out, testBlog(), valid, selfLinks)
+	if !errors.Is(err, errNoSelfLink) {
+		t.Fatalf("Was expecting the self link validator to fail, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("Was not expecting the payload to be written, got %s", out.String())
+	}
+}
+
+func TestMarshalExtensions_withJSONAPI(t *testing.T) {
+	jsonapi := &JSONAPIObject{Version: "1.1", Ext: []string{"https://example.com/ext/a"}}
+
+	payload, err := MarshalWithOptions(&Comment{ID: 1}, MarshalOptions{
+		JSONAPI:    jsonapi,
+		Extensions: []string{"https://example.com/ext/b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj := payload.(*OnePayload).JSONAPI
+	if e, a := "1.1", obj.Version; e != a {
+		t.Fatalf("Was expecting version %q, got %q", e, a)
+	}
+	if e, a := []string{"https://example.com/ext/a", "https://example.com/ext/b"}, obj.Ext; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting extensions %v, got %v", e, a)
+	}
+	if len(jsonapi.Ext) != 1 {
+		t.Fatalf("Was not expecting the options' jsonapi object to change, got %v", jsonapi.Ext)
+	}
+}
+
+func TestMarshalIdentifierRelations(t *testing.T) {
+	shipment := &Shipment{
+		ID:       "1",
+		Customer: Identifier{Type: "customers", ID: "c-9"},
+		Parcels:  []Identifier{{Type: "parcels", ID: "p-1"}, {Type: "parcels", ID: "p-2"}},
+	}
+
+	payload, err := MarshalOne(shipment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relationships := payload.Data.Relationships
+
+	customer := relationships["customer"].(*RelationshipOneNode)
+	if e, a := "customers,c-9", customer.Data.key(); e != a {
+		t.Fatalf("Was expecting customer linkage %q, got %q", e, a)
+	}
+	parcels := relationships["parcels"].(*RelationshipManyNode)
+	if len(parcels.Data) != 2 || parcels.Data[1].ID != "p-2" {
+		t.Fatalf("Was expecting 2 parcels, got %v", parcels.Data)
+	}
+	if _, ok := relationships["carrier"]; ok {
+		t.Fatal("Was expecting the nil carrier to be omitted")
+	}
+	if len(payload.Included) != 0 {
+		t.Fatalf("Was not expecting included resources, got %v", payload.Included)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, shipment); err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(Shipment)
+	if err := UnmarshalPayload(out, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(shipment, decoded) {
+		t.Fatalf("Was expecting %+v to round trip, got %+v", shipment, decoded)
+	}
+}
+
+func TestMarshalRelationSort(t *testing.T) {
+	post := &SortedPost{
+		ID:       "1",
+		Comments: []*Comment{{ID: 1, Body: "c"}, {ID: 2, Body: "a"}, {ID: 3, Body: "b"}},
+		Latest: []*OrderedComment{
+			{ID: "x", Order: 2}, {ID: "y", Order: 3}, {ID: "z", Order: 1},
+		},
+	}
+
+	payload, err := Marshal(post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relationships := payload.(*OnePayload).Data.Relationships
+
+	var ids []string
+	for _, n := range relationships["comments"].(*RelationshipManyNode).Data {
+		ids = append(ids, n.ID)
+	}
+	if e, a := []string{"2", "3", "1"}, ids; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting comments sorted by body %v, got %v", e, a)
+	}
+
+	// descending, sorted before max is applied
+	ids = nil
+	for _, n := range relationships["latest"].(*RelationshipManyNode).Data {
+		ids = append(ids, n.ID)
+	}
+	if e, a := []string{"y", "x"}, ids; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting latest sorted by descending order %v, got %v", e, a)
+	}
+
+	if e, a := 1, post.Comments[0].ID; e != a {
+		t.Fatalf("Was expecting the model's slice to be left untouched, got first comment %d", a)
+	}
+}
+
+func TestMarshalRelationSort_unknownAttribute(t *testing.T) {
+	type badSort struct {
+		ID       string     `jsonapi:"primary,posts"`
+		Comments []*Comment `jsonapi:"relation,comments,sort=created"`
+	}
+
+	if _, err := Marshal(&badSort{ID: "1", Comments: []*Comment{{ID: 1}}}); err != ErrBadJSONAPIStructTag {
+		t.Fatalf("Was expecting ErrBadJSONAPIStructTag, got %v", err)
+	}
+}
+
+func TestMarshalRelationSort_polymorphic(t *testing.T) {
+	type board struct {
+		ID    string        `jsonapi:"primary,boards"`
+		Items []interface{} `jsonapi:"relation,items,sort=title"`
+	}
+
+	b := &board{ID: "1", Items: []interface{}{
+		&Post{ID: 1, Title: "c"}, &Task{ID: "2", Title: "a"}, &Post{ID: 3, Title: "b"},
+	}}
+	payload, err := Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, n := range payload.(*OnePayload).Data.Relationships["items"].(*RelationshipManyNode).Data {
+		ids = append(ids, n.ID)
+	}
+	if e, a := []string{"2", "3", "1"}, ids; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting items sorted by title %v, got %v", e, a)
+	}
+
+	b.Items = append(b.Items, &Comment{ID: 4})
+	if _, err := Marshal(b); err != ErrBadJSONAPIStructTag {
+		t.Fatalf("Was expecting ErrBadJSONAPIStructTag for an item without a title, got %v", err)
+	}
+}
+
+func TestMarshalComputedAttrs(t *testing.T) {
+	person := &Person{ID: "1", First: "Ada", Last: "Lovelace", Role: "admin"}
+
+	payload, err := Marshal(person)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes := payload.(*OnePayload).Data.Attributes
+
+	for k, e := range map[string]interface{}{
+		"full-name": "Ada Lovelace",
+		"first":     "Augusta",
+		"role":      "ADMIN",
+	} {
+		if a := attributes[k]; e != a {
+			t.Fatalf("Was expecting attribute %s to be %v, got %v", k, e, a)
+		}
+	}
+}
+
+func TestMarshalComputedAttrs_conflicts(t *testing.T) {
+	person := &Person{ID: "1", First: "Ada", Last: "Lovelace", Role: "admin"}
+
+	payload, err := MarshalWithOptions(person, MarshalOptions{ComputedConflicts: ComputedKeepField})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes := payload.(*OnePayload).Data.Attributes
+	if e, a := "Ada", attributes["first"]; e != a {
+		t.Fatalf("Was expecting the field's first %q, got %v", e, a)
+	}
+	if e, a := "ADMIN", attributes["role"]; e != a {
+		t.Fatalf("Was expecting the overridden role %q, got %v", e, a)
+	}
+
+	_, err = MarshalWithOptions(person, MarshalOptions{ComputedConflicts: ComputedError})
+	if e, ok := err.(*ErrComputedConflict); !ok || e.Attribute != "first" {
+		t.Fatalf("Was expecting an *ErrComputedConflict for first, got %v", err)
+	}
+}
+
+func TestMarshalComputedAttrs_omittedField(t *testing.T) {
+	handle := &Handle{ID: "1"}
+
+	payload, err := MarshalWithOptions(handle, MarshalOptions{ComputedConflicts: ComputedKeepField})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nick, ok := payload.(*OnePayload).Data.Attributes["nick"]; ok {
+		t.Fatalf("Was expecting the empty nick field to be kept omitted, got %v", nick)
+	}
+
+	_, err = MarshalWithOptions(handle, MarshalOptions{ComputedConflicts: ComputedError})
+	if e, ok := err.(*ErrComputedConflict); !ok || e.Attribute != "nick" {
+		t.Fatalf("Was expecting an *ErrComputedConflict for nick, got %v", err)
+	}
+}
+
+func TestMarshalMethodAttrs(t *testing.T) {
+	member := &Member{ID: "1", First: "Ada", Last: "Lovelace", Born: time.Date(1815, 12, 10, 0, 0, 0, 0, time.UTC)}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, member); err != nil {
+		t.Fatal(err)
+	}
+	var payload OnePayload
+	if err := json.Unmarshal(out.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "Ada Lovelace", payload.Data.Attributes["full_name"]; e != a {
+		t.Fatalf("Was expecting full_name %q, got %v", e, a)
+	}
+	if e, a := "1833-12-10T00:00:00Z", payload.Data.Attributes["joined"]; e != a {
+		t.Fatalf("Was expecting joined %q, got %v", e, a)
+	}
+
+	// method-backed attributes are read-only
+	decoded := new(Member)
+	if err := UnmarshalPayload(bytes.NewReader(out.Bytes()), decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.FullName() != member.FullName() {
+		t.Fatalf("Was expecting %q, got %q", member.FullName(), decoded.FullName())
+	}
+	if _, err := UnmarshalPayloadDiff(bytes.NewReader(out.Bytes()), decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	type broken struct {
+		ID string   `jsonapi:"primary,broken"`
+		_  struct{} `jsonapi:"attr,missing,method=Missing"`
+	}
+	err := MarshalPayload(bytes.NewBuffer(nil), &broken{ID: "1"})
+	if e, ok := err.(*ErrAttrMethod); !ok || e.Method != "Missing" {
+		t.Fatalf("Was expecting an *ErrAttrMethod, got %v", err)
+	}
+}
+
+func TestMarshalWithOptions_alwaysEmitIncluded(t *testing.T) {
+	for _, models := range []interface{}{&Comment{ID: 1}, []*Comment{{ID: 1}}} {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayload(out, models); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(out.String(), `"included"`) {
+			t.Fatalf("Was expecting included to be omitted, got %s", out.String())
+		}
+
+		out.Reset()
+		if err := MarshalPayloadWithOptions(out, models, MarshalOptions{AlwaysEmitIncluded: true}); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), `"included":[]`) {
+			t.Fatalf("Was expecting an empty included array, got %s", out.String())
+		}
+	}
+
+	// non-empty included arrays are unchanged
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithOptions(out, testBlog(), MarshalOptions{AlwaysEmitIncluded: true}); err != nil {
+		t.Fatal(err)
+	}
+	payload := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Included) == 0 {
+		t.Fatal("Was expecting included resources")
+	}
+}
+
+func TestMarshalIncludeProvider(t *testing.T) {
+	review := &Review{ID: "1", AuthorID: 7, author: &Comment{ID: 7, Body: "Author"}}
+
+	for _, models := range []interface{}{review, []*Review{review}} {
+		payload, err := Marshal(models)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		included := payload.includedNodes()
+		if e, a := 1, len(included); e != a {
+			t.Fatalf("Was expecting %d included resource, got %d", e, a)
+		}
+		if e, a := "Author", included[0].Attributes["body"]; e != a {
+			t.Fatalf("Was expecting the provided comment, got %v", included[0].Attributes)
+		}
+	}
+}
+
+func TestMarshalEmptyRelationships(t *testing.T) {
+	vehicle := &Vehicle{ID: "1", Kind: "cars", Wheels: 4}
+
+	payload, err := Marshal(vehicle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relationships := payload.(*OnePayload).Data.Relationships; relationships != nil {
+		t.Fatalf("Was expecting nil relationships, got %v", relationships)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, vehicle); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), `"relationships"`) {
+		t.Fatalf("Was expecting relationships to be omitted, got %s", out.String())
+	}
+
+	out.Reset()
+	if err := MarshalPayloadWithOptions(out, vehicle, MarshalOptions{EmitEmptyRelationships: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"relationships":{}`) {
+		t.Fatalf("Was expecting an empty relationships object, got %s", out.String())
+	}
+
+	// models without relation fields are unaffected
+	out.Reset()
+	if err := MarshalPayloadWithOptions(out, &Tag{ID: "1"}, MarshalOptions{EmitEmptyRelationships: true}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), `"relationships"`) {
+		t.Fatalf("Was expecting relationships to be omitted, got %s", out.String())
+	}
+}
+
+func TestMarshalWithOptions_zeroTimes(t *testing.T) {
+	now := time.Now()
+	model := &TimestampModel{ID: 1, RFC3339V: now, ISO8601P: &now}
+
+	attributes := func(options MarshalOptions) map[string]interface{} {
+		payload, err := MarshalWithOptions(model, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return payload.(*OnePayload).Data.Attributes
+	}
+
+	if _, ok := attributes(MarshalOptions{})["iso8601v"]; ok {
+		t.Fatal("Was expecting the zero time to be omitted by default")
+	}
+
+	attrs := attributes(MarshalOptions{ZeroTimes: ZeroTimeNull})
+	if v, ok := attrs["iso8601v"]; !ok || v != nil {
+		t.Fatalf("Was expecting a null iso8601v, got %v", v)
+	}
+	if v, ok := attrs["defaultv"]; !ok || v != nil {
+		t.Fatalf("Was expecting a null defaultv, like the other formats, got %v", v)
+	}
+	if attrs["rfc3339v"] == nil {
+		t.Fatal("Was expecting the set rfc3339v")
+	}
+
+	_, err := MarshalWithOptions(model, MarshalOptions{ZeroTimes: ZeroTimeError})
+	var zeroTime *ErrZeroTime
+	if !errors.As(err, &zeroTime) {
+		t.Fatalf("Was expecting an ErrZeroTime, got %v", err)
+	}
+	if e, a := "defaultv", zeroTime.Attribute; e != a {
+		t.Fatalf("Was expecting attribute %q, got %q", e, a)
+	}
+}
+
+func TestMarshalWithOptions_includeDepths(t *testing.T) {
+	for _, tc := range []struct {
+		depths   map[string]int
+		expected []string
+	}{
+		{
+			depths:   map[string]int{"posts": 1, "current_post": 1},
+			expected: []string{"posts,1", "posts,2"},
+		},
+		{
+			// comments 1 and 2 are still reached through current_post
+			depths:   map[string]int{"posts": 1},
+			expected: []string{"comments,1", "comments,2", "posts,1", "posts,2"},
+		},
+		{
+			depths:   map[string]int{"posts": 0, "current_post.comments": 0},
+			expected: []string{"comments,1", "posts,1"},
+		},
+		{
+			depths:   map[string]int{"posts.latest_comment": 1},
+			expected: []string{"comments,1", "comments,2", "comments,3", "posts,1", "posts,2"},
+		},
+	} {
+		payload, err := MarshalWithOptions(testBlog(), MarshalOptions{IncludeDepths: tc.depths})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		for _, n := range payload.includedNodes() {
+			keys = append(keys, n.Type+","+n.ID)
+		}
+		sort.Strings(keys)
+
+		if !reflect.DeepEqual(tc.expected, keys) {
+			t.Fatalf("With depths %v, was expecting included %v, got %v", tc.depths, tc.expected, keys)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package jsonapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// NodeIterator decodes the resources of a many payload's "data" array one at
+// a time, see UnmarshalManyPayloadStream.
+type NodeIterator struct {
+	// JSONAPI, Links, Meta and Errors hold the top-level members of the
+	// document. Members following the "data" array are only set once Next
+	// returned false.
+	JSONAPI *JSONAPIObject
+	Links   *Links
+	Meta    *Meta
+	Errors  []*ErrorObject
+
+	dec      *json.Decoder
+	included map[string]*Node
+	done     bool
+	err      error
+}
+
+// UnmarshalManyPayloadStream reads a jsonapi payload with many records from
+// in, decoding one element of the "data" array per call to Next instead of
+// the whole document at once. This keeps memory flat for collections with a
+// large number of resources:
+//
+//	it, err := jsonapi.UnmarshalManyPayloadStream(resp.Body)
+//	if err != nil {
+//		return err
+//	}
+//	for {
+//		post := new(Post)
+//		if !it.Next(post) {
+//			break
+//		}
+//		// process post
+//	}
+//	if err := it.Err(); err != nil {
+//		return err
+//	}
+//
+// Relationships are resolved against the "included" array only when it
+// precedes "data" in the document; otherwise just the related ids are set.
+func UnmarshalManyPayloadStream(in io.Reader) (*NodeIterator, error) {
+	it := &NodeIterator{dec: json.NewDecoder(in)}
+
+	if err := it.expectDelim('{'); err != nil {
+		return nil, err
+	}
+
+	for {
+		key, ok, err := it.nextKey()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrMissingData
+		}
+
+		if key != "data" {
+			if err := it.decodeMember(key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		tok, err := it.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if tok == nil {
+			// "data": null holds no resources
+			it.done = true
+			return it, it.readRest()
+		}
+		if tok != json.Delim('[') {
+			return nil, fmt.Errorf("jsonapi: expected the data array, got %v", tok)
+		}
+		if len(it.Errors) > 0 {
+			return nil, ErrDataWithErrors
+		}
+
+		return it, nil
+	}
+}
+
+// Next decodes the next resource of the "data" array into model, a struct
+// pointer, and reports whether there was one. It returns false at the end of
+// the array or when decoding failed, which Err tells apart.
+func (it *NodeIterator) Next(model interface{}) bool {
+	if it.done || it.err != nil {
+		return false
+	}
+
+	if !it.dec.More() {
+		it.done = true
+		if err := it.expectDelim(']'); err != nil {
+			it.err = err
+			return false
+		}
+		it.err = it.readRest()
+		return false
+	}
+
+	node := new(Node)
+	if err := it.dec.Decode(node); err != nil {
+		it.err = err
+		return false
+	}
+
+	var included *map[string]*Node
+	if it.included != nil {
+		included = &it.included
+	}
+	if err := unmarshalNode(node, reflect.ValueOf(model), included, nil); err != nil {
+		it.err = err
+		return false
+	}
+
+	return true
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *NodeIterator) Err() error {
+	return it.err
+}
+
+// readRest decodes the members following the "data" array.
+func (it *NodeIterator) readRest() error {
+	for {
+		key, ok, err := it.nextKey()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if err := it.decodeMember(key); err != nil {
+			return err
+		}
+	}
+
+	if len(it.Errors) > 0 {
+		return ErrDataWithErrors
+	}
+	return nil
+}
+
+// nextKey returns the key of the next top-level member, or false at the end
+// of the document.
+func (it *NodeIterator) nextKey() (string, bool, error) {
+	tok, err := it.dec.Token()
+	if err != nil {
+		return "", false, err
+	}
+	if tok == json.Delim('}') {
+		return "", false, nil
+	}
+
+	key, ok := tok.(string)
+	if !ok {
+		return "", false, fmt.Errorf("jsonapi: unexpected token %v", tok)
+	}
+	return key, true, nil
+}
+
+func (it *NodeIterator) decodeMember(key string) error {
+	switch key {
+	case "jsonapi":
+		return it.dec.Decode(&it.JSONAPI)
+	case "links":
+		return it.dec.Decode(&it.Links)
+	case "meta":
+		return it.dec.Decode(&it.Meta)
+	case "errors":
+		return it.dec.Decode(&it.Errors)
+	case "included":
+		var nodes []*Node
+		if err := it.dec.Decode(&nodes); err != nil {
+			return err
+		}
+		it.included = make(map[string]*Node, len(nodes))
+		for _, n := range nodes {
+			if n == nil {
+				continue
+			}
+			it.included[n.key()] = n
+		}
+		return nil
+	default:
+		var skipped json.RawMessage
+		return it.dec.Decode(&skipped)
+	}
+}
+
+func (it *NodeIterator) expectDelim(delim json.Delim) error {
+	tok, err := it.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("jsonapi: expected %v, got %v", delim, tok)
+	}
+	return nil
+}
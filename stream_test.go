@@ -0,0 +1,106 @@
+package jsonapi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalManyPayloadStream(t *testing.T) {
+	posts := []*Post{
+		{ID: 1, Title: "First", Comments: []*Comment{{ID: 1, Body: "Comment"}}},
+		{ID: 2, Title: "Second"},
+	}
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, posts); err != nil {
+		t.Fatal(err)
+	}
+	// append a top-level meta after the included resources
+	doc := strings.TrimSuffix(strings.TrimSpace(out.String()), "}") + `,"meta":{"total":2}}`
+
+	it, err := UnmarshalManyPayloadStream(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var titles []string
+	for {
+		post := new(Post)
+		if !it.Next(post) {
+			break
+		}
+		titles = append(titles, post.Title)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := "First,Second", strings.Join(titles, ","); e != a {
+		t.Fatalf("Was expecting the posts %s, got %s", e, a)
+	}
+	if it.Meta == nil || (*it.Meta)["total"] != float64(2) {
+		t.Fatalf("Was expecting the top-level meta, got %v", it.Meta)
+	}
+}
+
+func TestUnmarshalManyPayloadStream_includedFirst(t *testing.T) {
+	doc := `{
+		"included": [{"type": "comments", "id": "1", "attributes": {"body": "Included"}}],
+		"data": [{"type": "posts", "id": "1", "relationships": {
+			"comments": {"data": [{"type": "comments", "id": "1"}]}
+		}}],
+		"links": {"next": "/posts?page=2"}
+	}`
+
+	it, err := UnmarshalManyPayloadStream(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := new(Post)
+	if !it.Next(post) {
+		t.Fatalf("Was expecting a post, got error %v", it.Err())
+	}
+	if e, a := "Included", post.Comments[0].Body; e != a {
+		t.Fatalf("Was expecting the included comment body %q, got %q", e, a)
+	}
+
+	if it.Next(new(Post)) {
+		t.Fatal("Was expecting the end of the data array")
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if it.Links == nil || (*it.Links)["next"] != "/posts?page=2" {
+		t.Fatalf("Was expecting the next link, got %v", it.Links)
+	}
+}
+
+func TestUnmarshalManyPayloadStream_errors(t *testing.T) {
+	if _, err := UnmarshalManyPayloadStream(strings.NewReader(`{"meta": {}}`)); err != ErrMissingData {
+		t.Fatalf("Was expecting ErrMissingData, got %v", err)
+	}
+
+	doc := `{"data": [{"type": "posts", "id": "1"}, {"type": "posts", "id": 2`
+	it, err := UnmarshalManyPayloadStream(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next(new(Post)) {
+		t.Fatalf("Was expecting the first post, got error %v", it.Err())
+	}
+	if it.Next(new(Post)) {
+		t.Fatal("Was expecting the truncated post to fail")
+	}
+	if it.Err() == nil {
+		t.Fatal("Was expecting a decode error")
+	}
+
+	it, err = UnmarshalManyPayloadStream(strings.NewReader(`{"data": [{"type": "blogs", "id": "1"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Next(new(Post)) || it.Err() == nil {
+		t.Fatal("Was expecting a type mismatch error")
+	}
+}
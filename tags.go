@@ -0,0 +1,54 @@
+package jsonapi
+
+import "strings"
+
+// validTagArgs reports whether the tag args hold the arguments their
+// annotation takes. A "links" tag may name a relationship or stand alone.
+func validTagArgs(args []string) bool {
+	switch annotation := args[0]; {
+	case annotation == annotationLinks:
+		return len(args) <= 2
+	case isSingleArgAnnotation(annotation):
+		return len(args) == 1
+	default:
+		return len(args) >= 2
+	}
+}
+
+// tagOptionValue returns the value of a "name=value" tag option when arg is
+// an option with the given name.
+func tagOptionValue(arg, name string) (string, bool) {
+	k, v, found := strings.Cut(arg, annotationValueSep)
+	if !found || k != name {
+		return "", false
+	}
+	return v, true
+}
+
+// tagOptionArg returns the value of the "name=value" option among the extra
+// arguments of the tag args, following the annotation and name.
+func tagOptionArg(args []string, name string) (string, bool) {
+	if len(args) < 3 {
+		return "", false
+	}
+	for _, arg := range args[2:] {
+		if v, ok := tagOptionValue(arg, name); ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// hasTagOption reports whether the extra arguments of the tag args, following
+// the annotation and name, include option.
+func hasTagOption(args []string, option string) bool {
+	if len(args) < 3 {
+		return false
+	}
+	for _, arg := range args[2:] {
+		if arg == option {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package jsonapi
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrViolation is a violation of the JSON API specification found by
+// Validate.
+type ErrViolation struct {
+	// Pointer is a JSON Pointer (RFC6901) to the offending member, e.g.
+	// "/data/attributes/id".
+	Pointer string
+	Reason  string
+}
+
+func (e *ErrViolation) Error() string {
+	return fmt.Sprintf("jsonapi: %s: %s", e.Pointer, e.Reason)
+}
+
+// Validate checks that the resource object n conforms to the specification:
+// it has a type, doesn't have both an id and a lid, has no attribute named
+// "type" or "id", no relationship sharing its name with an attribute, and
+// valid links. Every violation is reported, joined with errors.Join, as an
+// *ErrViolation with a pointer relative to the resource object.
+func (n *Node) Validate() error {
+	return errors.Join(n.violations("")...)
+}
+
+// Validate checks the primary and included resources of the document with
+// Node.Validate, with pointers from the root of the document.
+func (p *OnePayload) Validate() error {
+	var errs []error
+	if p.Data != nil {
+		errs = append(errs, p.Data.violations("/data")...)
+	}
+	errs = append(errs, includedViolations(p.Included)...)
+	return errors.Join(errs...)
+}
+
+// Validate checks the primary and included resources of the document with
+// Node.Validate, with pointers from the root of the document.
+func (p *ManyPayload) Validate() error {
+	var errs []error
+	for i, n := range p.Data {
+		if n != nil {
+			errs = append(errs, n.violations("/data/"+strconv.Itoa(i))...)
+		}
+	}
+	errs = append(errs, includedViolations(p.Included)...)
+	return errors.Join(errs...)
+}
+
+func includedViolations(included []*Node) []error {
+	var errs []error
+	for i, n := range included {
+		if n != nil {
+			errs = append(errs, n.violations("/included/"+strconv.Itoa(i))...)
+		}
+	}
+	return errs
+}
+
+// violations returns the violations of n, with pointers prefixed by pointer.
+func (n *Node) violations(pointer string) []error {
+	var errs []error
+	violation := func(member, reason string) {
+		errs = append(errs, &ErrViolation{Pointer: pointer + member, Reason: reason})
+	}
+
+	if n.Type == "" {
+		violation("/type", "the type must not be empty")
+	}
+	if n.ID != "" && n.LID != "" {
+		violation("/lid", "a resource must not have both an id and a lid")
+	}
+
+	for _, name := range sortedKeys(n.Attributes) {
+		if name == "type" || name == "id" {
+			violation("/attributes/"+escapePointer(name), fmt.Sprintf("an attribute must not be named %q", name))
+		}
+	}
+	for _, name := range sortedKeys(n.Relationships) {
+		if _, ok := n.Attributes[name]; ok {
+			violation("/relationships/"+escapePointer(name), fmt.Sprintf("the relationship %q has the name of an attribute", name))
+		}
+		if links := relationshipLinks(n, name); links != nil {
+			if err := links.validate(); err != nil {
+				violation("/relationships/"+escapePointer(name)+"/links", err.Error())
+			}
+		}
+	}
+
+	if n.Links != nil {
+		if err := n.Links.validate(); err != nil {
+			violation("/links", err.Error())
+		}
+	}
+
+	return errs
+}
+
+// sortedKeys returns the keys of m in order, so violations are reported
+// deterministically.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapePointer escapes a member name for use as a JSON Pointer reference
+// token.
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
@@ -0,0 +1,72 @@
+package jsonapi
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNodeValidate(t *testing.T) {
+	valid := &Node{
+		Type:       "posts",
+		ID:         "1",
+		Attributes: map[string]interface{}{"title": "Hello"},
+		Relationships: map[string]interface{}{
+			"author": &RelationshipOneNode{Data: &Node{Type: "people", ID: "9"}},
+		},
+		Links: &Links{"self": "https://example.com/posts/1"},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Was not expecting an error, got %v", err)
+	}
+
+	invalid := &Node{
+		ID:         "1",
+		LID:        "local",
+		Attributes: map[string]interface{}{"id": "1", "type": "posts", "author": "Jane"},
+		Relationships: map[string]interface{}{
+			"author": &RelationshipOneNode{Data: &Node{Type: "people", ID: "9"}},
+		},
+		Links: &Links{"self": 42},
+	}
+	var pointers []string
+	for _, err := range invalid.Validate().(interface{ Unwrap() []error }).Unwrap() {
+		var violation *ErrViolation
+		if !errors.As(err, &violation) {
+			t.Fatalf("Was expecting an ErrViolation, got %v", err)
+		}
+		pointers = append(pointers, violation.Pointer)
+	}
+	if e, a := []string{
+		"/type", "/lid", "/attributes/id", "/attributes/type", "/relationships/author", "/links",
+	}, pointers; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting violations at %v, got %v", e, a)
+	}
+}
+
+func TestPayloadValidate(t *testing.T) {
+	payload := &ManyPayload{
+		Data:     []*Node{{Type: "posts", ID: "1"}, {ID: "2"}},
+		Included: []*Node{{Type: "comments", ID: "1", Attributes: map[string]interface{}{"a/b": 1, "type": "x"}}},
+	}
+
+	err := payload.Validate()
+	var pointers []string
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		pointers = append(pointers, err.(*ErrViolation).Pointer)
+	}
+	if e, a := []string{"/data/1/type", "/included/0/attributes/type"}, pointers; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting violations at %v, got %v", e, a)
+	}
+
+	one := &OnePayload{Data: &Node{Type: "posts", ID: "1", Relationships: map[string]interface{}{
+		"comments": &RelationshipManyNode{Links: &Links{"related": Link{Href: "/posts/1/comments"}}},
+	}}}
+	if err := one.Validate(); err != nil {
+		t.Fatalf("Was not expecting an error, got %v", err)
+	}
+	one.Data.Relationships["comments"].(*RelationshipManyNode).Links = &Links{"related": 1}
+	if e, a := "jsonapi: /data/relationships/comments/links: The related member of the links object was not a string or link object", one.Validate().Error(); e != a {
+		t.Fatalf("Was expecting %q, got %q", e, a)
+	}
+}